@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/go-pkgz/lgr"
+	"github.com/spf13/viper"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var adminAddr string
+
+// defaultAdminAddr is a Unix socket in the config directory, only the user running the proxy
+// can connect to it
+var defaultAdminAddr = "unix:" + filepath.Join(configPath(), "admin.sock")
+
+func init() {
+	// the commands controlling the running proxy share the address of its admin API
+	rootCmd.PersistentFlags().StringVar(
+		&adminAddr,
+		"admin",
+		defaultAdminAddr,
+		"Address of the admin API of the running proxy, see --admin-listen, e.g. localhost:3129",
+	)
+	err := viper.BindPFlag("admin", rootCmd.PersistentFlags().Lookup("admin"))
+	if err != nil {
+		log.Printf("[PANIC] could not bind admin flag: %v", err)
+		os.Exit(1)
+	}
+}
+
+// adminSocket returns the path of the Unix socket of admin addresses of the form unix:PATH
+func adminSocket(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, "unix:"), true
+}
+
+// listenAdmin listens on the TCP address or Unix socket of the admin API
+func listenAdmin(addr string) (net.Listener, error) {
+	path, ok := adminSocket(addr)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	// the socket of a previous run is left behind if it was killed
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// only the user running the proxy may control it
+	if err := os.Chmod(path, 0600); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// adminRequest sends in as JSON to the admin API of the running proxy and decodes the response
+// into out
+func adminRequest(method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	addr := viper.GetString("admin")
+	client := &http.Client{Timeout: 30 * time.Second}
+	if socket, ok := adminSocket(addr); ok {
+		addr = "unix"
+		client.Transport = &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}}
+	}
+	req, err := http.NewRequest(method, "http://"+addr+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("is the proxy running? %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s", strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	log "github.com/go-pkgz/lgr"
+	"github.com/spf13/cobra"
+	myhttp "github.com/tipok/kubeproxy/http"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var caOut string
+
+var caCmd = &cobra.Command{
+	Use:   "ca",
+	Short: "Manage the CA used for TLS interception",
+	Long:  `Manage the CA used to intercept TLS connections to cluster hosts with --mitm.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := cmd.Help()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+var caExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the CA certificate",
+	Long:  `Export the CA certificate in PEM format, so it can be added to the trust store of clients. The CA is created if it doesn't exist yet.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		initLogging()
+		exportCA()
+	},
+}
+
+func init() {
+	caExportCmd.Flags().StringVar(
+		&caOut,
+		"out",
+		"",
+		"File to write the CA certificate to (default is stdout)",
+	)
+
+	caCmd.AddCommand(caExportCmd)
+	rootCmd.AddCommand(caCmd)
+}
+
+// loadCA loads the CA from the config directory, creating it if necessary
+func loadCA() *tls.Certificate {
+	dir := configDir()
+	ca, err := myhttp.LoadOrCreateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		log.Fatalf("[PANIC] could not load CA: %v", err)
+	}
+	return ca
+}
+
+func exportCA() {
+	ca := loadCA()
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]})
+	if caOut == "" {
+		fmt.Print(string(certPEM))
+		return
+	}
+	if err := ioutil.WriteFile(caOut, certPEM, 0644); err != nil {
+		log.Fatalf("[PANIC] could not write CA certificate: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+	log "github.com/go-pkgz/lgr"
+	"github.com/spf13/cobra"
+	myhttp "github.com/tipok/kubeproxy/http"
+	"net/http"
+	"os"
+)
+
+var captureCmd = &cobra.Command{
+	Use:   "capture",
+	Short: "Capture requests of the running proxy",
+	Long:  `Capture the requests to cluster hosts sent through the running HTTP proxy to a HAR file.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := cmd.Help()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+var captureStartCmd = &cobra.Command{
+	Use:   "start NAME",
+	Short: "Start capturing to a HAR file",
+	Long: `Start capturing requests to the HAR file NAME in the capture directory of the proxy (--capture-dir),
+the file is written when the capture is stopped.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		initLogging()
+		var resp myhttp.CaptureResponse
+		if err := adminRequest(http.MethodPost, "/capture/start", &myhttp.CaptureRequest{File: args[0]}, &resp); err != nil {
+			log.Fatalf("[PANIC] could not start capture: %v", err)
+		}
+		fmt.Printf("capturing to %s\n", resp.File)
+	},
+}
+
+var captureStopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stop capturing and write the HAR file",
+	Long:  `Stop capturing and write the HAR file.`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		initLogging()
+		var resp myhttp.CaptureResponse
+		if err := adminRequest(http.MethodPost, "/capture/stop", nil, &resp); err != nil {
+			log.Fatalf("[PANIC] could not stop capture: %v", err)
+		}
+		fmt.Printf("wrote %d requests to %s\n", resp.Entries, resp.File)
+	},
+}
+
+func init() {
+	captureCmd.AddCommand(captureStartCmd, captureStopCmd)
+	rootCmd.AddCommand(captureCmd)
+}
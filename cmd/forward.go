@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	log "github.com/go-pkgz/lgr"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	myhttp "github.com/tipok/kubeproxy/http"
+	"github.com/tipok/kubeproxy/k8s"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+var targets []string
+var namespaces []string
+var loopbackCIDR string
+var hostsFile string
+var dnsListen string
+var dnsUpstream string
+
+var forwardCmd = &cobra.Command{
+	Use:   "forward [target...]",
+	Short: "Forwarding local ports to services and pods",
+	Long: `Forwarding local ports to services and pods without a proxy. The pod is resolved for every connection.
+
+Targets have the form:
+  svc/orders.shop:5432 -> 127.0.0.1:15432
+  pod/orders-0.shop:5432 -> 15432
+  ns/shop -> 127.0.0.2 (all service ports of the namespace)
+
+With --namespace every service of the namespace gets its own loopback address and its host names are
+written to the hosts file, following services appearing and disappearing.
+
+With --dns-listen queries for the cluster domain are answered with the loopback addresses of services
+and pods, which are bound on first use. Other queries are forwarded to --dns-upstream.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		initLogging()
+		startForward(append(viper.GetStringSlice("targets"), args...), viper.GetStringSlice("namespaces"))
+	},
+}
+
+func init() {
+	forwardCmd.PersistentFlags().StringArrayVar(
+		&targets,
+		"target",
+		nil,
+		"Target to forward, e.g. \"svc/orders.shop:5432 -> 127.0.0.1:15432\"",
+	)
+	forwardCmd.PersistentFlags().StringSliceVar(
+		&namespaces,
+		"namespace",
+		nil,
+		"Namespace to watch, its services are bound on their own loopback address",
+	)
+	forwardCmd.PersistentFlags().StringVar(
+		&loopbackCIDR,
+		"loopback-cidr",
+		"127.1.0.0/16",
+		"Loopback network addresses of services of watched namespaces are allocated from",
+	)
+	forwardCmd.PersistentFlags().StringVar(
+		&hostsFile,
+		"hosts-file",
+		"/etc/hosts",
+		"Hosts file the names of services of watched namespaces are written to, empty to disable",
+	)
+	forwardCmd.PersistentFlags().StringVar(
+		&dnsListen,
+		"dns-listen",
+		"",
+		"Address to answer DNS queries for the cluster domain on, e.g. 127.0.0.1:5353 (default disabled)",
+	)
+	forwardCmd.PersistentFlags().StringVar(
+		&dnsUpstream,
+		"dns-upstream",
+		"",
+		"Resolver other DNS queries are forwarded to (default is the first nameserver of /etc/resolv.conf)",
+	)
+	for key, name := range map[string]string{
+		"targets":       "target",
+		"namespaces":    "namespace",
+		"loopback-cidr": "loopback-cidr",
+		"hosts-file":    "hosts-file",
+		"dns-listen":    "dns-listen",
+		"dns-upstream":  "dns-upstream",
+	} {
+		err := viper.BindPFlag(key, forwardCmd.PersistentFlags().Lookup(name))
+		if err != nil {
+			log.Printf("[PANIC] could not bind %s flag: %v", name, err)
+			os.Exit(1)
+		}
+	}
+
+	rootCmd.AddCommand(forwardCmd)
+}
+
+func startForward(specs []string, namespaces []string) {
+	dnsAddr := viper.GetString("dns-listen")
+	if len(specs) == 0 && len(namespaces) == 0 && dnsAddr == "" {
+		log.Fatalf("[PANIC] no targets to forward")
+	}
+	var parsed []*myhttp.ForwardTarget
+	for _, t := range specs {
+		target, err := myhttp.ParseForwardTarget(t)
+		if err != nil {
+			log.Fatalf("[PANIC] %v", err)
+		}
+		parsed = append(parsed, target)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(
+		sig,
+		syscall.SIGTERM,
+		syscall.SIGINT,
+	)
+	defer signal.Stop(sig)
+
+	k8sc, err := k8s.New(kubeconfig)
+	if err != nil {
+		log.Fatalf("[PANIC] could not create k8s client %v", err)
+	}
+	p := myhttp.NewProxy(k8sc, clusterDomain)
+	p.ACL = accessList(k8sc.Context())
+	p.Safe = safeMode(k8sc.Context())
+	p.AccessLog = accessLog(k8sc.Context())
+	p.Timeouts = timeoutPolicy()
+	f := p.NewForwarder()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := f.Start(ctx, parsed); err != nil {
+		log.Fatalf("[PANIC] could not start forwarding: %v", err)
+	}
+	if len(namespaces) > 0 || dnsAddr != "" {
+		_, network, err := net.ParseCIDR(viper.GetString("loopback-cidr"))
+		if err != nil {
+			log.Fatalf("[PANIC] invalid loopback network: %v", err)
+		}
+		var hosts *myhttp.HostsFile
+		if path := viper.GetString("hosts-file"); path != "" {
+			hosts = &myhttp.HostsFile{Path: path}
+		}
+		if err := f.UseLoopback(network, hosts); err != nil {
+			log.Fatalf("[PANIC] could not enable loopback addresses: %v", err)
+		}
+		if err := f.WatchNamespaces(ctx, namespaces); err != nil {
+			log.Fatalf("[PANIC] could not watch namespaces: %v", err)
+		}
+	}
+	var dnsUDP net.PacketConn
+	var dnsTCP net.Listener
+	if dnsAddr != "" {
+		dnsUDP, dnsTCP = startDNS(f, dnsAddr)
+	}
+
+	<-sig
+
+	log.Printf("[INFO] shutting down")
+	if dnsAddr != "" {
+		_ = dnsUDP.Close()
+		_ = dnsTCP.Close()
+	}
+	if err := f.Close(); err != nil {
+		log.Printf("[ERROR] during shutdown: %v", err)
+	}
+	p.Close()
+}
+
+func startDNS(f *myhttp.Forwarder, addr string) (net.PacketConn, net.Listener) {
+	dns := f.NewDNSServer()
+	dns.Upstream = viper.GetString("dns-upstream")
+	if dns.Upstream == "" {
+		dns.Upstream = resolvConfNameserver()
+	}
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		log.Fatalf("[PANIC] could not listen to %s: %v", addr, err)
+	}
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("[PANIC] could not listen to %s: %v", addr, err)
+	}
+	log.Printf("[INFO] starting dns server on %s, forwarding to %s", addr, dns.Upstream)
+	go func() {
+		if err := dns.ServeUDP(udp); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Fatalf("[PANIC] while serving dns on %s: %v", addr, err)
+		}
+	}()
+	go func() {
+		if err := dns.ServeTCP(tcp); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Fatalf("[PANIC] while serving dns on %s: %v", addr, err)
+		}
+	}()
+	return udp, tcp
+}
+
+// resolvConfNameserver returns the first nameserver of /etc/resolv.conf, other queries are
+// refused if there is none
+func resolvConfNameserver() string {
+	content, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		log.Printf("[ERROR] could not read resolv.conf: %v", err)
+		return ""
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return ""
+}
@@ -2,22 +2,56 @@ package cmd
 
 import (
 	"context"
-	"fmt"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"github.com/elazarl/goproxy"
 	log "github.com/go-pkgz/lgr"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	myhttp "github.com/tipok/kubeproxy/http"
 	"github.com/tipok/kubeproxy/k8s"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"regexp"
+	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 )
 
 var listen string
+var grpcWeb bool
+var mitm bool
+var mitmPorts []string
+var upstreamCA string
+var upstreamInsecure bool
+var egress string
+var upstreamProxy string
+var noProxy string
+var socksListen string
+var socksUsername string
+var socksPasswordFile string
+var clusterCIDRs []string
+var htpasswd string
+var allowAnonymous bool
+var adminListen string
+var healthListen string
+var waitReady bool
+var drainTimeout time.Duration
+var captureDir string
+var captureMaxBody int64
+var captureRedactHeaders []string
+var recordDir string
+var recordMaxBody int64
+var replayDir string
+var replayMatch []string
+var replayStrict bool
+var traceEndpoint string
+var traceFile string
+var traceService string
 
 var startProxyCmd = &cobra.Command{
 	Use:   "http-proxy",
@@ -33,13 +67,195 @@ func init() {
 	startProxyCmd.PersistentFlags().StringVar(
 		&listen,
 		"listen",
-		":3128",
-		"Address to listen on (default :3128)",
+		"",
+		"Address to listen on (default localhost:3128, :3128 with --htpasswd)",
 	)
-	err := viper.BindPFlag("listen", startProxyCmd.PersistentFlags().Lookup("listen"))
-	if err != nil {
-		log.Printf("[PANIC] could not bind listen flag: %v", err)
-		os.Exit(1)
+	startProxyCmd.PersistentFlags().BoolVar(
+		&allowAnonymous,
+		"allow-anonymous",
+		false,
+		"Allow listening on addresses other than loopback without --htpasswd, anyone reaching the proxy can use the cluster credentials",
+	)
+	startProxyCmd.PersistentFlags().StringVar(
+		&htpasswd,
+		"htpasswd",
+		"",
+		"htpasswd file with bcrypt hashed passwords of the users allowed to use the proxy, see htpasswd -B",
+	)
+	startProxyCmd.PersistentFlags().BoolVar(
+		&grpcWeb,
+		"grpc-web",
+		false,
+		"Translate grpc-web requests of browsers to gRPC",
+	)
+	startProxyCmd.PersistentFlags().BoolVar(
+		&mitm,
+		"mitm",
+		false,
+		"Intercept TLS connections to cluster hosts with a local CA, see kubeproxy ca export",
+	)
+	startProxyCmd.PersistentFlags().StringSliceVar(
+		&mitmPorts,
+		"mitm-ports",
+		[]string{"443", "8443", "https"},
+		"Ports of cluster hosts TLS connections are intercepted on",
+	)
+	startProxyCmd.PersistentFlags().StringVar(
+		&upstreamCA,
+		"upstream-ca",
+		"",
+		"CA bundle used to verify pods of intercepted TLS connections (default is the system trust store)",
+	)
+	startProxyCmd.PersistentFlags().BoolVar(
+		&upstreamInsecure,
+		"upstream-insecure-skip-verify",
+		false,
+		"Don't verify the certificates of pods of intercepted TLS connections",
+	)
+	startProxyCmd.PersistentFlags().StringVar(
+		&egress,
+		"egress",
+		myhttp.EgressDirect,
+		"Policy for hosts outside of the cluster: direct, upstream or reject",
+	)
+	startProxyCmd.PersistentFlags().StringVar(
+		&upstreamProxy,
+		"upstream-proxy",
+		"",
+		"Proxy for hosts outside of the cluster with --egress upstream, e.g. http://proxy:3128 or socks5://proxy:1080",
+	)
+	startProxyCmd.PersistentFlags().StringVar(
+		&noProxy,
+		"no-proxy",
+		"",
+		"Hosts outside of the cluster not sent to the upstream proxy, same format as NO_PROXY",
+	)
+	startProxyCmd.PersistentFlags().StringVar(
+		&socksListen,
+		"socks-listen",
+		"",
+		"Address to accept SOCKS5 connections on, e.g. :1080 (default disabled)",
+	)
+	startProxyCmd.PersistentFlags().StringVar(
+		&socksUsername,
+		"socks-username",
+		"",
+		"Username SOCKS5 clients have to authenticate with (default no authentication)",
+	)
+	startProxyCmd.PersistentFlags().StringVar(
+		&socksPasswordFile,
+		"socks-password-file",
+		"",
+		"File with the password SOCKS5 clients have to authenticate with (default $KUBEPROXY_SOCKS_PASSWORD)",
+	)
+	startProxyCmd.PersistentFlags().StringSliceVar(
+		&clusterCIDRs,
+		"cluster-cidrs",
+		nil,
+		"ClusterIP and pod networks, requests to their addresses are sent to the matching pod, e.g. 10.96.0.0/12",
+	)
+	startProxyCmd.PersistentFlags().StringVar(
+		&adminListen,
+		"admin-listen",
+		defaultAdminAddr,
+		"Address or unix:PATH socket of the admin API controlling the running proxy and serving /metrics (empty to disable)",
+	)
+	startProxyCmd.PersistentFlags().StringVar(
+		&captureDir,
+		"capture-dir",
+		"",
+		"Directory captures started through the admin API are written to (default $HOME/.config/kubeproxy/captures)",
+	)
+	startProxyCmd.PersistentFlags().StringVar(
+		&healthListen,
+		"health-listen",
+		"",
+		"Address serving only /healthz and /readyz for probes of service managers, e.g. :8086 (empty to disable)",
+	)
+	startProxyCmd.PersistentFlags().BoolVar(
+		&waitReady,
+		"wait-ready",
+		false,
+		"Accept connections only once the cluster is reachable with the credentials of the kubeconfig",
+	)
+	startProxyCmd.PersistentFlags().DurationVar(
+		&drainTimeout,
+		"drain-timeout",
+		20*time.Second,
+		"Time active tunnels and requests may take to finish on shutdown before they are closed",
+	)
+	startProxyCmd.PersistentFlags().Int64Var(
+		&captureMaxBody,
+		"capture-max-body",
+		1<<20,
+		"Bytes of request and response bodies stored in captures, larger bodies are truncated (0 for no limit)",
+	)
+	startProxyCmd.PersistentFlags().StringSliceVar(
+		&captureRedactHeaders,
+		"capture-redact-headers",
+		myhttp.DefaultRedactHeaders,
+		"Headers stored as REDACTED in captures",
+	)
+	startProxyCmd.PersistentFlags().StringVar(
+		&recordDir,
+		"record",
+		"",
+		"Directory to record the requests to cluster hosts and their responses to",
+	)
+	startProxyCmd.PersistentFlags().Int64Var(
+		&recordMaxBody,
+		"record-max-body",
+		myhttp.DefaultRecordMaxBody,
+		"Bytes of the largest response body recorded, larger responses are not recorded (0 for no limit)",
+	)
+	startProxyCmd.PersistentFlags().StringVar(
+		&replayDir,
+		"replay",
+		"",
+		"Directory with recordings to answer requests to cluster hosts with",
+	)
+	startProxyCmd.PersistentFlags().StringSliceVar(
+		&replayMatch,
+		"replay-match",
+		[]string{"method", "path", "query"},
+		"Parts of requests which have to match the recording: method, path, query, body and header:<name>",
+	)
+	startProxyCmd.PersistentFlags().BoolVar(
+		&replayStrict,
+		"replay-strict",
+		false,
+		"Answer requests without recording with 502 instead of sending them to the cluster, no cluster connection is needed",
+	)
+	startProxyCmd.PersistentFlags().StringVar(
+		&traceEndpoint,
+		"trace-otlp-endpoint",
+		"",
+		"OTLP/HTTP endpoint to export spans of requests to cluster hosts to, e.g. http://localhost:4318/v1/traces",
+	)
+	startProxyCmd.PersistentFlags().StringVar(
+		&traceFile,
+		"trace-file",
+		"",
+		"File to append spans of requests to cluster hosts to as OTLP/JSON, one batch per line",
+	)
+	startProxyCmd.PersistentFlags().StringVar(
+		&traceService,
+		"trace-service-name",
+		"kubeproxy",
+		"Service name of exported spans",
+	)
+	for _, name := range []string{
+		"trace-otlp-endpoint", "trace-file", "trace-service-name",
+		"record", "record-max-body", "replay", "replay-match", "replay-strict",
+		"admin-listen", "health-listen", "wait-ready", "drain-timeout", "capture-dir", "capture-max-body", "capture-redact-headers",
+		"cluster-cidrs", "htpasswd", "allow-anonymous", "listen", "grpc-web", "mitm", "mitm-ports", "upstream-ca", "upstream-insecure-skip-verify",
+		"egress", "upstream-proxy", "no-proxy", "socks-listen", "socks-username", "socks-password-file",
+	} {
+		err := viper.BindPFlag(name, startProxyCmd.PersistentFlags().Lookup(name))
+		if err != nil {
+			log.Printf("[PANIC] could not bind %s flag: %v", name, err)
+			os.Exit(1)
+		}
 	}
 
 	rootCmd.AddCommand(startProxyCmd)
@@ -57,32 +273,194 @@ func startProxy() {
 	proxy := goproxy.NewProxyHttpServer()
 	proxy.Verbose = true
 
-	k8sc, err := k8s.New(kubeconfig)
-	if err != nil {
-		log.Fatalf("[PANIC] could not create k8s client %v", err)
+	var err error
+	var replay *myhttp.Replayer
+	if dir := viper.GetString("replay"); dir != "" {
+		match, err := myhttp.ParseReplayMatch(viper.GetStringSlice("replay-match"))
+		if err != nil {
+			log.Fatalf("[PANIC] invalid replay match: %v", err)
+		}
+		replay, err = myhttp.LoadReplayer(dir, match)
+		if err != nil {
+			log.Fatalf("[PANIC] could not load recordings: %v", err)
+		}
+		replay.Strict = viper.GetBool("replay-strict")
 	}
 
-	clusterRegEx, err := regexp.Compile(fmt.Sprintf("^.*\\.%s:?\\d*", strings.Replace(clusterDomain, ".", "\\.", -1)))
-	if err != nil {
-		log.Fatalf("[PANIC] could not compile cluster regex: %v", err)
+	var k8sc *k8s.Api
+	cluster := ""
+	// strict replays never reach the cluster
+	if replay == nil || !replay.Strict {
+		k8sc, err = k8s.New(kubeconfig)
+		if err != nil {
+			log.Fatalf("[PANIC] could not create k8s client %v", err)
+		}
+		cluster = k8sc.Context()
+	}
+
+	p := myhttp.NewProxy(k8sc, clusterDomain)
+	p.GRPCWeb = viper.GetBool("grpc-web")
+	p.ACL = accessList(cluster)
+	p.Safe = safeMode(cluster)
+	p.Replay = replay
+	if dir := viper.GetString("record"); dir != "" {
+		p.Recorder, err = myhttp.NewRecorder(dir)
+		if err != nil {
+			log.Fatalf("[PANIC] could not record: %v", err)
+		}
+		p.Recorder.MaxBodySize = viper.GetInt64("record-max-body")
+	}
+	p.Headers = headerRewriter()
+	p.AccessLog = accessLog(cluster)
+	p.Tracer = tracer()
+	p.Timeouts = timeoutPolicy()
+	p.Health = myhttp.NewHealth()
+	p.Health.AddCheck("cluster", p.CheckCluster)
+	if viper.GetString("admin-listen") != "" {
+		p.Metrics = myhttp.NewMetrics()
+		if k8sc != nil {
+			k8sc.OnLookup = p.Metrics.ObserveLookup
+		}
+	}
+	addr := viper.GetString("listen")
+	if file := viper.GetString("htpasswd"); file != "" {
+		p.Users, err = myhttp.LoadHtpasswd(file)
+		if err != nil {
+			log.Fatalf("[PANIC] could not load users: %v", err)
+		}
+		if addr == "" {
+			addr = ":3128"
+		}
+	} else if addr == "" {
+		// without authentication anyone reaching the proxy could use the cluster credentials
+		addr = "localhost:3128"
+	} else {
+		checkAnonymous(addr, "--htpasswd")
+	}
+	socksUser, socksPass := viper.GetString("socks-username"), ""
+	if socksAddr := viper.GetString("socks-listen"); socksAddr != "" {
+		if socksUser != "" {
+			socksPass = socksPassword()
+		} else if p.Users == nil {
+			checkAnonymous(socksAddr, "--htpasswd or --socks-username")
+		}
+	}
+	p.Parser().Aliases = viper.GetStringMapString("aliases")
+	for _, cidr := range viper.GetStringSlice("cluster-cidrs") {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatalf("[PANIC] invalid cluster network %s: %v", cidr, err)
+		}
+		p.Parser().CIDRs = append(p.Parser().CIDRs, network)
+	}
+	onReq := proxy.OnRequest(p.ClusterRequest())
+	onReq.HandleConnectFunc(p.AccessConnect)
+	if viper.GetBool("mitm") {
+		p.UpstreamTLS = upstreamTLSConfig()
+		handleConnect, err := p.MitmConnect(loadCA(), viper.GetStringSlice("mitm-ports"))
+		if err != nil {
+			log.Fatalf("[PANIC] could not set up TLS interception: %v", err)
+		}
+		onReq.HandleConnect(handleConnect)
+	} else {
+		onReq.HandleConnectFunc(p.TunnelConnect)
 	}
-	p := myhttp.NewProxy(k8sc)
-	onReq := proxy.OnRequest(goproxy.ReqHostMatches(clusterRegEx))
-	onReq.HijackConnect(p.HijackConnect)
 	onReq.DoFunc(p.Do)
 
+	e, err := myhttp.NewEgress(viper.GetString("egress"), viper.GetString("upstream-proxy"), viper.GetString("no-proxy"))
+	if err != nil {
+		log.Fatalf("[PANIC] invalid egress policy: %v", err)
+	}
+	e.Configure(proxy, goproxy.Not(p.ClusterRequest()))
+
 	srv := &http.Server{
-		Addr:     listen,
+		Addr:     addr,
 		ErrorLog: log.ToStdLogger(log.Default(), "[ERROR]"),
-		Handler:  proxy,
+		Handler:  p.Handler(proxy),
 	}
 
 	shuttingDown := false
+	var healthSrv *http.Server
+	if healthAddr := viper.GetString("health-listen"); healthAddr != "" {
+		healthSrv = &http.Server{
+			Addr:     healthAddr,
+			ErrorLog: log.ToStdLogger(log.Default(), "[ERROR]"),
+			Handler:  p.Health,
+		}
+		go func() {
+			log.Printf("[INFO] starting health probes on %s", healthAddr)
+			if err := healthSrv.ListenAndServe(); err != nil && !shuttingDown {
+				log.Fatalf("[PANIC] while listening to %s: %v", healthAddr, err)
+			}
+		}()
+	}
+
+	var adminSrv *http.Server
+	if adminAddr := viper.GetString("admin-listen"); adminAddr != "" {
+		admin := p.NewAdmin()
+		admin.Listeners = map[string]string{"http": addr, "admin": adminAddr}
+		if socksAddr := viper.GetString("socks-listen"); socksAddr != "" {
+			admin.Listeners["socks"] = socksAddr
+		}
+		if cluster != "" {
+			admin.Clusters = []string{cluster}
+		}
+		admin.CaptureDir = viper.GetString("capture-dir")
+		if admin.CaptureDir == "" {
+			admin.CaptureDir = filepath.Join(configDir(), "captures")
+		}
+		if err := os.MkdirAll(admin.CaptureDir, 0700); err != nil {
+			log.Fatalf("[PANIC] could not create capture directory: %v", err)
+		}
+		admin.CaptureOptions = myhttp.CaptureOptions{
+			MaxBodySize:   viper.GetInt64("capture-max-body"),
+			RedactHeaders: viper.GetStringSlice("capture-redact-headers"),
+		}
+		adminSrv = &http.Server{
+			Addr:     adminAddr,
+			ErrorLog: log.ToStdLogger(log.Default(), "[ERROR]"),
+			Handler:  admin,
+		}
+		adminListener, err := listenAdmin(adminAddr)
+		if err != nil {
+			log.Fatalf("[PANIC] could not listen to %s: %v", adminAddr, err)
+		}
+		go func() {
+			log.Printf("[INFO] starting admin API on %s", adminAddr)
+			if err := adminSrv.Serve(adminListener); err != nil && !shuttingDown {
+				log.Fatalf("[PANIC] while listening to %s: %v", adminAddr, err)
+			}
+		}()
+	}
+
+	if viper.GetBool("wait-ready") && !waitUntilReady(p.Health, sig) {
+		shuttingDown = true
+		closeServers(healthSrv, adminSrv)
+		return
+	}
+
+	var socksListener net.Listener
+	if socksAddr := viper.GetString("socks-listen"); socksAddr != "" {
+		socks := p.NewSOCKSServer()
+		socks.Egress = e
+		socks.Username, socks.Password = socksUser, socksPass
+		socksListener, err = net.Listen("tcp", socksAddr)
+		if err != nil {
+			log.Fatalf("[PANIC] could not listen to %s: %v", socksAddr, err)
+		}
+		go func() {
+			log.Printf("[INFO] starting socks proxy on %s", socksAddr)
+			if err := socks.Serve(socksListener); err != nil && !shuttingDown {
+				log.Fatalf("[PANIC] while accepting socks connections on %s: %v", socksAddr, err)
+			}
+		}()
+	}
+
 	go func() {
 		log.Printf("[INFO] starting proxy on %s", srv.Addr)
 		if err := srv.ListenAndServe(); err != nil {
 			if !shuttingDown {
-				log.Fatalf("[PANIC] while listening to %s: %v", listen, err)
+				log.Fatalf("[PANIC] while listening to %s: %v", addr, err)
 			}
 			log.Printf("[INFO] shutting down")
 		}
@@ -91,7 +469,157 @@ func startProxy() {
 	<-sig
 
 	shuttingDown = true
-	if err := srv.Shutdown(context.Background()); err != nil {
+	p.Health.Stop()
+	if socksListener != nil {
+		if err := socksListener.Close(); err != nil {
+			log.Printf("[ERROR] could not close socks listener: %v", err)
+		}
+	}
+	drain := viper.GetDuration("drain-timeout")
+	log.Printf("[INFO] draining connections for up to %s", drain)
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	// a second signal skips draining
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	// Shutdown waits for requests on connections which are not hijacked by tunnels
+	if err := srv.Shutdown(ctx); err != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
 		log.Printf("[ERROR] during shutdown: %v", err)
 	}
+	if n := p.Drain(ctx); n > 0 {
+		log.Printf("[INFO] closed %d requests and tunnels still active", n)
+	}
+	cancel()
+	if err := srv.Close(); err != nil {
+		log.Printf("[ERROR] could not close proxy: %v", err)
+	}
+	closeServers(healthSrv, adminSrv)
+	if err := p.Tracer.Close(); err != nil {
+		log.Printf("[ERROR] could not export spans: %v", err)
+	}
+	// don't lose a running capture
+	if _, _, err := p.StopCapture(); err != nil && !errors.Is(err, myhttp.ErrNotCapturing) {
+		log.Printf("[ERROR] could not write capture: %v", err)
+	}
+	p.Close()
+}
+
+func upstreamTLSConfig() *tls.Config {
+	cfg := &tls.Config{InsecureSkipVerify: viper.GetBool("upstream-insecure-skip-verify")}
+	if file := viper.GetString("upstream-ca"); file != "" {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatalf("[PANIC] could not read upstream CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("[PANIC] no certificates found in %s", file)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg
+}
+
+// tracer returns the tracer exporting to the configured endpoint and file, nil if none is
+func tracer() *myhttp.Tracer {
+	var exporters []myhttp.SpanExporter
+	if endpoint := viper.GetString("trace-otlp-endpoint"); endpoint != "" {
+		exporters = append(exporters, &myhttp.OTLPExporter{Endpoint: endpoint})
+	}
+	if file := viper.GetString("trace-file"); file != "" {
+		e, err := myhttp.NewFileExporter(file)
+		if err != nil {
+			log.Fatalf("[PANIC] could not open trace file: %v", err)
+		}
+		exporters = append(exporters, e)
+	}
+	if len(exporters) == 0 {
+		return nil
+	}
+	return myhttp.NewTracer(viper.GetString("trace-service-name"), exporters...)
+}
+
+// waitUntilReady blocks until the proxy is ready, it returns false if a signal arrived before
+func waitUntilReady(health *myhttp.Health, sig <-chan os.Signal) bool {
+	for {
+		err := health.Ready(context.Background())
+		if err == nil {
+			return true
+		}
+		log.Printf("[INFO] not accepting connections until ready: %v", err)
+		select {
+		case <-sig:
+			return false
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// closeServers closes the servers which are not nil
+func closeServers(servers ...*http.Server) {
+	for _, srv := range servers {
+		if srv == nil {
+			continue
+		}
+		if err := srv.Close(); err != nil {
+			log.Printf("[ERROR] could not close %s: %v", srv.Addr, err)
+		}
+	}
+}
+
+// checkAnonymous refuses to accept connections without authentication on addr unless it is a
+// loopback address or --allow-anonymous is set, auth names the flags enabling authentication
+func checkAnonymous(addr string, auth string) {
+	if isLoopback(addr) {
+		return
+	}
+	if !viper.GetBool("allow-anonymous") {
+		log.Fatalf("[PANIC] refusing to listen on %s without %s, anyone reaching it could use the cluster credentials. "+
+			"Listen on localhost or pass --allow-anonymous", addr, auth)
+	}
+	log.Printf("[WARN] listening on %s without authentication, anyone reaching it can use the cluster credentials", addr)
+}
+
+// socksPassword returns the password of SOCKS5 clients from --socks-password-file or
+// $KUBEPROXY_SOCKS_PASSWORD, it is not a flag to keep it out of process lists and config files
+func socksPassword() string {
+	file := viper.GetString("socks-password-file")
+	if file == "" {
+		password, ok := os.LookupEnv("KUBEPROXY_SOCKS_PASSWORD")
+		if !ok || password == "" {
+			log.Fatalf("[PANIC] --socks-username requires --socks-password-file or $KUBEPROXY_SOCKS_PASSWORD")
+		}
+		return password
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatalf("[PANIC] could not read socks password: %v", err)
+	}
+	password := strings.TrimRight(string(content), "\r\n")
+	if password == "" {
+		log.Fatalf("[PANIC] socks password file %s is empty", file)
+	}
+	return password
+}
+
+// isLoopback reports whether the listen address addr only accepts connections from this host
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if !ip.IsLoopback() {
+			return false
+		}
+	}
+	return true
 }
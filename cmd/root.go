@@ -6,9 +6,12 @@ import (
 	log "github.com/go-pkgz/lgr"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	myhttp "github.com/tipok/kubeproxy/http"
+	"io"
 	"k8s.io/client-go/util/homedir"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 var rootCmd = &cobra.Command{
@@ -39,6 +42,15 @@ var cfgFile string
 var kubeconfig string
 var clusterDomain string
 var debug bool
+var accessLogFile string
+var accessLogFormat string
+var accessLogMaxSize int64
+var accessLogMaxBackups int
+var resolveTimeout time.Duration
+var dialTimeout time.Duration
+var responseHeaderTimeout time.Duration
+var tunnelIdleTimeout time.Duration
+var tunnelMaxLifetime time.Duration
 
 func initLogging() {
 	logOpts := []log.Option{log.Debug, log.Msec, log.LevelBraces, log.CallerFile, log.CallerFunc}
@@ -76,6 +88,60 @@ func init() {
 		"cluster.local",
 		"K8s cluster domain, this domain will be used to identify cluster requests (default is cluster.local)",
 	)
+	rootCmd.PersistentFlags().StringVar(
+		&accessLogFile,
+		"access-log",
+		"",
+		"File to write an entry per request and tunnel to cluster hosts to, - for stdout (default disabled)",
+	)
+	rootCmd.PersistentFlags().StringVar(
+		&accessLogFormat,
+		"access-log-format",
+		myhttp.AccessLogJSON,
+		"Format of access log entries: json or logfmt",
+	)
+	rootCmd.PersistentFlags().Int64Var(
+		&accessLogMaxSize,
+		"access-log-max-size",
+		100,
+		"Megabytes the access log file may grow to before it is rotated (0 for no limit)",
+	)
+	rootCmd.PersistentFlags().IntVar(
+		&accessLogMaxBackups,
+		"access-log-max-backups",
+		5,
+		"Rotated access log files to keep",
+	)
+	rootCmd.PersistentFlags().DurationVar(
+		&resolveTimeout,
+		"resolve-timeout",
+		10*time.Second,
+		"Time the lookup of the pod serving a host may take (0 for no limit)",
+	)
+	rootCmd.PersistentFlags().DurationVar(
+		&dialTimeout,
+		"dial-timeout",
+		30*time.Second,
+		"Time connecting to the port-forward API of a pod may take (0 for no limit)",
+	)
+	rootCmd.PersistentFlags().DurationVar(
+		&responseHeaderTimeout,
+		"response-header-timeout",
+		0,
+		"Time to wait for the response headers of pods once the request is sent (0 for no limit)",
+	)
+	rootCmd.PersistentFlags().DurationVar(
+		&tunnelIdleTimeout,
+		"tunnel-idle-timeout",
+		0,
+		"Time after which tunnels without traffic are closed (0 for no limit)",
+	)
+	rootCmd.PersistentFlags().DurationVar(
+		&tunnelMaxLifetime,
+		"tunnel-max-lifetime",
+		0,
+		"Time after which tunnels are closed (0 for no limit)",
+	)
 	err := viper.BindPFlag("kubeconfig", rootCmd.PersistentFlags().Lookup("kubeconfig"))
 	if err != nil {
 		log.Printf("[PANIC] could not bind kubeconfig flag: %v", err)
@@ -86,21 +152,131 @@ func init() {
 		log.Printf("[PANIC] could not bind cluster-domain flag: %v", err)
 		os.Exit(1)
 	}
+	for _, name := range []string{
+		"access-log", "access-log-format", "access-log-max-size", "access-log-max-backups",
+		"resolve-timeout", "dial-timeout", "response-header-timeout", "tunnel-idle-timeout", "tunnel-max-lifetime",
+	} {
+		err := viper.BindPFlag(name, rootCmd.PersistentFlags().Lookup(name))
+		if err != nil {
+			log.Printf("[PANIC] could not bind %s flag: %v", name, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// configPath returns the directory kubeproxy keeps its files in
+func configPath() string {
+	return filepath.Join(homedir.HomeDir(), ".config", "kubeproxy")
+}
+
+// configDir returns the directory kubeproxy keeps its files in, it is created if missing
+func configDir() string {
+	configPath := configPath()
+	if _, err := os.Stat(configPath); errors.Is(err, os.ErrNotExist) {
+		err := os.MkdirAll(configPath, os.ModePerm)
+		if err != nil {
+			log.Fatalf("[PANIC] could not create config directory: %v", err)
+		}
+	}
+	return configPath
+}
+
+// accessList returns the access rules of the config file for the cluster of the kubeconfig context
+func accessList(cluster string) *myhttp.AccessList {
+	var rules []myhttp.AccessRule
+	if err := viper.UnmarshalKey("access", &rules); err != nil {
+		log.Fatalf("[PANIC] could not read access rules: %v", err)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	acl, err := myhttp.NewAccessList(cluster, rules)
+	if err != nil {
+		log.Fatalf("[PANIC] invalid access rules: %v", err)
+	}
+	return acl
+}
+
+// safeMode returns the safe mode rules of the config file for the cluster of the kubeconfig context
+func safeMode(cluster string) *myhttp.SafeMode {
+	var rules []myhttp.SafeRule
+	if err := viper.UnmarshalKey("safe-mode", &rules); err != nil {
+		log.Fatalf("[PANIC] could not read safe mode rules: %v", err)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	safe, err := myhttp.NewSafeMode(cluster, rules)
+	if err != nil {
+		log.Fatalf("[PANIC] invalid safe mode rules: %v", err)
+	}
+	return safe
+}
+
+// headerRewriter returns the header rules of the config file
+func headerRewriter() *myhttp.HeaderRewriter {
+	var rules []myhttp.HeaderRule
+	if err := viper.UnmarshalKey("headers", &rules); err != nil {
+		log.Fatalf("[PANIC] could not read header rules: %v", err)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	headers, err := myhttp.NewHeaderRewriter(rules)
+	if err != nil {
+		log.Fatalf("[PANIC] invalid header rules: %v", err)
+	}
+	return headers
+}
+
+// accessLog returns the access log configured with --access-log for the cluster of the
+// kubeconfig context
+func accessLog(cluster string) *myhttp.AccessLog {
+	file := viper.GetString("access-log")
+	if file == "" {
+		return nil
+	}
+	var w io.Writer = os.Stdout
+	if file != "-" {
+		w = &myhttp.RotatingFile{
+			Path:       file,
+			MaxSize:    viper.GetInt64("access-log-max-size") << 20,
+			MaxBackups: viper.GetInt("access-log-max-backups"),
+		}
+	}
+	l, err := myhttp.NewAccessLog(w, viper.GetString("access-log-format"))
+	if err != nil {
+		log.Fatalf("[PANIC] invalid access log: %v", err)
+	}
+	l.Cluster = cluster
+	return l
+}
+
+// timeoutPolicy returns the timeouts of the flags overridden per host by the timeout rules of
+// the config file
+func timeoutPolicy() *myhttp.TimeoutPolicy {
+	var rules []myhttp.TimeoutRule
+	if err := viper.UnmarshalKey("timeouts", &rules); err != nil {
+		log.Fatalf("[PANIC] could not read timeout rules: %v", err)
+	}
+	policy, err := myhttp.NewTimeoutPolicy(myhttp.Timeouts{
+		Resolve:        viper.GetDuration("resolve-timeout"),
+		Dial:           viper.GetDuration("dial-timeout"),
+		ResponseHeader: viper.GetDuration("response-header-timeout"),
+		Idle:           viper.GetDuration("tunnel-idle-timeout"),
+		MaxLifetime:    viper.GetDuration("tunnel-max-lifetime"),
+	}, rules)
+	if err != nil {
+		log.Fatalf("[PANIC] invalid timeouts: %v", err)
+	}
+	return policy
 }
 
 func initConfig() {
 	if cfgFile != "" {
 		viper.SetConfigFile(cfgFile)
 	} else {
-		home := homedir.HomeDir()
-		configPath := filepath.Join(home, ".config", "kubeproxy")
-		if _, err := os.Stat(configPath); errors.Is(err, os.ErrNotExist) {
-			err := os.MkdirAll(configPath, os.ModePerm)
-			if err != nil {
-				log.Fatalf("[PANIC] could not create config directory: %v", err)
-			}
-		}
-		viper.AddConfigPath(configPath)
+		viper.AddConfigPath(configDir())
 		viper.SetConfigType("yaml")
 		viper.SetConfigName("config")
 	}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	myhttp "github.com/tipok/kubeproxy/http"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show whether the proxy is running",
+	Long:  `Show whether the proxy is running, its listeners, clusters and uptime, using its admin API.`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		initLogging()
+		var status myhttp.StatusResponse
+		if err := adminRequest(http.MethodGet, "/status", nil, &status); err != nil {
+			fmt.Printf("kubeproxy is not running on %s: %v\n", adminAddr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("kubeproxy is running since %s (up %s)\n",
+			status.Started.Local().Format("2006-01-02 15:04:05"), uptime(status.Uptime))
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		clusters := strings.Join(status.Clusters, ", ")
+		if clusters == "" {
+			clusters = "none"
+		}
+		fmt.Fprintf(w, "clusters:\t%s\n", clusters)
+		fmt.Fprintf(w, "connections:\t%d\n", status.Connections)
+		fmt.Fprintf(w, "listeners:\t\n")
+		protocols := make([]string, 0, len(status.Listeners))
+		for protocol := range status.Listeners {
+			protocols = append(protocols, protocol)
+		}
+		sort.Strings(protocols)
+		for _, protocol := range protocols {
+			fmt.Fprintf(w, "  %s\t%s\n", protocol, status.Listeners[protocol])
+		}
+		_ = w.Flush()
+	},
+}
+
+// uptime formats the seconds the proxy is running to the second
+func uptime(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second)
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+}
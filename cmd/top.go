@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/go-pkgz/lgr"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	myhttp "github.com/tipok/kubeproxy/http"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+var topInterval time.Duration
+
+var topCmd = &cobra.Command{
+	Use:   "top",
+	Short: "Show active tunnels and request rates of the running proxy",
+	Long: `Show the active tunnels and the request rates per service of the running proxy, refreshed periodically.
+The request rates need the metrics of the admin API.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		initLogging()
+		interval := viper.GetDuration("interval")
+		if interval <= 0 {
+			log.Fatalf("[PANIC] invalid interval %s", interval)
+		}
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var last *topSample
+		for {
+			sample, err := takeTopSample()
+			if err != nil {
+				log.Fatalf("[PANIC] could not query the proxy on %s: %v", adminAddr, err)
+			}
+			var screen bytes.Buffer
+			// move the cursor home and clear the terminal
+			screen.WriteString("\033[H\033[2J")
+			renderTop(&screen, sample, last, interval)
+			_, _ = os.Stdout.Write(screen.Bytes())
+			last = sample
+
+			select {
+			case <-sig:
+				return
+			case <-ticker.C:
+			}
+		}
+	},
+}
+
+// topSample is the state of the proxy at one refresh
+type topSample struct {
+	time        time.Time
+	status      myhttp.StatusResponse
+	stats       []myhttp.ServiceStats
+	connections []myhttp.ConnectionInfo
+}
+
+func takeTopSample() (*topSample, error) {
+	s := &topSample{time: time.Now()}
+	if err := adminRequest(http.MethodGet, "/status", nil, &s.status); err != nil {
+		return nil, err
+	}
+	if err := adminRequest(http.MethodGet, "/stats", nil, &s.stats); err != nil {
+		return nil, err
+	}
+	if err := adminRequest(http.MethodGet, "/connections", nil, &s.connections); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// topService is a row of the services table
+type topService struct {
+	namespace string
+	service   string
+	requests  int64
+	rate      float64
+	errorRate float64
+	tunnels   int
+}
+
+// renderTop writes the sample, the request rates are computed since the last sample
+func renderTop(w io.Writer, s, last *topSample, interval time.Duration) {
+	clusters := strings.Join(s.status.Clusters, ", ")
+	if clusters == "" {
+		clusters = "none"
+	}
+	fmt.Fprintf(w, "kubeproxy up %s, clusters: %s, connections: %d, refreshing every %s\n\n",
+		uptime(s.status.Uptime), clusters, len(s.connections), interval)
+
+	services := map[[2]string]*topService{}
+	service := func(namespace, name string) *topService {
+		key := [2]string{namespace, name}
+		if services[key] == nil {
+			services[key] = &topService{namespace: namespace, service: name}
+		}
+		return services[key]
+	}
+	// services first seen in this sample had no requests before
+	previous := map[[2]string]myhttp.ServiceStats{}
+	var elapsed float64
+	if last != nil {
+		elapsed = s.time.Sub(last.time).Seconds()
+		for _, stats := range last.stats {
+			previous[[2]string{stats.Namespace, stats.Service}] = stats
+		}
+	}
+	for _, stats := range s.stats {
+		row := service(stats.Namespace, stats.Service)
+		row.requests = stats.Requests
+		if elapsed > 0 {
+			before := previous[[2]string{stats.Namespace, stats.Service}]
+			row.rate = float64(stats.Requests-before.Requests) / elapsed
+			row.errorRate = float64(stats.Errors-before.Errors) / elapsed
+		}
+	}
+	for _, c := range s.connections {
+		if c.Kind != "http" && c.Namespace != "" {
+			service(c.Namespace, c.Service).tunnels++
+		}
+	}
+	rows := make([]*topService, 0, len(services))
+	for _, row := range services {
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].rate != rows[j].rate {
+			return rows[i].rate > rows[j].rate
+		}
+		if rows[i].namespace != rows[j].namespace {
+			return rows[i].namespace < rows[j].namespace
+		}
+		return rows[i].service < rows[j].service
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tSERVICE\tREQ/S\tERR/S\tREQUESTS\tTUNNELS")
+	for _, row := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%.1f\t%.1f\t%d\t%d\n",
+			row.namespace, orDash(row.service), row.rate, row.errorRate, row.requests, row.tunnels)
+	}
+	_ = tw.Flush()
+	fmt.Fprintln(w)
+
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tKIND\tCLIENT\tHOST\tPOD\tAGE\tIN\tOUT")
+	for _, c := range s.connections {
+		pod := ""
+		if c.Pod != "" {
+			pod = c.Namespace + "/" + c.Pod
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n",
+			c.ID, c.Kind, c.Client, c.Host, orDash(pod), uptime(c.Age), c.BytesIn, c.BytesOut)
+	}
+	_ = tw.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func init() {
+	topCmd.Flags().DurationVar(
+		&topInterval,
+		"interval",
+		2*time.Second,
+		"Time between refreshes",
+	)
+	err := viper.BindPFlag("interval", topCmd.Flags().Lookup("interval"))
+	if err != nil {
+		log.Printf("[PANIC] could not bind interval flag: %v", err)
+		os.Exit(1)
+	}
+	rootCmd.AddCommand(topCmd)
+}
@@ -0,0 +1,110 @@
+package http
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Actions of access rules
+const (
+	AccessAllow = "allow"
+	AccessDeny  = "deny"
+)
+
+// AccessRule allows or denies access to cluster hosts. The fields are glob patterns as
+// understood by path.Match, empty fields match everything.
+type AccessRule struct {
+	Action string `mapstructure:"action"`
+	// Cluster is the name of the kubeconfig context
+	Cluster   string `mapstructure:"cluster"`
+	Namespace string `mapstructure:"namespace"`
+	// Type is svc or pod
+	Type string `mapstructure:"type"`
+	Name string `mapstructure:"name"`
+	Port string `mapstructure:"port"`
+}
+
+func (r *AccessRule) String() string {
+	var fields []string
+	for _, f := range []struct{ name, pattern string }{
+		{"cluster", r.Cluster},
+		{"namespace", r.Namespace},
+		{"type", r.Type},
+		{"name", r.Name},
+		{"port", r.Port},
+	} {
+		if f.pattern != "" {
+			fields = append(fields, fmt.Sprintf("%s=%s", f.name, f.pattern))
+		}
+	}
+	return strings.TrimSpace(r.Action + " " + strings.Join(fields, " "))
+}
+
+func (r *AccessRule) matches(cluster string, h *Host) bool {
+	for _, f := range []struct{ pattern, value string }{
+		{r.Cluster, cluster},
+		{r.Namespace, h.Namespace},
+		{r.Type, h.Type},
+		{r.Name, h.Name},
+		{r.Port, h.Port},
+	} {
+		if !match(f.pattern, f.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// AccessList decides which cluster hosts may be accessed, the first matching rule wins. Hosts
+// no rule matches are allowed.
+type AccessList struct {
+	// Cluster is the name of the kubeconfig context the proxy uses
+	Cluster string
+	Rules   []AccessRule
+}
+
+// NewAccessList validates the rules
+func NewAccessList(cluster string, rules []AccessRule) (*AccessList, error) {
+	for i, r := range rules {
+		if r.Action != AccessAllow && r.Action != AccessDeny {
+			return nil, fmt.Errorf("rule %d: unknown action %q, expected allow or deny", i+1, r.Action)
+		}
+		for _, pattern := range []string{r.Cluster, r.Namespace, r.Type, r.Name, r.Port} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid pattern %q: %w", i+1, pattern, err)
+			}
+		}
+	}
+	return &AccessList{Cluster: cluster, Rules: rules}, nil
+}
+
+// AccessDeniedError is returned for hosts denied by a rule
+type AccessDeniedError struct {
+	Host *Host
+	// Index of the rule starting at 1
+	Index int
+	Rule  AccessRule
+}
+
+func (e *AccessDeniedError) Error() string {
+	return fmt.Sprintf("access to %s/%s.%s:%s denied by rule %d (%s)",
+		e.Host.Type, e.Host.Name, e.Host.Namespace, e.Host.Port, e.Index, e.Rule.String())
+}
+
+// check returns an AccessDeniedError if h is denied
+func (a *AccessList) check(h *Host) error {
+	if a == nil {
+		return nil
+	}
+	for i, r := range a.Rules {
+		if !r.matches(a.Cluster, h) {
+			continue
+		}
+		if r.Action == AccessDeny {
+			return &AccessDeniedError{Host: h, Index: i + 1, Rule: r}
+		}
+		return nil
+	}
+	return nil
+}
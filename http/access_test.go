@@ -0,0 +1,161 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/elazarl/goproxy"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNewAccessList(t *testing.T) {
+	if _, err := NewAccessList("prod", []AccessRule{{Action: "block"}}); err == nil {
+		t.Errorf("expected unknown action to be refused")
+	}
+	if _, err := NewAccessList("prod", []AccessRule{{Action: AccessDeny, Name: "[orders"}}); err == nil {
+		t.Errorf("expected invalid pattern to be refused")
+	}
+}
+
+func TestAccessListCheck(t *testing.T) {
+	acl, err := NewAccessList("prod", []AccessRule{
+		{Action: AccessAllow, Namespace: "kube-system", Type: "svc", Name: "kube-dns", Port: "53"},
+		{Action: AccessDeny, Namespace: "kube-*"},
+		{Action: AccessDeny, Cluster: "prod", Type: "pod"},
+		{Action: AccessDeny, Namespace: "shop", Name: "payments", Port: "9090"},
+	})
+	if err != nil {
+		t.Fatalf("could not create access list: %v", err)
+	}
+
+	tests := []struct {
+		host *Host
+		rule int
+	}{
+		{&Host{Name: "kube-dns", Namespace: "kube-system", Type: "svc", Port: "53"}, 0},
+		{&Host{Name: "kube-dns", Namespace: "kube-system", Type: "svc", Port: "9153"}, 2},
+		{&Host{Name: "metrics", Namespace: "kube-public", Type: "svc", Port: "80"}, 2},
+		{&Host{Name: "orders-0", Namespace: "shop", Type: "pod", Port: "80"}, 3},
+		{&Host{Name: "payments", Namespace: "shop", Type: "svc", Port: "8080"}, 0},
+		{&Host{Name: "payments", Namespace: "shop", Type: "svc", Port: "9090"}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host.Type+"/"+tt.host.Name+"."+tt.host.Namespace+":"+tt.host.Port, func(t *testing.T) {
+			err := acl.check(tt.host)
+			var denied *AccessDeniedError
+			if tt.rule == 0 {
+				if err != nil {
+					t.Errorf("expected access, got %v", err)
+				}
+				return
+			}
+			if !errors.As(err, &denied) {
+				t.Fatalf("expected access to be denied, got %v", err)
+			}
+			if denied.Index != tt.rule {
+				t.Errorf("expected rule %d to deny access, got %d", tt.rule, denied.Index)
+			}
+		})
+	}
+
+	t.Run("other cluster", func(t *testing.T) {
+		staging := *acl
+		staging.Cluster = "staging"
+		if err := staging.check(&Host{Name: "orders-0", Namespace: "shop", Type: "pod", Port: "80"}); err != nil {
+			t.Errorf("expected access, got %v", err)
+		}
+	})
+
+	t.Run("error names the rule", func(t *testing.T) {
+		err := acl.check(&Host{Name: "payments", Namespace: "shop", Type: "svc", Port: "9090"})
+		want := "access to svc/payments.shop:9090 denied by rule 4 (deny namespace=shop name=payments port=9090)"
+		if err == nil || err.Error() != want {
+			t.Errorf("expected %q, got %v", want, err)
+		}
+	})
+}
+
+func TestProxyAccessDenied(t *testing.T) {
+	p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("pod"))
+	}))
+	p.ACL, _ = NewAccessList("prod", []AccessRule{
+		{Action: AccessDeny, Namespace: "kube-system"},
+		{Action: AccessDeny, Name: "ip-10.0.0.1"},
+		{Action: AccessDeny, Type: "svc", Name: "payments"},
+	})
+	_, network, _ := net.ParseCIDR("10.0.0.0/16")
+	p.parser.CIDRs = []*net.IPNet{network}
+
+	t.Run("http", func(t *testing.T) {
+		client := newTestClient(t, p)
+		for host, status := range map[string]int{
+			"orders.shop.svc.cluster.local":          http.StatusOK,
+			"kube-dns.kube-system.svc.cluster.local": http.StatusForbidden,
+			"10.0.0.2":                               http.StatusOK,
+			"10.0.0.1":                               http.StatusForbidden,
+		} {
+			resp, err := client.Get("http://" + host + "/")
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != status {
+				t.Errorf("%s: expected %d, got %d", host, status, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("connect", func(t *testing.T) {
+		proxy := goproxy.NewProxyHttpServer()
+		onReq := proxy.OnRequest(p.ClusterRequest())
+		onReq.HandleConnectFunc(p.AccessConnect)
+		onReq.HandleConnectFunc(p.TunnelConnect)
+		srv := httptest.NewServer(proxy)
+		defer srv.Close()
+		proxyURL, _ := url.Parse(srv.URL)
+
+		conn, err := net.Dial("tcp", proxyURL.Host)
+		if err != nil {
+			t.Fatalf("could not dial proxy: %v", err)
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("CONNECT kube-dns.kube-system.svc.cluster.local:443 HTTP/1.1\r\n" +
+			"Host: kube-dns.kube-system.svc.cluster.local:443\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("could not read response: %v", err)
+		}
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("checked before lookup", func(t *testing.T) {
+		_, err := p.resolve(context.Background(), "kube-dns.kube-system.svc.cluster.local:53", false)
+		if err == nil || !strings.Contains(err.Error(), "denied by rule 1") {
+			t.Errorf("expected access to be denied, got %v", err)
+		}
+	})
+
+	t.Run("unknown type", func(t *testing.T) {
+		// would bypass the rule for the payments service if it was resolved like a service
+		_, err := p.resolve(context.Background(), "payments.shop.svcs.cluster.local:80", false)
+		if err == nil || !strings.Contains(err.Error(), "unknown type") {
+			t.Errorf("expected unknown type to be refused, got %v", err)
+		}
+		resp, err := newTestClient(t, p).Get("http://payments.shop.svcs.cluster.local/")
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("expected 502, got %d", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,431 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/go-pkgz/lgr"
+	"github.com/tipok/kubeproxy/k8s"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Formats of access logs
+const (
+	AccessLogJSON   = "json"
+	AccessLogLogfmt = "logfmt"
+)
+
+// Kinds of access log entries
+const (
+	kindHTTP    = "http"
+	kindConnect = "connect"
+	kindSOCKS   = "socks"
+	kindForward = "forward"
+)
+
+// Classes of errors in access log entries
+const (
+	errorAccessDenied = "access_denied"
+	errorSafeMode     = "safe_mode"
+	errorResolve      = "resolve"
+	errorDial         = "dial"
+	errorUpstream     = "upstream"
+	errorHeaders      = "headers"
+	errorReplay       = "replay"
+)
+
+// AccessLog writes one entry per request or tunnel to a cluster host
+type AccessLog struct {
+	// Cluster is the name of the kubeconfig context the proxy uses
+	Cluster string
+
+	format string
+	lock   sync.Mutex
+	w      io.Writer
+}
+
+// NewAccessLog writes entries in format json or logfmt to w
+func NewAccessLog(w io.Writer, format string) (*AccessLog, error) {
+	if format != AccessLogJSON && format != AccessLogLogfmt {
+		return nil, fmt.Errorf("unknown access log format %q, expected json or logfmt", format)
+	}
+	return &AccessLog{format: format, w: w}, nil
+}
+
+// accessEntry is filled while a request or tunnel is handled, it is written to the access log
+// and recorded in the metrics when it is finished
+type accessEntry struct {
+	id       uint64
+	registry *registry
+	log      *AccessLog
+	metrics  *Metrics
+	start    time.Time
+	// service is the name of the service of the host, empty for other hosts
+	service string
+	// lock guards the fields changed while the entry is active, they are read by the admin API
+	// and the watchers of tunnel timeouts
+	lock sync.Mutex
+	// closer closes both sides of a tunnel
+	closer func()
+	// timeouts of tunnels, set when the pod is dialed
+	timeouts Timeouts
+
+	Time      time.Time
+	Kind      string
+	Client    string
+	Method    string
+	Host      string
+	Cluster   string
+	Namespace string
+	Pod       string
+	Port      string
+	Status    int
+	Error     string
+	Resolve   time.Duration
+	Dial      time.Duration
+	bytesIn   int64
+	bytesOut  int64
+	connected bool
+}
+
+// begin starts the entry of a request or tunnel, it is listed by the admin API until it is
+// finished
+func (p *Proxy) begin(kind, client, method, host string) *accessEntry {
+	now := time.Now()
+	e := &accessEntry{registry: &p.active, log: p.AccessLog, metrics: p.Metrics, start: now, Time: now, Kind: kind, Client: client, Method: method, Host: host}
+	if p.AccessLog != nil {
+		e.Cluster = p.AccessLog.Cluster
+	}
+	// requests failing before the lookup are still attributed to the namespace
+	if h, err := p.parser.ParseHost(host, false); err == nil && h.K8s {
+		e.Namespace = h.Namespace
+		if h.Type == "svc" {
+			e.service = h.Name
+		}
+	}
+	p.active.add(e)
+	return e
+}
+
+// resolved records the pod found for the entry and how long it took
+func (e *accessEntry) resolved(tp *k8s.TargetPod, since time.Time) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.Resolve = time.Since(since)
+	e.Namespace, e.Pod, e.Port = tp.Namespace, tp.Name, tp.Port
+}
+
+// dialed records how long it took to connect to the pod
+func (e *accessEntry) dialed(since time.Time) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.Dial = time.Since(since)
+}
+
+// setStatus records the status sent to the client
+func (e *accessEntry) setStatus(status int) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.Status = status
+}
+
+// fail records the class of the error the request or tunnel failed with
+func (e *accessEntry) fail(class string) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.Error = class
+}
+
+// errorClass returns the class of errors returned by resolve and resolveTunnel
+func errorClass(err error) string {
+	var denied *AccessDeniedError
+	var unsafe *SafeModeError
+	switch {
+	case errors.As(err, &denied):
+		return errorAccessDenied
+	case errors.As(err, &unsafe):
+		return errorSafeMode
+	}
+	var timeout *TimeoutError
+	if errors.As(err, &timeout) {
+		return timeout.class()
+	}
+	return errorResolve
+}
+
+// trace measures how long it takes to get a connection to the pod for requests with ctx
+func (e *accessEntry) trace(r *http.Request) *http.Request {
+	if e == nil {
+		return r
+	}
+	var start time.Time
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), &httptrace.ClientTrace{
+		GetConn: func(string) { start = time.Now() },
+		GotConn: func(httptrace.GotConnInfo) {
+			e.lock.Lock()
+			defer e.lock.Unlock()
+			e.connected = true
+			if !start.IsZero() {
+				e.Dial = time.Since(start)
+			}
+		},
+	}))
+}
+
+// failRoundTrip records whether a request failed connecting to the pod or afterwards
+func (e *accessEntry) failRoundTrip(err error) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	var timeout *TimeoutError
+	switch {
+	case errors.As(err, &timeout):
+		e.Error = timeout.class()
+	case e.connected:
+		e.Error = errorUpstream
+	default:
+		e.Error = errorDial
+	}
+}
+
+// countRequest counts the bytes read of the body of r
+func (e *accessEntry) countRequest(r *http.Request) {
+	if e == nil || r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	r.Body = &capturedBody{ReadCloser: r.Body, read: func(b []byte) {
+		atomic.AddInt64(&e.bytesIn, int64(len(b)))
+	}}
+}
+
+// finishResponse finishes the entry when the body of resp is closed, upgraded connections are
+// finished when their tunnel is closed
+func (e *accessEntry) finishResponse(resp *http.Response) {
+	if e == nil {
+		return
+	}
+	e.setStatus(resp.StatusCode)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return
+	}
+	if resp.Body == nil {
+		e.finish()
+		return
+	}
+	resp.Body = &capturedBody{
+		ReadCloser: resp.Body,
+		read:       func(b []byte) { atomic.AddInt64(&e.bytesOut, int64(len(b))) },
+		close:      e.finish,
+	}
+}
+
+// countConn counts the bytes sent by and to the client of a tunnel
+func (e *accessEntry) countConn(conn net.Conn) net.Conn {
+	if e == nil {
+		return conn
+	}
+	return &countingConn{Conn: conn, in: &e.bytesIn, out: &e.bytesOut}
+}
+
+type countingConn struct {
+	net.Conn
+	in, out *int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(c.in, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(c.out, int64(n))
+	return n, err
+}
+
+// CloseWrite is passed on, tunnels half close connections
+func (c *countingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// finish writes the entry to the access log and records it in the metrics
+func (e *accessEntry) finish() {
+	if e == nil {
+		return
+	}
+	d := time.Since(e.start)
+	e.registry.remove(e)
+	// tunnels closed by timeouts might still set the error
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.metrics.finish(e, d)
+	e.log.write(e, d)
+}
+
+func (l *AccessLog) write(e *accessEntry, d time.Duration) {
+	if l == nil {
+		return
+	}
+	fields := []struct {
+		key   string
+		value interface{}
+	}{
+		{"time", e.Time.UTC().Format(time.RFC3339Nano)},
+		{"kind", e.Kind},
+		{"client", e.Client},
+		{"method", e.Method},
+		{"host", e.Host},
+		{"cluster", e.Cluster},
+		{"namespace", e.Namespace},
+		{"pod", e.Pod},
+		{"port", e.Port},
+		{"status", e.Status},
+		{"bytes_in", atomic.LoadInt64(&e.bytesIn)},
+		{"bytes_out", atomic.LoadInt64(&e.bytesOut)},
+		{"resolve_ms", ms(e.Resolve)},
+		{"dial_ms", ms(e.Dial)},
+		{"duration_ms", ms(d)},
+		{"error", e.Error},
+	}
+
+	var b strings.Builder
+	if l.format == AccessLogJSON {
+		// written field by field to keep the order
+		b.WriteByte('{')
+		for i, f := range fields {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			value, _ := json.Marshal(f.value)
+			b.WriteString(strconv.Quote(f.key) + ":" + string(value))
+		}
+		b.WriteByte('}')
+	} else {
+		for i, f := range fields {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(f.key + "=" + logfmtValue(f.value))
+		}
+	}
+	b.WriteByte('\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, err := io.WriteString(l.w, b.String()); err != nil {
+		log.Printf("[WARN] could not write access log: %v", err)
+	}
+}
+
+func logfmtValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if f, ok := v.(float64); ok {
+		s = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	if s == "" || strings.ContainsAny(s, " \"=\\\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// RotatingFile is an io.Writer appending to a file which is rotated when it exceeds MaxSize
+// bytes, the rotated files are kept as Path.1 to Path.<MaxBackups>
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	lock sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func (r *RotatingFile) Write(b []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.MaxSize > 0 && r.size > 0 && r.size+int64(len(b)) > r.MaxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file
+func (r *RotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *RotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+	_ = os.Remove(fmt.Sprintf("%s.%d", r.Path, r.MaxBackups))
+	for i := r.MaxBackups - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", r.Path, i), fmt.Sprintf("%s.%d", r.Path, i+1))
+	}
+	if r.MaxBackups > 0 {
+		if err := os.Rename(r.Path, r.Path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.Path); err != nil {
+		return err
+	}
+	return r.open()
+}
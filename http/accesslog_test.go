@@ -0,0 +1,161 @@
+package http
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lineWriter hands every written access log entry to a channel
+type lineWriter chan string
+
+func (w lineWriter) Write(b []byte) (int, error) {
+	w <- string(b)
+	return len(b), nil
+}
+
+func (w lineWriter) next(t *testing.T) string {
+	select {
+	case line := <-w:
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no access log entry written")
+		return ""
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write([]byte("pod:" + string(body)))
+	}))
+	lines := make(lineWriter, 10)
+	var err error
+	p.AccessLog, err = NewAccessLog(lines, AccessLogJSON)
+	if err != nil {
+		t.Fatalf("could not create access log: %v", err)
+	}
+	p.AccessLog.Cluster = "prod"
+	client := newTestClient(t, p)
+
+	do := func(url, body string) *http.Response {
+		resp, err := client.Post(url, "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		_, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	t.Run("json", func(t *testing.T) {
+		do("http://orders.shop.svc.cluster.local/orders", "hello")
+		var entry map[string]interface{}
+		line := lines.next(t)
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid entry %q: %v", line, err)
+		}
+		if !strings.HasPrefix(line, `{"time":`) {
+			t.Errorf("fields are not ordered: %s", line)
+		}
+		want := map[string]interface{}{
+			"kind": "http", "method": "POST", "host": "orders.shop.svc.cluster.local", "cluster": "prod",
+			"namespace": "shop", "pod": "orders-0", "port": "80", "status": float64(200),
+			"bytes_in": float64(5), "bytes_out": float64(9), "error": "",
+		}
+		for k, v := range want {
+			if entry[k] != v {
+				t.Errorf("expected %s %v, got %v", k, v, entry[k])
+			}
+		}
+		if entry["client"] == "" || entry["duration_ms"].(float64) <= 0 {
+			t.Errorf("unexpected entry %s", line)
+		}
+	})
+
+	t.Run("logfmt", func(t *testing.T) {
+		p.AccessLog.format = AccessLogLogfmt
+		defer func() { p.AccessLog.format = AccessLogJSON }()
+		do("http://orders.shop.svc.cluster.local/orders", "hello")
+		line := lines.next(t)
+		for _, field := range []string{" kind=http ", " namespace=shop ", " status=200 ", ` error=""`} {
+			if !strings.Contains(line, field) {
+				t.Errorf("expected %q in %q", field, line)
+			}
+		}
+	})
+
+	t.Run("access denied", func(t *testing.T) {
+		p.ACL, _ = NewAccessList("prod", []AccessRule{{Action: AccessDeny, Namespace: "shop"}})
+		defer func() { p.ACL = nil }()
+		if resp := do("http://orders.shop.svc.cluster.local/orders", ""); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected 403, got %d", resp.StatusCode)
+		}
+		line := lines.next(t)
+		if !strings.Contains(line, `"status":403`) || !strings.Contains(line, `"error":"access_denied"`) {
+			t.Errorf("unexpected entry %s", line)
+		}
+	})
+}
+
+// TestAccessEntryConcurrent is meant to be run with -race, entries are changed by the handler
+// and the watchers of tunnel timeouts while the admin API lists them
+func TestAccessEntryConcurrent(t *testing.T) {
+	p, _ := newFakeProxy(t, http.NotFoundHandler())
+	lines := make(lineWriter, 1)
+	p.AccessLog, _ = NewAccessLog(lines, AccessLogLogfmt)
+	e := p.begin(kindConnect, "127.0.0.1:1234", http.MethodConnect, "orders.shop.svc.cluster.local:80")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			e.lock.Lock()
+			e.Error = (&TimeoutError{Phase: phaseIdle}).class()
+			e.lock.Unlock()
+			_ = p.Connections()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		e.setStatus(http.StatusOK)
+		e.dialed(time.Now())
+		e.failRoundTrip(io.EOF)
+	}
+	<-done
+	e.finish()
+	if line := lines.next(t); !strings.Contains(line, "status=200") {
+		t.Errorf("unexpected entry %s", line)
+	}
+}
+
+func TestNewAccessLog(t *testing.T) {
+	if _, err := NewAccessLog(os.Stdout, "text"); err == nil {
+		t.Errorf("expected unknown format to be refused")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f := &RotatingFile{Path: path, MaxSize: 10, MaxBackups: 2}
+	defer f.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("could not write: %v", err)
+		}
+	}
+	for file, want := range map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"} {
+		b, err := ioutil.ReadFile(file)
+		if err != nil || string(b) != want {
+			t.Errorf("expected %s to contain %q, got %q (%v)", file, want, b, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups")
+	}
+}
@@ -0,0 +1,258 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/go-pkgz/lgr"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Admin serves the API controlling a running proxy, it must only be reachable by its user
+type Admin struct {
+	proxy   *Proxy
+	mux     *http.ServeMux
+	started time.Time
+	// CaptureOptions are used for captures started through the API
+	CaptureOptions CaptureOptions
+	// CaptureDir is the directory captures started through the API are written to, they are
+	// refused without it
+	CaptureDir string
+	// Listeners are the addresses the proxy accepts connections on by protocol
+	Listeners map[string]string
+	// Clusters are the kubeconfig contexts the proxy uses
+	Clusters []string
+}
+
+// StatusResponse describes the running proxy
+type StatusResponse struct {
+	Started     time.Time         `json:"started"`
+	Uptime      float64           `json:"uptimeSeconds"`
+	Listeners   map[string]string `json:"listeners"`
+	Clusters    []string          `json:"clusters"`
+	Connections int               `json:"connections"`
+}
+
+// CaptureRequest starts a capture
+type CaptureRequest struct {
+	// File is the name of the HAR file in the capture directory of the proxy
+	File string `json:"file"`
+}
+
+// CaptureResponse describes a started or stopped capture
+type CaptureResponse struct {
+	// File is the path of the HAR file on the host of the proxy
+	File    string `json:"file"`
+	Entries int    `json:"entries"`
+}
+
+// CloseRequest closes a tunnel
+type CloseRequest struct {
+	ID uint64 `json:"id"`
+}
+
+// RoutesResponse describes how hosts are routed to pods
+type RoutesResponse struct {
+	ClusterDomain string            `json:"clusterDomain"`
+	Aliases       map[string]string `json:"aliases"`
+	ClusterCIDRs  []string          `json:"clusterCidrs"`
+	// Pods are the pods with pooled connections to their port-forward API
+	Pods []PooledConnection `json:"pods"`
+}
+
+// FlushResponse tells how many cached entries were dropped
+type FlushResponse struct {
+	Connections int `json:"connections"`
+	Secrets     int `json:"secrets"`
+}
+
+// NewAdmin returns the admin API of p, p.Metrics are served on /metrics if set
+func (p *Proxy) NewAdmin() *Admin {
+	a := &Admin{proxy: p, mux: http.NewServeMux(), started: time.Now()}
+	a.mux.HandleFunc("/status", a.status)
+	a.mux.HandleFunc("/stats", a.stats)
+	a.mux.HandleFunc("/capture/start", a.startCapture)
+	a.mux.HandleFunc("/capture/stop", a.stopCapture)
+	a.mux.HandleFunc("/connections", a.connections)
+	a.mux.HandleFunc("/connections/close", a.closeConnection)
+	a.mux.HandleFunc("/routes", a.routes)
+	a.mux.HandleFunc("/caches/flush", a.flushCaches)
+	if p.Metrics != nil {
+		a.mux.Handle("/metrics", p.Metrics)
+	}
+	if p.Health != nil {
+		a.mux.Handle("/healthz", p.Health)
+		a.mux.Handle("/readyz", p.Health)
+	}
+	return a
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// browsers send the origin of cross-origin requests, web pages must not control the proxy
+	if r.Header.Get("Origin") != "" {
+		http.Error(w, "Cross-origin requests are not allowed", http.StatusForbidden)
+		return
+	}
+	// forms are posted cross-origin without preflight, JSON bodies are not
+	if r.Method == http.MethodPost {
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			http.Error(w, "Expected Content-Type application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+// capturePath returns the path of the capture file name in CaptureDir, names can't leave it
+func (a *Admin) capturePath(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid capture file %q, expected a file name", name)
+	}
+	return filepath.Join(a.CaptureDir, name), nil
+}
+
+func (a *Admin) startCapture(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.CaptureDir == "" {
+		http.Error(w, "Capturing through the admin API is disabled", http.StatusForbidden)
+		return
+	}
+	var req CaptureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.File == "" {
+		http.Error(w, "Expected {\"file\": name}", http.StatusBadRequest)
+		return
+	}
+	file, err := a.capturePath(req.File)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = a.proxy.StartCapture(file, a.CaptureOptions)
+	if errors.Is(err, ErrCapturing) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, &CaptureResponse{File: file})
+}
+
+func (a *Admin) stopCapture(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	file, entries, err := a.proxy.StopCapture()
+	if errors.Is(err, ErrNotCapturing) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, &CaptureResponse{File: file, Entries: entries})
+}
+
+func (a *Admin) status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, &StatusResponse{
+		Started:     a.started,
+		Uptime:      time.Since(a.started).Seconds(),
+		Listeners:   a.Listeners,
+		Clusters:    a.Clusters,
+		Connections: len(a.proxy.Connections()),
+	})
+}
+
+// stats returns the totals of requests per service, p.Metrics have to be set
+func (a *Admin) stats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, a.proxy.Metrics.ServiceStats())
+}
+
+func (a *Admin) connections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, a.proxy.Connections())
+}
+
+func (a *Admin) closeConnection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req CloseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == 0 {
+		http.Error(w, "Expected {\"id\": id}", http.StatusBadRequest)
+		return
+	}
+	info, err := a.proxy.CloseConnection(req.ID)
+	switch {
+	case errors.Is(err, ErrUnknownConnection):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrNotTunnel):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("[INFO] closed tunnel %d of %s to %s", info.ID, info.Client, info.Host)
+		writeJSON(w, &info)
+	}
+}
+
+func (a *Admin) routes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parser := a.proxy.parser
+	resp := &RoutesResponse{
+		ClusterDomain: parser.ClusterDomain,
+		Aliases:       parser.Aliases,
+		ClusterCIDRs:  []string{},
+		Pods:          a.proxy.conns.list(),
+	}
+	if resp.Aliases == nil {
+		resp.Aliases = map[string]string{}
+	}
+	for _, cidr := range parser.CIDRs {
+		resp.ClusterCIDRs = append(resp.ClusterCIDRs, cidr.String())
+	}
+	writeJSON(w, resp)
+}
+
+// flushCaches drops pooled connections to pods, idle keep-alive connections and values of
+// secrets, so changes in the cluster are picked up
+func (a *Admin) flushCaches(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	a.proxy.transport.CloseIdleConnections()
+	resp := &FlushResponse{Connections: a.proxy.conns.flush(), Secrets: a.proxy.Headers.flush()}
+	log.Printf("[INFO] flushed %d pooled connections and %d secrets", resp.Connections, resp.Secrets)
+	writeJSON(w, resp)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[DEBUG] could not write response: %v", err)
+	}
+}
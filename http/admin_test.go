@@ -0,0 +1,198 @@
+package http
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/elazarl/goproxy"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminGet(t *testing.T, url string, out interface{}) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+}
+
+func adminPost(t *testing.T, url, body string, out interface{}) int {
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("invalid response: %v", err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// openTunnel opens a CONNECT tunnel to orders through p and sends a request through it
+func openTunnel(t *testing.T, p *Proxy) (net.Conn, *bufio.Reader) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(p.ClusterRequest()).HandleConnectFunc(p.TunnelConnect)
+	srv := httptest.NewServer(proxy)
+	t.Cleanup(srv.Close)
+	proxyURL, _ := url.Parse(srv.URL)
+
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	if err != nil {
+		t.Fatalf("could not dial proxy: %v", err)
+	}
+	r := bufio.NewReader(conn)
+	_, _ = conn.Write([]byte("CONNECT orders.shop.svc.cluster.local:80 HTTP/1.1\r\nHost: orders.shop.svc.cluster.local:80\r\n\r\n"))
+	if resp, err := http.ReadResponse(r, nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("could not open tunnel: %v", err)
+	}
+	_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: orders.shop.svc.cluster.local\r\n\r\n"))
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("could not read response: %v", err)
+	}
+	_, _ = ioutil.ReadAll(resp.Body)
+	return conn, r
+}
+
+func TestAdminConnections(t *testing.T) {
+	p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("pod"))
+	}))
+	admin := httptest.NewServer(p.NewAdmin())
+	defer admin.Close()
+	conn, r := openTunnel(t, p)
+	defer conn.Close()
+
+	var conns []ConnectionInfo
+	adminGet(t, admin.URL+"/connections", &conns)
+	if len(conns) != 1 {
+		t.Fatalf("expected 1 connection, got %+v", conns)
+	}
+	c := conns[0]
+	if c.Kind != kindConnect || c.Host != "orders.shop.svc.cluster.local:80" || c.Namespace != "shop" || c.Service != "orders" || c.Pod != "orders-0" ||
+		c.BytesIn == 0 || c.BytesOut == 0 || c.Age <= 0 {
+		t.Errorf("unexpected connection %+v", c)
+	}
+
+	if status := adminPost(t, admin.URL+"/connections/close", `{"id": 1000}`, nil); status != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown connection, got %d", status)
+	}
+	var closed ConnectionInfo
+	if status := adminPost(t, admin.URL+"/connections/close", `{"id": `+strconv.FormatUint(c.ID, 10)+`}`, &closed); status != http.StatusOK || closed.ID != c.ID {
+		t.Fatalf("could not close tunnel: %d", status)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("expected tunnel to be closed, got %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		adminGet(t, admin.URL+"/connections", &conns)
+		if len(conns) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(conns) != 0 {
+		t.Errorf("closed tunnel is still listed: %+v", conns)
+	}
+}
+
+func TestAdminStatus(t *testing.T) {
+	p, _ := newFakeProxy(t, http.NotFoundHandler())
+	a := p.NewAdmin()
+	a.Listeners = map[string]string{"http": "127.0.0.1:8080", "admin": "unix:/tmp/kubeproxy.sock"}
+	a.Clusters = []string{"dev"}
+	admin := httptest.NewServer(a)
+	defer admin.Close()
+
+	var status StatusResponse
+	adminGet(t, admin.URL+"/status", &status)
+	if status.Listeners["http"] != "127.0.0.1:8080" || len(status.Clusters) != 1 || status.Clusters[0] != "dev" ||
+		status.Uptime <= 0 || status.Connections != 0 || time.Since(status.Started) > time.Minute {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestAdminBrowserRequests(t *testing.T) {
+	p, _ := newFakeProxy(t, http.NotFoundHandler())
+	admin := httptest.NewServer(p.NewAdmin())
+	defer admin.Close()
+
+	for _, tt := range []struct {
+		method, contentType, origin string
+		status                      int
+	}{
+		{http.MethodGet, "", "", http.StatusOK},
+		{http.MethodGet, "", "http://evil.example", http.StatusForbidden},
+		{http.MethodPost, "application/json", "http://evil.example", http.StatusForbidden},
+		// a form posted by a web page
+		{http.MethodPost, "text/plain", "", http.StatusUnsupportedMediaType},
+		{http.MethodPost, "application/json; charset=utf-8", "", http.StatusOK},
+	} {
+		path := "/connections"
+		if tt.method == http.MethodPost {
+			path = "/caches/flush"
+		}
+		req, _ := http.NewRequest(tt.method, admin.URL+path, strings.NewReader("{}"))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s %s %q from %q: expected %d, got %d", tt.method, path, tt.contentType, tt.origin, tt.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestAdminRoutesAndFlush(t *testing.T) {
+	p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("pod"))
+	}))
+	p.Parser().Aliases = map[string]string{"orders.dev": "orders.shop.svc.cluster.local"}
+	admin := httptest.NewServer(p.NewAdmin())
+	defer admin.Close()
+	client := newTestClient(t, p)
+
+	resp, err := client.Get("http://orders.dev/")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	_, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	var routes RoutesResponse
+	adminGet(t, admin.URL+"/routes", &routes)
+	if routes.ClusterDomain != "cluster.local" || routes.Aliases["orders.dev"] != "orders.shop.svc.cluster.local" ||
+		len(routes.Pods) != 1 || routes.Pods[0].Pod != "orders-0" || routes.Pods[0].Namespace != "shop" {
+		t.Errorf("unexpected routes %+v", routes)
+	}
+
+	var flushed FlushResponse
+	if status := adminPost(t, admin.URL+"/caches/flush", "", &flushed); status != http.StatusOK || flushed.Connections != 1 {
+		t.Errorf("unexpected flush %d %+v", status, flushed)
+	}
+	adminGet(t, admin.URL+"/routes", &routes)
+	if len(routes.Pods) != 0 {
+		t.Errorf("expected pool to be empty, got %+v", routes.Pods)
+	}
+}
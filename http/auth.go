@@ -0,0 +1,116 @@
+package http
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	log "github.com/go-pkgz/lgr"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// authRealm is sent in Proxy-Authenticate challenges
+const authRealm = "kubeproxy"
+
+// Htpasswd holds the credentials of the proxy users, loaded from a htpasswd file with bcrypt
+// hashes as created by htpasswd -B
+type Htpasswd struct {
+	users map[string][]byte
+	// verified caches digests of passwords which matched, bcrypt is slow on purpose and
+	// clients send the credentials with every request
+	lock     sync.Mutex
+	verified map[string][sha256.Size]byte
+}
+
+// LoadHtpasswd reads the users of the htpasswd file
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open htpasswd file: %w", err)
+	}
+	defer f.Close()
+
+	h := &Htpasswd{users: map[string][]byte{}, verified: map[string][sha256.Size]byte{}}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid line %d of %s", n, path)
+		}
+		if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+			return nil, fmt.Errorf("password of %s is not a bcrypt hash, use htpasswd -B: %w", parts[0], err)
+		}
+		h.users[parts[0]] = []byte(parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read htpasswd file: %w", err)
+	}
+	if len(h.users) == 0 {
+		return nil, fmt.Errorf("no users found in %s", path)
+	}
+	return h, nil
+}
+
+// Verify reports whether the password of user matches
+func (h *Htpasswd) Verify(user, password string) bool {
+	hash, ok := h.users[user]
+	if !ok {
+		return false
+	}
+	digest := sha256.Sum256([]byte(password))
+	h.lock.Lock()
+	cached, ok := h.verified[user]
+	h.lock.Unlock()
+	if ok && subtle.ConstantTimeCompare(cached[:], digest[:]) == 1 {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	h.lock.Lock()
+	h.verified[user] = digest
+	h.lock.Unlock()
+	return true
+}
+
+// proxyUser returns the user authenticated by the Proxy-Authorization header of r
+func (h *Htpasswd) proxyUser(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok || !h.Verify(user, password) {
+		return user, false
+	}
+	return user, true
+}
+
+// authenticate answers requests without valid credentials with a 407 challenge
+func (h *Htpasswd) authenticate(w http.ResponseWriter, r *http.Request) bool {
+	user, ok := h.proxyUser(r)
+	if ok {
+		return true
+	}
+	if user != "" {
+		log.Printf("[INFO] invalid credentials of %s from %s", user, r.RemoteAddr)
+	}
+	w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", authRealm))
+	http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+	return false
+}
@@ -0,0 +1,140 @@
+package http
+
+import (
+	"bufio"
+	"encoding/base64"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func newTestHtpasswd(t *testing.T) *Htpasswd {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("could not hash password: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := ioutil.WriteFile(path, []byte("# users\ndev:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatalf("could not write htpasswd file: %v", err)
+	}
+	users, err := LoadHtpasswd(path)
+	if err != nil {
+		t.Fatalf("could not load htpasswd file: %v", err)
+	}
+	return users
+}
+
+func TestLoadHtpasswd(t *testing.T) {
+	users := newTestHtpasswd(t)
+	if !users.Verify("dev", "secret") || !users.Verify("dev", "secret") {
+		t.Errorf("expected password to match")
+	}
+	if users.Verify("dev", "guess") || users.Verify("ops", "secret") {
+		t.Errorf("expected invalid credentials to be refused")
+	}
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	_ = ioutil.WriteFile(path, []byte("dev:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0600)
+	if _, err := LoadHtpasswd(path); err == nil {
+		t.Errorf("expected non bcrypt hash to be refused")
+	}
+}
+
+func TestHandlerAuthentication(t *testing.T) {
+	p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Errorf("credentials were forwarded to the pod")
+		}
+		_, _ = w.Write([]byte("pod"))
+	}))
+	p.Users = newTestHtpasswd(t)
+	front := httptest.NewServer(p.Handler(http.NotFoundHandler()))
+	defer front.Close()
+	proxyURL, _ := url.Parse(front.URL)
+
+	get := func(user *url.Userinfo) *http.Response {
+		u := *proxyURL
+		u.User = user
+		tr := &http.Transport{Proxy: http.ProxyURL(&u)}
+		defer tr.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: tr}).Get("http://orders.shop.svc.cluster.local/")
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	t.Run("without credentials", func(t *testing.T) {
+		resp := get(nil)
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			t.Errorf("expected 407, got %d", resp.StatusCode)
+		}
+		if challenge := resp.Header.Get("Proxy-Authenticate"); challenge != `Basic realm="kubeproxy"` {
+			t.Errorf("unexpected challenge %q", challenge)
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		if resp := get(url.UserPassword("dev", "guess")); resp.StatusCode != http.StatusProxyAuthRequired {
+			t.Errorf("expected 407, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("valid credentials", func(t *testing.T) {
+		if resp := get(url.UserPassword("dev", "secret")); resp.StatusCode != http.StatusOK {
+			t.Errorf("expected 200, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("connect", func(t *testing.T) {
+		conn, err := net.Dial("tcp", proxyURL.Host)
+		if err != nil {
+			t.Fatalf("could not dial proxy: %v", err)
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("CONNECT orders.shop.svc.cluster.local:443 HTTP/1.1\r\nHost: orders.shop.svc.cluster.local:443\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("could not read response: %v", err)
+		}
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			t.Errorf("expected 407, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("connect with credentials", func(t *testing.T) {
+		conn, err := net.Dial("tcp", proxyURL.Host)
+		if err != nil {
+			t.Fatalf("could not dial proxy: %v", err)
+		}
+		defer conn.Close()
+		credentials := base64.StdEncoding.EncodeToString([]byte("dev:secret"))
+		_, _ = conn.Write([]byte("CONNECT orders.shop.svc.cluster.local:443 HTTP/1.1\r\nHost: orders.shop.svc.cluster.local:443\r\n" +
+			"Proxy-Authorization: Basic " + credentials + "\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("could not read response: %v", err)
+		}
+		// passed on to the next handler
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("pac file", func(t *testing.T) {
+		resp, err := http.Get(front.URL + "/proxy.pac")
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected 200, got %d", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package http
+
+import (
+	"fmt"
+	log "github.com/go-pkgz/lgr"
+	"github.com/tipok/kubeproxy/k8s"
+	"io"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// podAddr is the net.Addr of a port-forward stream
+type podAddr struct {
+	tp *k8s.TargetPod
+}
+
+func (a podAddr) Network() string {
+	return "portforward"
+}
+
+func (a podAddr) String() string {
+	return fmt.Sprintf("%s/%s:%s", a.tp.Namespace, a.tp.Name, a.tp.Port)
+}
+
+// streamConn is a net.Conn backed by a port-forward data stream. Errors reported by the
+// kubelet on the matching error stream are returned once the data stream is drained, onError
+// is called for them.
+type streamConn struct {
+	tp          *k8s.TargetPod
+	streamConn  httpstream.Connection
+	dataStream  httpstream.Stream
+	errorStream httpstream.Stream
+
+	errorDone chan struct{}
+	err       error
+	closeOnce sync.Once
+	// onClose is called when the connection is closed if set
+	onClose func()
+}
+
+func newStreamConn(con httpstream.Connection, tp *k8s.TargetPod, requestID int, onError func()) (*streamConn, error) {
+	// create error stream
+	headers := http.Header{}
+	headers.Set(v1.StreamType, v1.StreamTypeError)
+	headers.Set(v1.PortHeader, tp.Port)
+	headers.Set(v1.PortForwardRequestIDHeader, strconv.Itoa(requestID))
+	errorStream, err := con.CreateStream(headers)
+	if err != nil {
+		return nil, fmt.Errorf("error creating error stream for pod %s -> %s: %v", tp.Name, tp.Port, err)
+	}
+	// we're not writing to this stream
+	err = errorStream.Close()
+	if err != nil {
+		log.Printf("[DEBUG] error closing error stream for pod %s -> %s: %v", tp.Name, tp.Port, err)
+	}
+
+	// create data stream
+	headers.Set(v1.StreamType, v1.StreamTypeData)
+	dataStream, err := con.CreateStream(headers)
+	if err != nil {
+		_ = errorStream.Reset()
+		con.RemoveStreams(errorStream)
+		return nil, fmt.Errorf("error creating forwarding stream for pod %s -> %s: %v", tp.Name, tp.Port, err)
+	}
+
+	c := &streamConn{
+		tp:          tp,
+		streamConn:  con,
+		dataStream:  dataStream,
+		errorStream: errorStream,
+		errorDone:   make(chan struct{}),
+	}
+	go func() {
+		message, err := ioutil.ReadAll(errorStream)
+		switch {
+		case err != nil:
+			c.err = fmt.Errorf("error reading from error stream for pod %s -> %s: %v", tp.Name, tp.Port, err)
+		case len(message) > 0:
+			c.err = fmt.Errorf("an error occurred forwarding on pod %s -> %s: %v", tp.Name, tp.Port, string(message))
+			onError()
+		}
+		close(c.errorDone)
+	}()
+	return c, nil
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	n, err := c.dataStream.Read(b)
+	if err == io.EOF {
+		// the kubelet closes the error stream once forwarding is done
+		<-c.errorDone
+		if c.err != nil {
+			return n, c.err
+		}
+	}
+	return n, err
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	return c.dataStream.Write(b)
+}
+
+// CloseWrite informs the pod that we're not sending any more data
+func (c *streamConn) CloseWrite() error {
+	return c.dataStream.Close()
+}
+
+// Close tears down both streams, so the kubelet closes the connection to the pod
+func (c *streamConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.dataStream.Reset()
+		if rerr := c.errorStream.Reset(); rerr != nil {
+			log.Printf("[DEBUG] error resetting error stream for pod %s -> %s: %v", c.tp.Name, c.tp.Port, rerr)
+		}
+		c.streamConn.RemoveStreams(c.dataStream, c.errorStream)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return err
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return podAddr{tp: c.tp}
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return podAddr{tp: c.tp}
+}
+
+// SetDeadline is a no-op, deadlines of the underlying connection are shared by all streams
+func (c *streamConn) SetDeadline(_ time.Time) error {
+	return nil
+}
+
+// SetReadDeadline is a no-op, see SetDeadline
+func (c *streamConn) SetReadDeadline(_ time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline is a no-op, see SetDeadline
+func (c *streamConn) SetWriteDeadline(_ time.Time) error {
+	return nil
+}
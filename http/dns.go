@@ -0,0 +1,250 @@
+package http
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	log "github.com/go-pkgz/lgr"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// dnsTTL is short, addresses of services change when kubeproxy restarts
+	dnsTTL = 5
+	// dnsTimeout limits lookups of cluster hosts and queries to the upstream resolver
+	dnsTimeout = 5 * time.Second
+)
+
+// DNSServer answers queries for cluster hosts with the loopback addresses the forwarder binds
+// the services and pods on, other queries are forwarded to Upstream
+type DNSServer struct {
+	forwarder *Forwarder
+	// Upstream is the address of the resolver other queries are forwarded to, they are refused
+	// if it is empty
+	Upstream string
+}
+
+// NewDNSServer returns a DNS server for the services and pods bound by f, loopback addresses
+// have to be enabled with UseLoopback
+func (f *Forwarder) NewDNSServer() *DNSServer {
+	return &DNSServer{forwarder: f}
+}
+
+// ServeUDP answers queries received on conn until it is closed
+func (s *DNSServer) ServeUDP(conn net.PacketConn) error {
+	for {
+		buf := make([]byte, 65535)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		go func() {
+			resp := s.handle(buf[:n], "udp")
+			if resp == nil {
+				return
+			}
+			if _, err := conn.WriteTo(resp, addr); err != nil {
+				log.Printf("[DEBUG] could not answer %s: %v", addr, err)
+			}
+		}()
+	}
+}
+
+// ServeTCP answers queries of connections accepted on l until it is closed
+func (s *DNSServer) ServeTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				if err := conn.SetDeadline(time.Now().Add(dnsTimeout)); err != nil {
+					return
+				}
+				req, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				resp := s.handle(req, "tcp")
+				if resp == nil {
+					return
+				}
+				if err := writeTCPMessage(conn, resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var l uint16
+	if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, l)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+// handle returns the response to req, nil if req can't be parsed
+func (s *DNSServer) handle(req []byte, network string) []byte {
+	var m dnsmessage.Message
+	if err := m.Unpack(req); err != nil {
+		log.Printf("[DEBUG] invalid dns message: %v", err)
+		return nil
+	}
+	if len(m.Questions) != 1 {
+		return s.reply(&m, dnsmessage.RCodeFormatError, nil, nil)
+	}
+
+	q := m.Questions[0]
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	domain := s.forwarder.proxy.parser.ClusterDomain
+	if name != domain && !strings.HasSuffix(name, "."+domain) {
+		return s.forward(&m, req, network)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	answers, additionals, rcode := s.answer(ctx, q, name)
+	return s.reply(&m, rcode, answers, additionals)
+}
+
+// answer resolves the cluster host name, SRV queries use the names of the ports like
+// _http._tcp.orders.shop.svc.cluster.local
+func (s *DNSServer) answer(ctx context.Context, q dnsmessage.Question, name string) ([]dnsmessage.Resource, []dnsmessage.Resource, dnsmessage.RCode) {
+	host, portName := name, ""
+	if q.Type == dnsmessage.TypeSRV {
+		labels := strings.SplitN(name, ".", 3)
+		if len(labels) != 3 || !strings.HasPrefix(labels[0], "_") || labels[1] != "_tcp" {
+			return nil, nil, dnsmessage.RCodeNameError
+		}
+		host, portName = labels[2], strings.TrimPrefix(labels[0], "_")
+	}
+	h, err := s.forwarder.proxy.parser.ParseHost(host, false)
+	if err != nil || !h.K8s || (h.Type != "svc" && h.Type != "pod") {
+		return nil, nil, dnsmessage.RCodeNameError
+	}
+	ip, ports, err := s.forwarder.lookup(ctx, h)
+	if err != nil {
+		log.Printf("[INFO] could not resolve %s: %v", host, err)
+		var denied *AccessDeniedError
+		if errors.As(err, &denied) {
+			return nil, nil, dnsmessage.RCodeRefused
+		}
+		if apierrors.IsNotFound(err) {
+			return nil, nil, dnsmessage.RCodeNameError
+		}
+		return nil, nil, dnsmessage.RCodeServerFailure
+	}
+
+	hostName, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, nil, dnsmessage.RCodeNameError
+	}
+	body := &dnsmessage.AResource{}
+	copy(body.A[:], ip.To4())
+	a := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: hostName, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: dnsTTL},
+		Body:   body,
+	}
+	switch q.Type {
+	case dnsmessage.TypeA:
+		return []dnsmessage.Resource{a}, nil, dnsmessage.RCodeSuccess
+	case dnsmessage.TypeSRV:
+		port, ok := ports[portName]
+		if !ok {
+			return nil, nil, dnsmessage.RCodeNameError
+		}
+		p, _ := strconv.Atoi(port)
+		srv := dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: dnsTTL},
+			Body:   &dnsmessage.SRVResource{Priority: 0, Weight: 100, Port: uint16(p), Target: hostName},
+		}
+		return []dnsmessage.Resource{srv}, []dnsmessage.Resource{a}, dnsmessage.RCodeSuccess
+	}
+	// the name exists but has no records of the type, e.g. AAAA
+	return nil, nil, dnsmessage.RCodeSuccess
+}
+
+func (s *DNSServer) reply(m *dnsmessage.Message, rcode dnsmessage.RCode, answers, additionals []dnsmessage.Resource) []byte {
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 m.ID,
+			Response:           true,
+			OpCode:             m.OpCode,
+			Authoritative:      true,
+			RecursionDesired:   m.RecursionDesired,
+			RecursionAvailable: s.Upstream != "",
+			RCode:              rcode,
+		},
+		Questions:   m.Questions,
+		Answers:     answers,
+		Additionals: additionals,
+	}
+	b, err := resp.Pack()
+	if err != nil {
+		log.Printf("[ERROR] could not pack dns response: %v", err)
+		return nil
+	}
+	return b
+}
+
+// forward sends queries for names outside of the cluster domain to the upstream resolver
+func (s *DNSServer) forward(m *dnsmessage.Message, req []byte, network string) []byte {
+	if s.Upstream == "" {
+		return s.reply(m, dnsmessage.RCodeRefused, nil, nil)
+	}
+	resp, err := exchange(network, s.Upstream, req)
+	if err != nil {
+		log.Printf("[INFO] could not forward query for %s: %v", m.Questions[0].Name, err)
+		return s.reply(m, dnsmessage.RCodeServerFailure, nil, nil)
+	}
+	return resp
+}
+
+func exchange(network, upstream string, req []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, upstream, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(dnsTimeout)); err != nil {
+		return nil, err
+	}
+
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, req); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	if n < 2 || binary.BigEndian.Uint16(buf) != binary.BigEndian.Uint16(req) {
+		return nil, errors.New("unexpected response id")
+	}
+	return buf[:n], nil
+}
@@ -0,0 +1,154 @@
+package http
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTestDNSServer(t *testing.T, upstream string) string {
+	p, _ := newFakeProxy(t, http.NotFoundHandler())
+	f := p.NewForwarder()
+	t.Cleanup(func() { _ = f.Close() })
+	_, network, _ := net.ParseCIDR("127.88.0.0/16")
+	if err := f.UseLoopback(network, nil); err != nil {
+		t.Fatalf("could not enable loopback addresses: %v", err)
+	}
+	s := f.NewDNSServer()
+	s.Upstream = upstream
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() { _ = s.ServeUDP(conn) }()
+	return conn.LocalAddr().String()
+}
+
+func query(t *testing.T, server, name string, qtype dnsmessage.Type) *dnsmessage.Message {
+	req := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	b, err := req.Pack()
+	if err != nil {
+		t.Fatalf("could not pack query: %v", err)
+	}
+	resp, err := exchange("udp", server, b)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		t.Fatalf("could not unpack response: %v", err)
+	}
+	return &m
+}
+
+func TestDNSServer(t *testing.T) {
+	server := newTestDNSServer(t, "")
+
+	t.Run("A", func(t *testing.T) {
+		m := query(t, server, "orders.shop.svc.cluster.local.", dnsmessage.TypeA)
+		if m.RCode != dnsmessage.RCodeSuccess || len(m.Answers) != 1 {
+			t.Fatalf("unexpected response %v", m)
+		}
+		if a := m.Answers[0].Body.(*dnsmessage.AResource); net.IP(a.A[:]).String() != "127.88.0.1" {
+			t.Errorf("unexpected address %v", a.A)
+		}
+		// the service is reachable on its address
+		conn, err := net.DialTimeout("tcp", "127.88.0.1:8080", time.Second)
+		if err != nil {
+			t.Fatalf("service is not bound: %v", err)
+		}
+		_ = conn.Close()
+	})
+
+	t.Run("same address", func(t *testing.T) {
+		m := query(t, server, "Orders.Shop.svc.cluster.local.", dnsmessage.TypeA)
+		if a := m.Answers[0].Body.(*dnsmessage.AResource); net.IP(a.A[:]).String() != "127.88.0.1" {
+			t.Errorf("unexpected address %v", a.A)
+		}
+	})
+
+	t.Run("AAAA", func(t *testing.T) {
+		m := query(t, server, "orders.shop.svc.cluster.local.", dnsmessage.TypeAAAA)
+		if m.RCode != dnsmessage.RCodeSuccess || len(m.Answers) != 0 {
+			t.Errorf("expected no data, got %v", m)
+		}
+	})
+
+	t.Run("SRV", func(t *testing.T) {
+		m := query(t, server, "_grpc._tcp.payments.shop.svc.cluster.local.", dnsmessage.TypeSRV)
+		if m.RCode != dnsmessage.RCodeSuccess || len(m.Answers) != 1 || len(m.Additionals) != 1 {
+			t.Fatalf("unexpected response %v", m)
+		}
+		srv := m.Answers[0].Body.(*dnsmessage.SRVResource)
+		if srv.Port != 9090 || srv.Target.String() != "payments.shop.svc.cluster.local." {
+			t.Errorf("unexpected SRV record %v", srv)
+		}
+		if a := m.Additionals[0].Body.(*dnsmessage.AResource); net.IP(a.A[:]).String() != "127.88.0.2" {
+			t.Errorf("unexpected address %v", a.A)
+		}
+	})
+
+	t.Run("unknown port", func(t *testing.T) {
+		m := query(t, server, "_redis._tcp.payments.shop.svc.cluster.local.", dnsmessage.TypeSRV)
+		if m.RCode != dnsmessage.RCodeNameError {
+			t.Errorf("expected NXDOMAIN, got %v", m.RCode)
+		}
+	})
+
+	t.Run("invalid name", func(t *testing.T) {
+		m := query(t, server, "shop.svc.cluster.local.", dnsmessage.TypeA)
+		if m.RCode != dnsmessage.RCodeNameError {
+			t.Errorf("expected NXDOMAIN, got %v", m.RCode)
+		}
+	})
+
+	t.Run("without upstream", func(t *testing.T) {
+		m := query(t, server, "example.com.", dnsmessage.TypeA)
+		if m.RCode != dnsmessage.RCodeRefused {
+			t.Errorf("expected REFUSED, got %v", m.RCode)
+		}
+	})
+}
+
+func TestDNSServerForward(t *testing.T) {
+	// the upstream resolver answers everything with 192.0.2.1
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var m dnsmessage.Message
+			_ = m.Unpack(buf[:n])
+			m.Response = true
+			m.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: m.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			}}
+			resp, _ := m.Pack()
+			_, _ = upstream.WriteTo(resp, addr)
+		}
+	}()
+
+	server := newTestDNSServer(t, upstream.LocalAddr().String())
+	m := query(t, server, "example.com.", dnsmessage.TypeA)
+	if m.ID != 42 || len(m.Answers) != 1 {
+		t.Fatalf("unexpected response %v", m)
+	}
+	if a := m.Answers[0].Body.(*dnsmessage.AResource); a.A != [4]byte{192, 0, 2, 1} {
+		t.Errorf("unexpected address %v", a.A)
+	}
+}
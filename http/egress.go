@@ -0,0 +1,230 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Egress modes for hosts outside of the cluster
+const (
+	// EgressDirect connects to the host directly or through the proxies set in the environment
+	// (HTTP_PROXY, HTTPS_PROXY and NO_PROXY)
+	EgressDirect = "direct"
+	// EgressUpstream connects through an upstream HTTP or SOCKS5 proxy
+	EgressUpstream = "upstream"
+	// EgressReject refuses the request with 403 Forbidden
+	EgressReject = "reject"
+)
+
+// egressDialTimeout limits connecting to hosts outside of the cluster or the upstream proxy,
+// including the CONNECT handshake
+const egressDialTimeout = 30 * time.Second
+
+// ErrEgressRejected is returned when dialing hosts outside of the cluster is forbidden
+var ErrEgressRejected = fmt.Errorf("requests to hosts outside of the cluster are rejected")
+
+// Egress is the policy for requests to hosts outside of the cluster
+type Egress struct {
+	mode        string
+	proxyFor    func(*url.URL) (*url.URL, error)
+	dialTimeout time.Duration
+}
+
+// NewEgress creates the policy for mode. In upstream mode requests are sent through the proxy at
+// upstream (http, https or socks5 URL), except for hosts matching noProxy which are dialed
+// directly. noProxy has the format of the NO_PROXY environment variable.
+func NewEgress(mode, upstream, noProxy string) (*Egress, error) {
+	e := &Egress{mode: mode, dialTimeout: egressDialTimeout}
+	switch mode {
+	case EgressDirect:
+		e.proxyFor = httpproxy.FromEnvironment().ProxyFunc()
+		return e, nil
+	case EgressReject:
+		return e, nil
+	case EgressUpstream:
+	default:
+		return nil, fmt.Errorf("unknown egress mode %s", mode)
+	}
+
+	u, err := url.Parse(upstream)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream proxy %q", upstream)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy scheme %s", u.Scheme)
+	}
+	e.proxyFor = (&httpproxy.Config{
+		HTTPProxy:  upstream,
+		HTTPSProxy: upstream,
+		NoProxy:    noProxy,
+	}).ProxyFunc()
+	return e, nil
+}
+
+// Proxy returns the upstream proxy for req, nil if req is sent directly. It can be used as
+// http.Transport.Proxy.
+func (e *Egress) Proxy(req *http.Request) (*url.URL, error) {
+	if e.mode == EgressReject {
+		return nil, nil
+	}
+	return e.proxyFor(req.URL)
+}
+
+// Dial connects to addr according to the policy
+func (e *Egress) Dial(network, addr string) (net.Conn, error) {
+	return e.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr according to the policy, giving up once ctx is done
+func (e *Egress) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch e.mode {
+	case EgressReject:
+		return nil, ErrEgressRejected
+	}
+
+	upstream, err := e.proxyFor(&url.URL{Scheme: "https", Host: addr})
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: e.dialTimeout}
+	if upstream == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	if upstream.Scheme == "socks5" {
+		socks, err := proxy.FromURL(upstream, dialer)
+		if err != nil {
+			return nil, err
+		}
+		if e.dialTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, e.dialTimeout)
+			defer cancel()
+		}
+		return socks.(proxy.ContextDialer).DialContext(ctx, network, addr)
+	}
+	return dialConnect(ctx, dialer, upstream, addr)
+}
+
+// dialConnect opens a tunnel to addr through the HTTP proxy at upstream, the CONNECT handshake
+// has to complete within the timeout of dialer
+func dialConnect(ctx context.Context, dialer *net.Dialer, upstream *url.URL, addr string) (net.Conn, error) {
+	host := upstream.Host
+	if upstream.Port() == "" {
+		host = net.JoinHostPort(upstream.Hostname(), "80")
+		if upstream.Scheme == "https" {
+			host = net.JoinHostPort(upstream.Hostname(), "443")
+		}
+	}
+	var conn net.Conn
+	var err error
+	if upstream.Scheme == "https" {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: upstream.Hostname()}}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", host)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not dial upstream proxy: %w", err)
+	}
+
+	// the deadline limits the handshake, it is cut short once ctx is done
+	if dialer.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(dialer.Timeout))
+	}
+	stop := interruptOnDone(ctx, conn)
+	defer stop()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u := upstream.User; u != nil {
+		password, _ := u.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("could not write CONNECT request: %w", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("could not read CONNECT response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("upstream proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+	stop()
+	if err := ctx.Err(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// interruptOnDone sets a past deadline on conn once ctx is done, the returned function stops
+// watching ctx and returns once it did
+func interruptOnDone(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}
+}
+
+// Configure applies the policy to the requests matching cond
+func (e *Egress) Configure(p *goproxy.ProxyHttpServer, cond goproxy.ReqCondition) {
+	switch e.mode {
+	case EgressReject:
+		onReq := p.OnRequest(cond)
+		onReq.DoFunc(func(r *http.Request, _ *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusForbidden, ErrEgressRejected.Error())
+		})
+		onReq.HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			resp := goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusForbidden, ErrEgressRejected.Error())
+			resp.ProtoMajor, resp.ProtoMinor = 1, 1
+			ctx.Resp = resp
+			return goproxy.RejectConnect, host
+		})
+	default:
+		p.Tr.Proxy = e.Proxy
+		p.ConnectDial = e.Dial
+	}
+}
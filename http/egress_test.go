@@ -0,0 +1,223 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/elazarl/goproxy"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestNewEgress(t *testing.T) {
+	tests := []struct {
+		mode     string
+		upstream string
+		valid    bool
+	}{
+		{EgressDirect, "", true},
+		{EgressReject, "", true},
+		{EgressUpstream, "http://proxy:3128", true},
+		{EgressUpstream, "socks5://proxy:1080", true},
+		{EgressUpstream, "", false},
+		{EgressUpstream, "ftp://proxy:21", false},
+		{"sometimes", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+" "+tt.upstream, func(t *testing.T) {
+			_, err := NewEgress(tt.mode, tt.upstream, "")
+			if (err == nil) != tt.valid {
+				t.Errorf("NewEgress(%s, %s) error = %v", tt.mode, tt.upstream, err)
+			}
+		})
+	}
+}
+
+// newFakeUpstream starts a HTTP proxy accepting CONNECT requests, the tunnels are answered
+// with the target address
+func newFakeUpstream(t *testing.T) (addr string, connects chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	connects = make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				connects <- req.Host
+				_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n" + req.Host))
+			}()
+		}
+	}()
+	return l.Addr().String(), connects
+}
+
+func TestEgressDial(t *testing.T) {
+	t.Run("reject", func(t *testing.T) {
+		e, _ := NewEgress(EgressReject, "", "")
+		if _, err := e.Dial("tcp", "example.com:443"); !errors.Is(err, ErrEgressRejected) {
+			t.Errorf("expected rejection, got %v", err)
+		}
+	})
+
+	t.Run("upstream", func(t *testing.T) {
+		addr, connects := newFakeUpstream(t)
+		e, err := NewEgress(EgressUpstream, "http://"+addr, "")
+		if err != nil {
+			t.Fatalf("could not create egress: %v", err)
+		}
+		conn, err := e.Dial("tcp", "example.com:443")
+		if err != nil {
+			t.Fatalf("could not dial: %v", err)
+		}
+		defer conn.Close()
+		body, _ := ioutil.ReadAll(conn)
+		if string(body) != "example.com:443" {
+			t.Errorf("expected tunnel to example.com:443, got %q", body)
+		}
+		if host := <-connects; host != "example.com:443" {
+			t.Errorf("expected CONNECT example.com:443, got %s", host)
+		}
+	})
+
+	t.Run("direct through environment", func(t *testing.T) {
+		addr, connects := newFakeUpstream(t)
+		t.Setenv("HTTPS_PROXY", "http://"+addr)
+		t.Setenv("HTTP_PROXY", "")
+		t.Setenv("NO_PROXY", "")
+		e, _ := NewEgress(EgressDirect, "", "")
+		conn, err := e.Dial("tcp", "example.com:443")
+		if err != nil {
+			t.Fatalf("could not dial: %v", err)
+		}
+		_ = conn.Close()
+		if host := <-connects; host != "example.com:443" {
+			t.Errorf("expected CONNECT example.com:443, got %s", host)
+		}
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		if u, err := e.Proxy(req); err != nil || u != nil {
+			t.Errorf("expected no proxy without HTTP_PROXY, got %v %v", u, err)
+		}
+	})
+
+	t.Run("no proxy", func(t *testing.T) {
+		direct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer direct.Close()
+		addr, connects := newFakeUpstream(t)
+		e, err := NewEgress(EgressUpstream, "http://"+addr, "127.0.0.1")
+		if err != nil {
+			t.Fatalf("could not create egress: %v", err)
+		}
+		conn, err := e.Dial("tcp", direct.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("could not dial: %v", err)
+		}
+		_ = conn.Close()
+		select {
+		case host := <-connects:
+			t.Errorf("expected direct connection, got CONNECT %s", host)
+		default:
+		}
+	})
+}
+
+func TestEgressDialTimeout(t *testing.T) {
+	// the upstream proxy accepts connections but never answers CONNECT requests
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(ioutil.Discard, conn) }()
+		}
+	}()
+	e, err := NewEgress(EgressUpstream, "http://"+l.Addr().String(), "")
+	if err != nil {
+		t.Fatalf("could not create egress: %v", err)
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		e.dialTimeout = 50 * time.Millisecond
+		defer func() { e.dialTimeout = egressDialTimeout }()
+		start := time.Now()
+		if _, err := e.Dial("tcp", "example.com:443"); err == nil {
+			t.Fatalf("expected dial to fail")
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("dial took %s", d)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		if _, err := e.DialContext(ctx, "tcp", "example.com:443"); err == nil {
+			t.Fatalf("expected dial to fail")
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("dial took %s", d)
+		}
+	})
+}
+
+func TestEgressConfigureReject(t *testing.T) {
+	e, _ := NewEgress(EgressReject, "", "")
+	proxy := goproxy.NewProxyHttpServer()
+	e.Configure(proxy, goproxy.Not(goproxy.ReqHostMatches(regexp.MustCompile(`\.cluster\.local`))))
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	t.Run("http", func(t *testing.T) {
+		resp, err := client.Get("http://example.com/")
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("connect", func(t *testing.T) {
+		conn, err := net.Dial("tcp", proxyURL.Host)
+		if err != nil {
+			t.Fatalf("could not dial proxy: %v", err)
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("could not read response: %v", err)
+		}
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,227 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/tipok/kubeproxy/k8s"
+	"golang.org/x/net/http2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pipeListener is a net.Listener accepting the pod side of fake data streams
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// fakeStream is a httpstream.Stream on top of one end of a net.Pipe
+type fakeStream struct {
+	net.Conn
+	headers http.Header
+	id      uint32
+	conn    *fakeConnection
+	once    sync.Once
+}
+
+func (s *fakeStream) Close() error {
+	return s.Reset()
+}
+
+func (s *fakeStream) Reset() error {
+	s.once.Do(func() {
+		atomic.AddInt32(&s.conn.open, -1)
+	})
+	return s.Conn.Close()
+}
+
+func (s *fakeStream) Headers() http.Header {
+	return s.headers
+}
+
+func (s *fakeStream) Identifier() uint32 {
+	return s.id
+}
+
+// fakeErrorStream never receives an error, reading from it blocks until it is reset
+type fakeErrorStream struct {
+	fakeStream
+	done chan struct{}
+}
+
+func (s *fakeErrorStream) Read(_ []byte) (int, error) {
+	<-s.done
+	return 0, net.ErrClosed
+}
+
+func (s *fakeErrorStream) Close() error {
+	return nil
+}
+
+func (s *fakeErrorStream) Reset() error {
+	s.once.Do(func() {
+		atomic.AddInt32(&s.conn.open, -1)
+		close(s.done)
+	})
+	return nil
+}
+
+// fakeConnection is a httpstream.Connection handing data streams to a listener
+type fakeConnection struct {
+	listener    *pipeListener
+	dataStreams int32
+	open        int32
+	ids         uint32
+	closed      chan bool
+	closeOnce   sync.Once
+}
+
+func newFakeConnection(t *testing.T, h http.Handler) *fakeConnection {
+	return newFakeTLSConnection(t, h, nil)
+}
+
+// newFakeTLSConnection returns a connection to a pod serving TLS with cfg, plain HTTP if cfg is nil
+func newFakeTLSConnection(t *testing.T, h http.Handler, cfg *tls.Config) *fakeConnection {
+	l := &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+	srv := &http.Server{Handler: h}
+	if cfg != nil {
+		// pods negotiating h2 speak HTTP/2
+		_ = http2.ConfigureServer(srv, nil)
+	}
+	go func() {
+		if cfg != nil {
+			_ = srv.Serve(tls.NewListener(l, cfg))
+			return
+		}
+		_ = srv.Serve(l)
+	}()
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+	return &fakeConnection{listener: l, closed: make(chan bool)}
+}
+
+func (c *fakeConnection) CreateStream(headers http.Header) (httpstream.Stream, error) {
+	id := atomic.AddUint32(&c.ids, 1)
+	atomic.AddInt32(&c.open, 1)
+	if headers.Get(v1.StreamType) == v1.StreamTypeError {
+		return &fakeErrorStream{fakeStream: fakeStream{headers: headers, id: id, conn: c}, done: make(chan struct{})}, nil
+	}
+	atomic.AddInt32(&c.dataStreams, 1)
+	local, remote := net.Pipe()
+	c.listener.conns <- remote
+	return &fakeStream{Conn: local, headers: headers, id: id, conn: c}, nil
+}
+
+func (c *fakeConnection) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakeConnection) CloseChan() <-chan bool {
+	return c.closed
+}
+
+func (c *fakeConnection) SetIdleTimeout(_ time.Duration) {}
+
+func (c *fakeConnection) RemoveStreams(_ ...httpstream.Stream) {}
+
+// fakeResolver resolves every host to the first pod of a stateful set
+type fakeResolver struct {
+	// events are sent to service watches
+	events chan k8s.ServiceEvent
+	// pingErr is returned by Ping
+	pingErr error
+}
+
+func (fakeResolver) GetMatchingPod(_ context.Context, namespace, podName, port string) (*k8s.TargetPod, error) {
+	return &k8s.TargetPod{Name: podName, Namespace: namespace, Port: port}, nil
+}
+
+func (fakeResolver) GetMatchingPodForService(_ context.Context, namespace, serviceName, port string) (*k8s.TargetPod, error) {
+	return &k8s.TargetPod{Name: serviceName + "-0", Namespace: namespace, Port: port}, nil
+}
+
+// ListServices returns an orders and a payments service for every namespace
+func (fakeResolver) ListServices(_ context.Context, namespace string) ([]*k8s.Service, error) {
+	return []*k8s.Service{
+		{Name: "orders", Namespace: namespace, Ports: []string{"5432"}},
+		{Name: "payments", Namespace: namespace, Ports: []string{"8080", "9090"}},
+	}, nil
+}
+
+// GetService returns a service with a http and a grpc port
+func (fakeResolver) GetService(_ context.Context, namespace, serviceName string) (*k8s.Service, error) {
+	return &k8s.Service{
+		Name:       serviceName,
+		Namespace:  namespace,
+		Ports:      []string{"8080", "9090"},
+		NamedPorts: map[string]string{"http": "8080", "grpc": "9090"},
+	}, nil
+}
+
+func (r fakeResolver) GetPodPorts(ctx context.Context, namespace, podName string) (*k8s.Service, error) {
+	return r.GetService(ctx, namespace, podName)
+}
+
+// GetMatchingPodForIP resolves every address to the pod ip-<address>
+func (fakeResolver) GetMatchingPodForIP(_ context.Context, ip, port string) (*k8s.TargetPod, error) {
+	return &k8s.TargetPod{Name: "ip-" + ip, Namespace: "default", Port: port}, nil
+}
+
+// GetSecretValue returns <namespace>/<name>/<key>
+func (fakeResolver) GetSecretValue(_ context.Context, namespace, secretName, key string) (string, error) {
+	return namespace + "/" + secretName + "/" + key, nil
+}
+
+func (r fakeResolver) Ping(_ context.Context) error {
+	return r.pingErr
+}
+
+func (r fakeResolver) WatchServices(_ context.Context, _ string) (<-chan k8s.ServiceEvent, error) {
+	return r.events, nil
+}
+
+// newFakeProxy returns a proxy sending all traffic to h
+func newFakeProxy(t *testing.T, h http.Handler) (*Proxy, *fakeConnection) {
+	con := newFakeConnection(t, h)
+	return newFakeProxyFor(con), con
+}
+
+// newFakeProxyFor returns a proxy sending all traffic through con
+func newFakeProxyFor(con *fakeConnection) *Proxy {
+	p := &Proxy{
+		k8sc:   fakeResolver{},
+		parser: &Parser{ClusterDomain: "cluster.local"},
+		conns: &connPool{dial: func(_ *k8s.TargetPod) (httpstream.Connection, error) {
+			return con, nil
+		}, conns: map[string]httpstream.Connection{}},
+	}
+	p.transport = newTransport(p)
+	return p
+}
@@ -0,0 +1,419 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/go-pkgz/lgr"
+	"github.com/tipok/kubeproxy/k8s"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultForwardHost is the local address targets are bound to if none is given
+const defaultForwardHost = "127.0.0.1"
+
+// ForwardTarget is a service, pod or namespace forwarded to a local address
+type ForwardTarget struct {
+	// Type is svc, pod or ns
+	Type      string
+	Name      string
+	Namespace string
+	// Port of the service or pod, empty for namespaces
+	Port string
+	// Local is the address to listen on, the host only for namespaces
+	Local string
+}
+
+// ParseForwardTarget parses targets like
+//
+//	svc/orders.shop:5432 -> 127.0.0.1:15432
+//	pod/orders-0.shop:5432 -> 15432
+//	svc/orders.shop:5432
+//	ns/shop -> 127.0.0.2
+//
+// The local address defaults to 127.0.0.1 and the port of the target. Namespaces bind all
+// ports of their services on the local address.
+func ParseForwardTarget(s string) (*ForwardTarget, error) {
+	remote, local := s, ""
+	if i := strings.Index(s, "->"); i >= 0 {
+		remote, local = strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+2:])
+	}
+	parts := strings.SplitN(remote, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid target %q, expected svc/, pod/ or ns/", s)
+	}
+	t := &ForwardTarget{Type: parts[0]}
+
+	switch t.Type {
+	case "ns":
+		t.Namespace = parts[1]
+		t.Local = local
+		if t.Local == "" {
+			t.Local = defaultForwardHost
+		}
+		if net.ParseIP(t.Local) == nil {
+			return nil, fmt.Errorf("invalid target %q, namespaces are bound to an IP address", s)
+		}
+		return t, nil
+	case "svc", "pod":
+	default:
+		return nil, fmt.Errorf("invalid target %q, unknown type %s", s, t.Type)
+	}
+
+	host, port, err := net.SplitHostPort(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %q: %w", s, err)
+	}
+	i := strings.LastIndex(host, ".")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid target %q, expected name.namespace", s)
+	}
+	t.Name, t.Namespace, t.Port = host[:i], host[i+1:], port
+
+	switch {
+	case local == "":
+		local = port
+		fallthrough
+	case !strings.Contains(local, ":"):
+		if _, err := strconv.Atoi(local); err != nil {
+			return nil, fmt.Errorf("invalid target %q, local port is required for named ports", s)
+		}
+		local = net.JoinHostPort(defaultForwardHost, local)
+	}
+	if _, _, err := net.SplitHostPort(local); err != nil {
+		return nil, fmt.Errorf("invalid target %q: %w", s, err)
+	}
+	t.Local = local
+	return t, nil
+}
+
+// Forwarder binds local listeners for targets and forwards the accepted connections to the
+// pods. The pod is resolved for every connection, so connections are spread over all pods of
+// a service and follow pods being replaced.
+type Forwarder struct {
+	proxy     *Proxy
+	lock      sync.Mutex
+	listeners []net.Listener
+	closed    bool
+
+	// services and pods bound on their own loopback address
+	services map[string]*forwardedService
+	loopback *loopbackAllocator
+	hosts    *HostsFile
+}
+
+// forwardedService is a service of a watched namespace
+type forwardedService struct {
+	ip         net.IP
+	names      []string
+	ports      []string
+	namedPorts map[string]string
+	listeners  []net.Listener
+}
+
+func (p *Proxy) NewForwarder() *Forwarder {
+	return &Forwarder{proxy: p, services: map[string]*forwardedService{}}
+}
+
+// Start binds the listeners for targets, namespaces are expanded to their services
+func (f *Forwarder) Start(ctx context.Context, targets []*ForwardTarget) error {
+	for _, t := range targets {
+		if t.Type != "ns" {
+			if err := f.listen(t); err != nil {
+				return err
+			}
+			continue
+		}
+
+		services, err := f.proxy.k8sc.ListServices(ctx, t.Namespace)
+		if err != nil {
+			return err
+		}
+		for _, svc := range services {
+			for _, port := range svc.Ports {
+				st := &ForwardTarget{
+					Type:      "svc",
+					Name:      svc.Name,
+					Namespace: svc.Namespace,
+					Port:      port,
+					Local:     net.JoinHostPort(t.Local, port),
+				}
+				// services of a namespace often share ports, the first one wins
+				if err := f.listen(st); err != nil {
+					log.Printf("[ERROR] skipping %s.%s:%s: %v", svc.Name, svc.Namespace, port, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// UseLoopback enables binding services on their own address of the loopback network, the host
+// names of the services are written to hosts unless it is nil
+func (f *Forwarder) UseLoopback(network *net.IPNet, hosts *HostsFile) error {
+	loopback, err := newLoopbackAllocator(network)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.loopback = loopback
+	f.hosts = hosts
+	return nil
+}
+
+// WatchNamespaces binds every service of namespaces on its loopback address, following services
+// appearing and disappearing until ctx is done
+func (f *Forwarder) WatchNamespaces(ctx context.Context, namespaces []string) error {
+	f.lock.Lock()
+	enabled := f.loopback != nil
+	f.lock.Unlock()
+	if !enabled {
+		return fmt.Errorf("loopback addresses are not enabled")
+	}
+
+	for _, ns := range namespaces {
+		events, err := f.proxy.k8sc.WatchServices(ctx, ns)
+		if err != nil {
+			return err
+		}
+		go func() {
+			for ev := range events {
+				f.update(ev)
+			}
+		}()
+	}
+	return nil
+}
+
+func (f *Forwarder) update(ev k8s.ServiceEvent) {
+	key := fmt.Sprintf("%s.%s", ev.Service.Name, ev.Service.Namespace)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return
+	}
+
+	if !ev.Deleted {
+		if _, err := f.bindService(key, "svc", ev.Service); err != nil {
+			log.Printf("[ERROR] could not forward %s: %v", key, err)
+		}
+		return
+	}
+	fs, ok := f.services[key]
+	if !ok {
+		return
+	}
+	closeListeners(fs.listeners)
+	delete(f.services, key)
+	f.loopback.release(key)
+	log.Printf("[INFO] stopped forwarding %s", key)
+	f.writeHosts()
+}
+
+// bindService binds the ports of svc on the loopback address of key, listeners of ports which
+// changed are replaced. The lock must be held.
+func (f *Forwarder) bindService(key, typ string, svc *k8s.Service) (*forwardedService, error) {
+	fs, ok := f.services[key]
+	if ok && strings.Join(fs.ports, ",") == strings.Join(svc.Ports, ",") {
+		fs.namedPorts = svc.NamedPorts
+		return fs, nil
+	}
+
+	if ok {
+		closeListeners(fs.listeners)
+	} else {
+		ip, err := f.loopback.allocate(key)
+		if err != nil {
+			return nil, err
+		}
+		// keys of pods carry their type to not clash with services of the same name
+		name := fmt.Sprintf("%s.%s", svc.Name, svc.Namespace)
+		domain := f.proxy.parser.ClusterDomain
+		fs = &forwardedService{ip: ip, names: []string{
+			fmt.Sprintf("%s.%s.%s", name, typ, domain),
+			fmt.Sprintf("%s.%s", name, typ),
+		}}
+		if typ == "svc" {
+			fs.names = append(fs.names, name)
+		}
+		f.services[key] = fs
+	}
+	fs.ports = svc.Ports
+	fs.namedPorts = svc.NamedPorts
+	fs.listeners = nil
+	for _, port := range fs.ports {
+		t := &ForwardTarget{
+			Type:      typ,
+			Name:      svc.Name,
+			Namespace: svc.Namespace,
+			Port:      port,
+			Local:     net.JoinHostPort(fs.ip.String(), port),
+		}
+		l, err := f.bind(t)
+		if err != nil {
+			log.Printf("[ERROR] skipping %s:%s: %v", key, port, err)
+			continue
+		}
+		fs.listeners = append(fs.listeners, l)
+	}
+	f.writeHosts()
+	return fs, nil
+}
+
+// lookup returns the loopback address and ports of the service or pod h, services of namespaces
+// which are not watched and pods are bound on first use
+func (f *Forwarder) lookup(ctx context.Context, h *Host) (net.IP, map[string]string, error) {
+	key := fmt.Sprintf("%s.%s", h.Name, h.Namespace)
+	if h.Type == "pod" {
+		key = fmt.Sprintf("%s.%s.pod", h.Name, h.Namespace)
+	}
+	f.lock.Lock()
+	fs, ok := f.services[key]
+	if ok {
+		defer f.lock.Unlock()
+		return fs.ip, fs.portMap(), nil
+	}
+	f.lock.Unlock()
+
+	if err := h.checkType(); err != nil {
+		return nil, nil, err
+	}
+	if err := f.proxy.ACL.check(h); err != nil {
+		return nil, nil, err
+	}
+	var svc *k8s.Service
+	var err error
+	switch h.Type {
+	case "svc":
+		svc, err = f.proxy.k8sc.GetService(ctx, h.Namespace, h.Name)
+	case "pod":
+		svc, err = f.proxy.k8sc.GetPodPorts(ctx, h.Namespace, h.Name)
+	default:
+		err = fmt.Errorf("unknown type %s", h.Type)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return nil, nil, fmt.Errorf("forwarder is closed")
+	}
+	if f.loopback == nil {
+		return nil, nil, fmt.Errorf("loopback addresses are not enabled")
+	}
+	fs, err = f.bindService(key, h.Type, svc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fs.ip, fs.portMap(), nil
+}
+
+// portMap maps the port names and numbers to the port numbers
+func (fs *forwardedService) portMap() map[string]string {
+	ports := map[string]string{}
+	for _, p := range fs.ports {
+		ports[p] = p
+	}
+	for name, p := range fs.namedPorts {
+		ports[name] = p
+	}
+	return ports
+}
+
+// writeHosts writes the names of all forwarded services, the lock must be held
+func (f *Forwarder) writeHosts() {
+	if f.hosts == nil {
+		return
+	}
+	entries := map[string][]string{}
+	for _, fs := range f.services {
+		entries[fs.ip.String()] = fs.names
+	}
+	if err := f.hosts.Write(entries); err != nil {
+		log.Printf("[ERROR] could not update hosts file: %v", err)
+	}
+}
+
+func (f *Forwarder) listen(t *ForwardTarget) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return fmt.Errorf("forwarder is closed")
+	}
+	l, err := f.bind(t)
+	if err != nil {
+		return err
+	}
+	f.listeners = append(f.listeners, l)
+	return nil
+}
+
+// bind listens on the local address of t and forwards the accepted connections
+func (f *Forwarder) bind(t *ForwardTarget) (net.Listener, error) {
+	l, err := net.Listen("tcp", t.Local)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen to %s: %w", t.Local, err)
+	}
+	host := net.JoinHostPort(fmt.Sprintf("%s.%s.%s.%s", t.Name, t.Namespace, t.Type, f.proxy.parser.ClusterDomain), t.Port)
+	log.Printf("[INFO] forwarding %s to %s/%s.%s:%s", l.Addr(), t.Type, t.Name, t.Namespace, t.Port)
+	go f.serve(l, host)
+	return l, nil
+}
+
+func (f *Forwarder) serve(l net.Listener, host string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("[ERROR] could not accept connection on %s: %v", l.Addr(), err)
+			}
+			return
+		}
+		go f.forward(conn, host)
+	}
+}
+
+func (f *Forwarder) forward(conn net.Conn, host string) {
+	e := f.proxy.begin(kindForward, conn.RemoteAddr().String(), "", host)
+	defer e.finish()
+	upstream, err := f.proxy.dialTunnel(context.Background(), host, e)
+	if err != nil {
+		log.Printf("[INFO] could not connect to %s: %v", host, err)
+		_ = conn.Close()
+		return
+	}
+	log.Printf("[DEBUG] forwarding %s to %s", conn.RemoteAddr(), host)
+	f.proxy.tunnel(kindForward, conn, upstream, e)
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		if err := l.Close(); err != nil {
+			log.Printf("[DEBUG] could not close listener: %v", err)
+		}
+	}
+}
+
+// Close stops accepting connections and removes the entries from the hosts file, open
+// connections are not affected
+func (f *Forwarder) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+	closeListeners(f.listeners)
+	f.listeners = nil
+	for _, fs := range f.services {
+		closeListeners(fs.listeners)
+	}
+	f.services = map[string]*forwardedService{}
+	if f.hosts != nil {
+		return f.hosts.Clean()
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package http
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseForwardTarget(t *testing.T) {
+	tests := []struct {
+		target   string
+		expected *ForwardTarget
+	}{
+		{"svc/orders.shop:5432 -> 127.0.0.1:15432", &ForwardTarget{Type: "svc", Name: "orders", Namespace: "shop", Port: "5432", Local: "127.0.0.1:15432"}},
+		{"svc/orders.shop:5432->15432", &ForwardTarget{Type: "svc", Name: "orders", Namespace: "shop", Port: "5432", Local: "127.0.0.1:15432"}},
+		{"svc/orders.shop:5432", &ForwardTarget{Type: "svc", Name: "orders", Namespace: "shop", Port: "5432", Local: "127.0.0.1:5432"}},
+		{"pod/orders-0.shop:http -> localhost:8080", &ForwardTarget{Type: "pod", Name: "orders-0", Namespace: "shop", Port: "http", Local: "localhost:8080"}},
+		{"ns/shop -> 127.0.0.2", &ForwardTarget{Type: "ns", Namespace: "shop", Local: "127.0.0.2"}},
+		{"ns/shop", &ForwardTarget{Type: "ns", Namespace: "shop", Local: "127.0.0.1"}},
+		{"svc/orders.shop:postgres", nil},
+		{"svc/orders:5432", nil},
+		{"deployment/orders.shop:5432", nil},
+		{"ns/shop -> localhost:80", nil},
+		{"orders.shop:5432", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			target, err := ParseForwardTarget(tt.target)
+			if tt.expected == nil {
+				if err == nil {
+					t.Errorf("expected error, got %+v", target)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not parse target: %v", err)
+			}
+			if !reflect.DeepEqual(target, tt.expected) {
+				t.Errorf("expected %+v, got %+v", tt.expected, target)
+			}
+		})
+	}
+}
+
+func TestForwarder(t *testing.T) {
+	p, con := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("orders"))
+	}))
+	f := p.NewForwarder()
+	defer f.Close()
+
+	target, _ := ParseForwardTarget("svc/orders.shop:5432 -> 127.0.0.1:0")
+	if err := f.Start(context.Background(), []*ForwardTarget{target}); err != nil {
+		t.Fatalf("could not start forwarder: %v", err)
+	}
+	addr := f.listeners[0].Addr().String()
+
+	// every connection gets its own stream to a freshly resolved pod
+	for i := 0; i < 2; i++ {
+		tr := &http.Transport{DisableKeepAlives: true}
+		resp, err := (&http.Client{Transport: tr}).Get("http://" + addr + "/")
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "orders" {
+			t.Errorf("unexpected body %q", body)
+		}
+	}
+	if n := atomic.LoadInt32(&con.dataStreams); n != 2 {
+		t.Errorf("expected 2 streams, got %d", n)
+	}
+}
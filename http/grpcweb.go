@@ -0,0 +1,179 @@
+package http
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// grpc-web, see https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-WEB.md
+const (
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+	grpcContentType        = "application/grpc"
+	// grpcWebTrailerFlag marks the frame carrying the trailers at the end of the body
+	grpcWebTrailerFlag = 0x80
+)
+
+func isGRPCWebRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), grpcWebContentType)
+}
+
+func isGRPCWebText(contentType string) bool {
+	return strings.HasPrefix(contentType, grpcWebTextContentType)
+}
+
+// isGRPCWebPreflight reports whether r is a CORS preflight request of a browser grpc-web client
+func isGRPCWebPreflight(r *http.Request) bool {
+	if r.Method != http.MethodOptions || r.Header.Get("Origin") == "" {
+		return false
+	}
+	for _, h := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		if strings.EqualFold(strings.TrimSpace(h), "x-grpc-web") {
+			return true
+		}
+	}
+	return false
+}
+
+func grpcWebPreflightResponse(r *http.Request) *http.Response {
+	resp := &http.Response{
+		StatusCode: http.StatusNoContent,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		Request:    r,
+	}
+	resp.Header.Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+	resp.Header.Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	resp.Header.Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+	resp.Header.Set("Access-Control-Max-Age", "600")
+	return resp
+}
+
+// newGRPCWebRequest translates a grpc-web request into a gRPC request
+func newGRPCWebRequest(r *http.Request) *http.Request {
+	out := r.Clone(r.Context())
+	contentType := r.Header.Get("Content-Type")
+	subtype := strings.TrimPrefix(strings.TrimPrefix(contentType, grpcWebTextContentType), grpcWebContentType)
+	out.Header.Set("Content-Type", grpcContentType+subtype)
+	out.Header.Set("Te", "trailers")
+	out.Header.Del("X-Grpc-Web")
+	if isGRPCWebText(contentType) {
+		out.Body = struct {
+			io.Reader
+			io.Closer
+		}{base64.NewDecoder(base64.StdEncoding, r.Body), r.Body}
+		out.ContentLength = -1
+		out.Header.Del("Content-Length")
+	}
+	return out
+}
+
+// newGRPCWebResponse translates the gRPC response for the grpc-web request r, trailers are
+// appended to the body
+func newGRPCWebResponse(r *http.Request, resp *http.Response) *http.Response {
+	contentType := r.Header.Get("Content-Type")
+	out := *resp
+	out.Header = resp.Header.Clone()
+	out.Header.Del("Content-Length")
+	out.Header.Del("Trailer")
+	out.ContentLength = -1
+	out.Trailer = nil
+	if isGRPC(resp.Header) {
+		subtype := strings.TrimPrefix(resp.Header.Get("Content-Type"), grpcContentType)
+		if isGRPCWebText(contentType) {
+			out.Header.Set("Content-Type", grpcWebTextContentType+subtype)
+		} else {
+			out.Header.Set("Content-Type", grpcWebContentType+subtype)
+		}
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		out.Header.Set("Access-Control-Allow-Origin", origin)
+		out.Header.Set("Access-Control-Expose-Headers", "grpc-status, grpc-message, grpc-status-details-bin")
+	}
+	out.Body = &grpcWebBody{resp: resp, text: isGRPCWebText(contentType)}
+	return &out
+}
+
+// grpcWebBody is the body of a gRPC response with a trailer frame at the end
+type grpcWebBody struct {
+	resp    *http.Response
+	text    bool
+	trailer io.Reader
+	buf     []byte
+}
+
+func (b *grpcWebBody) Read(p []byte) (int, error) {
+	if b.text {
+		return b.readText(p)
+	}
+	return b.read(p)
+}
+
+func (b *grpcWebBody) read(p []byte) (int, error) {
+	if b.trailer != nil {
+		return b.trailer.Read(p)
+	}
+	n, err := b.resp.Body.Read(p)
+	if err == io.EOF {
+		// trailers are complete once the body is drained
+		b.trailer = bytes.NewReader(grpcWebTrailerFrame(b.resp.Trailer))
+		if n > 0 {
+			return n, nil
+		}
+		return b.trailer.Read(p)
+	}
+	return n, err
+}
+
+// readText encodes every chunk read from the pod on its own, grpc-web-text clients decode
+// padded chunks separately
+func (b *grpcWebBody) readText(p []byte) (int, error) {
+	if len(b.buf) == 0 {
+		raw := make([]byte, base64.StdEncoding.DecodedLen(len(p)))
+		if len(raw) == 0 {
+			return 0, fmt.Errorf("buffer too small")
+		}
+		n, err := b.read(raw)
+		if n > 0 {
+			b.buf = make([]byte, base64.StdEncoding.EncodedLen(n))
+			base64.StdEncoding.Encode(b.buf, raw[:n])
+		}
+		if len(b.buf) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+func (b *grpcWebBody) Close() error {
+	return b.resp.Body.Close()
+}
+
+func grpcWebTrailerFrame(trailer http.Header) []byte {
+	keys := make([]string, 0, len(trailer))
+	for k := range trailer {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var payload bytes.Buffer
+	for _, k := range keys {
+		for _, v := range trailer[k] {
+			payload.WriteString(fmt.Sprintf("%s: %s\r\n", strings.ToLower(k), v))
+		}
+	}
+	frame := make([]byte, 5, 5+payload.Len())
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(payload.Len()))
+	return append(frame, payload.Bytes()...)
+}
@@ -0,0 +1,203 @@
+package http
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newGRPCPod(t *testing.T) http.Handler {
+	return h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("unexpected protocol: %s", r.Proto)
+		}
+		if r.Header.Get("Content-Type") != "application/grpc+proto" {
+			t.Errorf("unexpected content type: %s", r.Header.Get("Content-Type"))
+		}
+		if r.Header.Get("Te") != "trailers" {
+			t.Errorf("unexpected te: %s", r.Header.Get("Te"))
+		}
+		msg, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		_, _ = w.Write(msg)
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+	}), &http2.Server{})
+}
+
+func TestGRPCPriorKnowledge(t *testing.T) {
+	p, _ := newFakeProxy(t, newGRPCPod(t))
+	front := httptest.NewServer(p.Handler(http.NotFoundHandler()))
+	defer front.Close()
+
+	tr := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, _ string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, strings.TrimPrefix(front.URL, "http://"))
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	msg := []byte{0, 0, 0, 0, 2, 8, 1}
+	req, err := http.NewRequest(http.MethodPost, "http://greeter.shop.svc.cluster.local:50051/shop.Greeter/Hello", bytes.NewReader(msg))
+	if err != nil {
+		t.Fatalf("could not create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("Te", "trailers")
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("could not read body: %v", err)
+	}
+	if !bytes.Equal(body, msg) {
+		t.Errorf("unexpected body: %v", body)
+	}
+	if resp.Trailer.Get("Grpc-Status") != "0" || resp.Trailer.Get("Grpc-Message") != "ok" {
+		t.Errorf("unexpected trailers: %v", resp.Trailer)
+	}
+}
+
+func TestGRPCOverTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		t.Fatalf("could not create CA: %v", err)
+	}
+	roots := x509.NewCertPool()
+	x509ca, _ := x509.ParseCertificate(ca.Certificate[0])
+	roots.AddCert(x509ca)
+	certs, err := newCertStore(ca)
+	if err != nil {
+		t.Fatalf("could not create cert store: %v", err)
+	}
+	podCert, err := certs.get("greeter.shop.svc.cluster.local")
+	if err != nil {
+		t.Fatalf("could not create pod certificate: %v", err)
+	}
+	grpc := newGRPCPod(t)
+	con := newFakeTLSConnection(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			t.Errorf("expected gRPC over TLS, got plain text")
+		}
+		grpc.ServeHTTP(w, r)
+	}), &tls.Config{Certificates: []tls.Certificate{*podCert}, NextProtos: []string{http2.NextProtoTLS, "http/1.1"}})
+	p := newFakeProxyFor(con)
+	p.UpstreamTLS = &tls.Config{RootCAs: roots}
+
+	// e.g. an intercepted grpc-web request translated to gRPC
+	msg := []byte{0, 0, 0, 0, 2, 8, 1}
+	req, err := http.NewRequest(http.MethodPost, "https://greeter.shop.svc.cluster.local/shop.Greeter/Hello", bytes.NewReader(msg))
+	if err != nil {
+		t.Fatalf("could not create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("Te", "trailers")
+	resp, err := p.transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !bytes.Equal(body, msg) || resp.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("unexpected response %v, trailers %v", body, resp.Trailer)
+	}
+}
+
+func TestGRPCWeb(t *testing.T) {
+	p, _ := newFakeProxy(t, newGRPCPod(t))
+	p.GRPCWeb = true
+	client := newTestClient(t, p)
+	msg := []byte{0, 0, 0, 0, 2, 8, 1}
+	trailer := "\x80\x00\x00\x00\x22grpc-message: ok\r\ngrpc-status: 0\r\n"
+
+	t.Run("binary", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, "http://greeter.shop.svc.cluster.local:50051/shop.Greeter/Hello", bytes.NewReader(msg))
+		if err != nil {
+			t.Fatalf("could not create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/grpc-web+proto")
+		req.Header.Set("Origin", "http://localhost:8080")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != string(msg)+trailer {
+			t.Errorf("unexpected body: %q", body)
+		}
+		if resp.Header.Get("Content-Type") != "application/grpc-web+proto" {
+			t.Errorf("unexpected content type: %s", resp.Header.Get("Content-Type"))
+		}
+		if resp.Header.Get("Access-Control-Allow-Origin") != "http://localhost:8080" {
+			t.Errorf("unexpected allowed origin: %s", resp.Header.Get("Access-Control-Allow-Origin"))
+		}
+	})
+
+	t.Run("text", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, "http://greeter.shop.svc.cluster.local:50051/shop.Greeter/Hello", strings.NewReader(base64.StdEncoding.EncodeToString(msg)))
+		if err != nil {
+			t.Fatalf("could not create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/grpc-web-text+proto")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		// every chunk is padded on its own, so decode each quantum separately
+		encoded := readAll(t, resp.Body)
+		var body []byte
+		for i := 0; i+4 <= len(encoded); i += 4 {
+			decoded, err := base64.StdEncoding.DecodeString(encoded[i : i+4])
+			if err != nil {
+				t.Fatalf("could not decode %q: %v", encoded, err)
+			}
+			body = append(body, decoded...)
+		}
+		if string(body) != string(msg)+trailer {
+			t.Errorf("unexpected body: %q", body)
+		}
+	})
+
+	t.Run("preflight", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodOptions, "http://greeter.shop.svc.cluster.local:50051/shop.Greeter/Hello", nil)
+		if err != nil {
+			t.Fatalf("could not create request: %v", err)
+		}
+		req.Header.Set("Origin", "http://localhost:8080")
+		req.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("unexpected status: %d", resp.StatusCode)
+		}
+	})
+}
+
+func readAll(t *testing.T, r io.Reader) string {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("could not read: %v", err)
+	}
+	return string(b)
+}
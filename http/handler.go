@@ -0,0 +1,205 @@
+package http
+
+import (
+	"fmt"
+	log "github.com/go-pkgz/lgr"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// streamBufferSize is the size of the chunks responses are copied to the client with
+const streamBufferSize = 32 * 1024
+
+type handler struct {
+	proxy *Proxy
+	next  http.Handler
+}
+
+// Handler returns a http.Handler serving plain HTTP requests to cluster hosts, responses are
+// streamed to the client as they arrive. The PAC file is served at /proxy.pac without
+// authentication, if Users is set all other requests have to be authenticated. Requests to
+// other hosts and CONNECT requests are passed to next.
+// Clients may speak HTTP/2 without TLS (h2c) with prior knowledge or by upgrading, HTTP/2
+// requests are sent to cluster hosts by their :authority, e.g. for gRPC.
+func (p *Proxy) Handler(next http.Handler) http.Handler {
+	return h2c.NewHandler(&handler{proxy: p, next: next}, &http2.Server{})
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	proxied := r.URL.IsAbs() || r.ProtoMajor == 2
+	if !proxied && r.Method == http.MethodGet && r.URL.Path == pacPath {
+		h.proxy.servePAC(w, r)
+		return
+	}
+	if h.proxy.Users != nil && !h.proxy.Users.authenticate(w, r) {
+		return
+	}
+	if r.Method == http.MethodConnect || !proxied || !h.proxy.isClusterHost(r.Host) {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	_, resp, e := h.proxy.doRequest(r)
+	defer func() {
+		// closing the body before it is drained closes the stream to the pod
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("[DEBUG] could not close response body: %v", err)
+		}
+	}()
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		h.proxy.switchProtocols(w, r, resp, e)
+		return
+	}
+
+	copyHeader(w.Header(), resp.Header)
+	announced := announceTrailers(w.Header(), resp.Trailer)
+	w.WriteHeader(resp.StatusCode)
+	if err := copyResponse(w, resp); err != nil {
+		log.Printf("[DEBUG] could not copy response to %s: %v", r.RemoteAddr, err)
+		return
+	}
+	copyTrailers(w.Header(), resp.Trailer, announced)
+}
+
+// bufferedConn is a net.Conn with data already read into a buffer
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// switchProtocols relays the 101 response of an Upgrade request, e.g. for websockets, and
+// tunnels the connection of the client to the pod afterwards. The entry of the request is
+// finished when the tunnel is closed.
+func (p *Proxy) switchProtocols(w http.ResponseWriter, r *http.Request, resp *http.Response, e *accessEntry) {
+	defer e.finish()
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		log.Printf("[ERROR] upgraded response of %s is not writable", r.Host)
+		e.setStatus(http.StatusBadGateway)
+		e.fail(errorUpstream)
+		http.Error(w, "Cannot reach destination", http.StatusBadGateway)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		log.Printf("[ERROR] could not switch protocols for %s over %s", r.Host, r.Proto)
+		e.setStatus(http.StatusBadGateway)
+		e.fail(errorUpstream)
+		http.Error(w, "Cannot switch protocols", http.StatusBadGateway)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("[ERROR] could not hijack connection: %v", err)
+		return
+	}
+
+	_, err = fmt.Fprintf(brw, "HTTP/1.1 %s\r\n", resp.Status)
+	if err == nil {
+		err = resp.Header.Write(brw)
+	}
+	if err == nil {
+		_, err = brw.WriteString("\r\n")
+	}
+	if err == nil {
+		err = brw.Flush()
+	}
+	if err != nil {
+		log.Printf("[ERROR] could not write to client: %v", err)
+		_ = conn.Close()
+		_ = upstream.Close()
+		return
+	}
+
+	var client net.Conn = conn
+	if brw.Reader.Buffered() > 0 {
+		client = &bufferedConn{Conn: conn, r: io.MultiReader(brw.Reader, conn)}
+	}
+	p.tunnel(kindHTTP, client, upstream, e)
+}
+
+func (p *Proxy) isClusterHost(host string) bool {
+	h, err := p.parser.ParseHost(host, false)
+	return err == nil && h.K8s
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// announceTrailers declares the trailers known before the body is sent
+func announceTrailers(h http.Header, trailer http.Header) int {
+	keys := make([]string, 0, len(trailer))
+	for k := range trailer {
+		keys = append(keys, k)
+	}
+	if len(keys) > 0 {
+		h.Set("Trailer", strings.Join(keys, ", "))
+	}
+	return len(keys)
+}
+
+// copyTrailers sends the trailers received after the body, trailers which were not announced
+// are sent with http.TrailerPrefix. gRPC servers usually don't announce grpc-status.
+func copyTrailers(h http.Header, trailer http.Header, announced int) {
+	if len(trailer) == announced {
+		copyHeader(h, trailer)
+		return
+	}
+	for k, vv := range trailer {
+		for _, v := range vv {
+			h.Add(http.TrailerPrefix+k, v)
+		}
+	}
+}
+
+// isStreaming reports whether resp should be sent to the client without buffering
+func isStreaming(resp *http.Response) bool {
+	if resp.ContentLength == -1 || isGRPC(resp.Header) {
+		return true
+	}
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+}
+
+// copyResponse copies the response body to w. Streaming responses like server-sent events,
+// long polling or chunked downloads are flushed after every read, so the client sees data as
+// soon as the pod sends it.
+func copyResponse(w http.ResponseWriter, resp *http.Response) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok || !isStreaming(resp) {
+		_, err := io.Copy(w, resp.Body)
+		return err
+	}
+
+	// send the headers right away, the first chunk might take a while
+	flusher.Flush()
+	buf := make([]byte, streamBufferSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			flusher.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
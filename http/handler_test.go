@@ -0,0 +1,219 @@
+package http
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, p *Proxy) *http.Client {
+	front := httptest.NewServer(p.Handler(http.NotFoundHandler()))
+	t.Cleanup(front.Close)
+	proxyURL, err := url.Parse(front.URL)
+	if err != nil {
+		t.Fatalf("could not parse proxy url: %v", err)
+	}
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL), ExpectContinueTimeout: 5 * time.Second}
+	t.Cleanup(tr.CloseIdleConnections)
+	return &http.Client{Transport: tr}
+}
+
+func TestHandler(t *testing.T) {
+	t.Run("server-sent events", testHandlerStreaming)
+	t.Run("client disconnect", testHandlerClientDisconnect)
+	t.Run("chunked upload with expect continue", testHandlerChunkedUpload)
+}
+
+func testHandlerStreaming(t *testing.T) {
+	release := make(chan struct{})
+	p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: 1\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = io.WriteString(w, "data: 2\n\n")
+	}))
+	client := newTestClient(t, p)
+
+	resp, err := client.Get("http://events.shop.svc.cluster.local/")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("could not read first event: %v", err)
+	}
+	if line != "data: 1\n" {
+		t.Errorf("unexpected first event: %q", line)
+	}
+	close(release)
+	rest, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("could not read remaining events: %v", err)
+	}
+	if string(rest) != "\ndata: 2\n\n" {
+		t.Errorf("unexpected remaining events: %q", rest)
+	}
+}
+
+func testHandlerClientDisconnect(t *testing.T) {
+	gone := make(chan struct{})
+	p, con := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "first chunk")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(gone)
+	}))
+	client := newTestClient(t, p)
+
+	resp, err := client.Get("http://download.shop.svc.cluster.local/")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	buf := make([]byte, len("first chunk"))
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatalf("could not read first chunk: %v", err)
+	}
+	_ = resp.Body.Close()
+	client.CloseIdleConnections()
+
+	select {
+	case <-gone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("pod did not notice the client going away")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&con.open) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("streams still open: %d", atomic.LoadInt32(&con.open))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testHandlerChunkedUpload(t *testing.T) {
+	p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TransferEncoding) == 0 || r.TransferEncoding[0] != "chunked" {
+			t.Errorf("unexpected transfer encoding: %v", r.TransferEncoding)
+		}
+		_, _ = io.Copy(w, r.Body)
+	}))
+	client := newTestClient(t, p)
+
+	var got100 int32
+	trace := &httptrace.ClientTrace{Got100Continue: func() { atomic.StoreInt32(&got100, 1) }}
+	body := io.MultiReader(strings.NewReader("hello "), strings.NewReader("world"))
+	req, err := http.NewRequest(http.MethodPut, "http://upload.shop.svc.cluster.local/", ioutil.NopCloser(body))
+	if err != nil {
+		t.Fatalf("could not create request: %v", err)
+	}
+	req.Header.Set("Expect", "100-continue")
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	echo, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("could not read response: %v", err)
+	}
+	if string(echo) != "hello world" {
+		t.Errorf("unexpected response: %q", echo)
+	}
+	if atomic.LoadInt32(&got100) != 1 {
+		t.Errorf("expected 100 continue")
+	}
+}
+
+func TestHandlerUpgrade(t *testing.T) {
+	t.Run("plain", func(t *testing.T) { testHandlerUpgrade(t, Timeouts{}) })
+	// the upgraded connection is written to through the body of the response
+	t.Run("response header timeout", func(t *testing.T) { testHandlerUpgrade(t, Timeouts{ResponseHeader: 5 * time.Second}) })
+}
+
+func testHandlerUpgrade(t *testing.T, timeouts Timeouts) {
+	p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			t.Errorf("unexpected upgrade: %s", r.Header.Get("Upgrade"))
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("could not hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		_ = brw.Flush()
+		// echo everything
+		_, _ = io.Copy(conn, brw)
+	}))
+	var err error
+	if p.Timeouts, err = NewTimeoutPolicy(timeouts, nil); err != nil {
+		t.Fatalf("could not create timeout policy: %v", err)
+	}
+	lines := make(lineWriter, 1)
+	p.AccessLog, _ = NewAccessLog(lines, AccessLogLogfmt)
+	front := httptest.NewServer(p.Handler(http.NotFoundHandler()))
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(front.URL, "http://"))
+	if err != nil {
+		t.Fatalf("could not dial proxy: %v", err)
+	}
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET http://dashboard.shop.svc.cluster.local/ws HTTP/1.1\r\n"+
+		"Host: dashboard.shop.svc.cluster.local\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	if err != nil {
+		t.Fatalf("could not write request: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("could not read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "websocket" {
+		t.Fatalf("unexpected response: %s %v", resp.Status, resp.Header)
+	}
+
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatalf("could not write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		t.Fatalf("could not read: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("unexpected echo: %q", buf)
+	}
+
+	// upgraded connections are tunnels listed and closed through the admin API
+	connections := p.Connections()
+	if len(connections) != 1 || connections[0].BytesIn != 4 || connections[0].BytesOut != 4 {
+		t.Fatalf("unexpected connections: %+v", connections)
+	}
+	if _, err := p.CloseConnection(connections[0].ID); err != nil {
+		t.Fatalf("could not close connection: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("expected closed connection, got %v", err)
+	}
+	if line := lines.next(t); !strings.Contains(line, "status=101") || !strings.Contains(line, "bytes_out=4") {
+		t.Errorf("unexpected entry %s", line)
+	}
+}
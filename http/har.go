@@ -0,0 +1,378 @@
+package http
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/go-pkgz/lgr"
+	"github.com/tipok/kubeproxy/k8s"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// harRedacted replaces the values of redacted headers
+const harRedacted = "REDACTED"
+
+// DefaultRedactHeaders are the headers redacted in captures unless configured otherwise
+var DefaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// Errors of StartCapture and StopCapture
+var (
+	ErrCapturing    = errors.New("already capturing")
+	ErrNotCapturing = errors.New("not capturing")
+)
+
+// CaptureOptions configure a capture
+type CaptureOptions struct {
+	// MaxBodySize limits the bytes of each request and response body stored, larger bodies are
+	// truncated
+	MaxBodySize int64
+	// RedactHeaders are stored with the value REDACTED
+	RedactHeaders []string
+}
+
+// Capture collects the requests to cluster hosts and their responses, they are written to a HAR
+// 1.2 file when the capture is stopped
+type Capture struct {
+	path string
+	opts CaptureOptions
+
+	lock    sync.Mutex
+	entries []*harEntry
+}
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string      `json:"version"`
+	Creator harCreator  `json:"creator"`
+	Entries []*harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// harEntry is a HAR entry with the resolved pod as custom fields
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Namespace       string      `json:"_namespace"`
+	Pod             string      `json:"_pod"`
+	Port            string      `json:"_port"`
+	Error           string      `json:"_error,omitempty"`
+
+	// the bodies are encoded when the capture is written
+	requestBody  []byte
+	responseBody []byte
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType  string `json:"mimeType"`
+	Text      string `json:"text"`
+	Encoding  string `json:"_encoding,omitempty"`
+	Truncated bool   `json:"_truncated,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size      int64  `json:"size"`
+	MimeType  string `json:"mimeType"`
+	Text      string `json:"text,omitempty"`
+	Encoding  string `json:"encoding,omitempty"`
+	Truncated bool   `json:"_truncated,omitempty"`
+}
+
+// harTimings in milliseconds, blocked is the time it took to find the pod. Sending the request
+// and waiting for the response can't be told apart and are both reported as wait.
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// StartCapture starts capturing requests to cluster hosts to the HAR file at path
+func (p *Proxy) StartCapture(path string, opts CaptureOptions) error {
+	p.captureLock.Lock()
+	defer p.captureLock.Unlock()
+	if p.capture != nil {
+		return fmt.Errorf("%w to %s", ErrCapturing, p.capture.path)
+	}
+	// fail early if the file can't be written
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("could not create capture file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("could not create capture file: %w", err)
+	}
+	p.capture = &Capture{path: path, opts: opts}
+	log.Printf("[INFO] capturing requests to %s", path)
+	return nil
+}
+
+// StopCapture stops capturing and writes the HAR file, it returns the path of the file and the
+// number of entries
+func (p *Proxy) StopCapture() (string, int, error) {
+	p.captureLock.Lock()
+	c := p.capture
+	p.capture = nil
+	p.captureLock.Unlock()
+	if c == nil {
+		return "", 0, ErrNotCapturing
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, e := range c.entries {
+		if e.Request.PostData != nil {
+			e.Request.PostData.Text, e.Request.PostData.Encoding = encodeBody(e.requestBody)
+		}
+		e.Response.Content.Text, e.Response.Content.Encoding = encodeBody(e.responseBody)
+	}
+	b, err := json.MarshalIndent(&harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "kubeproxy"},
+		Entries: append([]*harEntry{}, c.entries...),
+	}}, "", "  ")
+	if err != nil {
+		return "", 0, fmt.Errorf("could not encode capture: %w", err)
+	}
+	if err := os.WriteFile(c.path, b, 0600); err != nil {
+		return "", 0, fmt.Errorf("could not write capture file: %w", err)
+	}
+	log.Printf("[INFO] wrote %d captured requests to %s", len(c.entries), c.path)
+	return c.path, len(c.entries), nil
+}
+
+func (p *Proxy) activeCapture() *Capture {
+	p.captureLock.Lock()
+	defer p.captureLock.Unlock()
+	return p.capture
+}
+
+// harRecorder fills the entry of one request
+type harRecorder struct {
+	capture *Capture
+	entry   *harEntry
+	start   time.Time
+	sent    time.Time
+}
+
+// begin adds the entry for the request r with header to the pod tp, the headers in redact are
+// redacted as well. start is when the request was received and resolved when the pod was found.
+func (c *Capture) begin(r *http.Request, header http.Header, redact []string, tp *k8s.TargetPod, start, resolved time.Time) *harRecorder {
+	if c == nil {
+		return nil
+	}
+	u := *r.URL
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	e := &harEntry{
+		StartedDateTime: start,
+		Request: harRequest{
+			Method:      r.Method,
+			URL:         u.String(),
+			HTTPVersion: r.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     c.headers(header, redact),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    0,
+		},
+		Timings:   harTimings{Blocked: ms(resolved.Sub(start)), DNS: -1, Connect: -1, SSL: -1},
+		Namespace: tp.Namespace,
+		Pod:       tp.Name,
+		Port:      tp.Port,
+	}
+	for name, values := range r.URL.Query() {
+		for _, v := range values {
+			e.Request.QueryString = append(e.Request.QueryString, harNameValue{Name: name, Value: v})
+		}
+	}
+	c.lock.Lock()
+	c.entries = append(c.entries, e)
+	c.lock.Unlock()
+	return &harRecorder{capture: c, entry: e, start: start, sent: resolved}
+}
+
+func (c *Capture) headers(h http.Header, redact []string) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range h {
+		redacted := false
+		for _, names := range [][]string{c.opts.RedactHeaders, redact} {
+			for _, r := range names {
+				redacted = redacted || strings.EqualFold(r, name)
+			}
+		}
+		for _, v := range values {
+			if redacted {
+				v = harRedacted
+			}
+			headers = append(headers, harNameValue{Name: name, Value: v})
+		}
+	}
+	return headers
+}
+
+// requestBody records the body of r as it is read
+func (rec *harRecorder) requestBody(r *http.Request) {
+	if rec == nil || r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	data := &harPostData{MimeType: r.Header.Get("Content-Type")}
+	rec.capture.lock.Lock()
+	rec.entry.Request.PostData = data
+	rec.capture.lock.Unlock()
+	e := rec.entry
+	r.Body = &capturedBody{ReadCloser: r.Body, read: func(b []byte) {
+		rec.capture.lock.Lock()
+		defer rec.capture.lock.Unlock()
+		e.Request.BodySize += int64(len(b))
+		e.requestBody, data.Truncated = appendLimited(e.requestBody, b, rec.capture.opts.MaxBodySize)
+	}}
+}
+
+// response records resp, or err if the request failed, with the headers in redact redacted. The
+// body of resp is recorded as it is read, the entry is complete when it is closed.
+func (rec *harRecorder) response(resp *http.Response, err error, redact []string) {
+	if rec == nil {
+		return
+	}
+	c := rec.capture
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e := rec.entry
+	e.Timings.Wait = ms(now.Sub(rec.sent))
+	e.Time = ms(now.Sub(rec.start))
+	if err != nil {
+		e.Error = err.Error()
+		e.Response = harResponse{Cookies: []harNameValue{}, Headers: []harNameValue{}, HeadersSize: -1, BodySize: -1}
+		return
+	}
+	e.Response = harResponse{
+		Status:      resp.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(resp.Status, fmt.Sprint(resp.StatusCode))),
+		HTTPVersion: resp.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     c.headers(resp.Header, redact),
+		Content:     harContent{MimeType: resp.Header.Get("Content-Type")},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+	}
+	// upgraded connections are tunnels, their body is not a response
+	if resp.StatusCode == http.StatusSwitchingProtocols || resp.Body == nil {
+		return
+	}
+	resp.Body = &capturedBody{ReadCloser: resp.Body, read: func(b []byte) {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		e.Response.BodySize += int64(len(b))
+		e.Response.Content.Size = e.Response.BodySize
+		e.responseBody, e.Response.Content.Truncated = appendLimited(e.responseBody, b, c.opts.MaxBodySize)
+	}, close: func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		e.Timings.Receive = ms(time.Since(now))
+		e.Time = ms(time.Since(rec.start))
+	}}
+}
+
+// capturedBody passes everything read to read, calls eof when the end is reached and close
+// once when it is closed
+type capturedBody struct {
+	io.ReadCloser
+	read  func([]byte)
+	eof   func()
+	close func()
+	once  sync.Once
+}
+
+func (b *capturedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.read != nil {
+		b.read(p[:n])
+	}
+	if err == io.EOF && b.eof != nil {
+		b.eof()
+	}
+	return n, err
+}
+
+func (b *capturedBody) Close() error {
+	if b.close != nil {
+		b.once.Do(b.close)
+	}
+	return b.ReadCloser.Close()
+}
+
+// appendLimited appends b to buf up to limit bytes, it reports whether b was truncated. There
+// is no limit if limit is 0.
+func appendLimited(buf, b []byte, limit int64) ([]byte, bool) {
+	if limit <= 0 || int64(len(buf)+len(b)) <= limit {
+		return append(buf, b...), false
+	}
+	return append(buf, b[:limit-int64(len(buf))]...), true
+}
+
+// encodeBody returns the body as text, base64 encoded if it is not valid UTF-8
+func encodeBody(b []byte) (string, string) {
+	if len(b) == 0 || utf8.Valid(b) {
+		return string(b), ""
+	}
+	return base64.StdEncoding.EncodeToString(b), "base64"
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,123 @@
+package http
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCapture(t *testing.T) {
+	p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Set-Cookie", "session=secret")
+		_, _ = w.Write([]byte("pod:" + string(body)))
+	}))
+	// injected credentials must not end up in captures meant to be shared
+	var err error
+	p.Headers, err = NewHeaderRewriter([]HeaderRule{{
+		Request:  []HeaderRewrite{{Action: HeaderSet, Name: "X-Api-Key", Value: "injected-secret"}},
+		Response: []HeaderRewrite{{Action: HeaderSet, Name: "X-Session", Value: "injected-secret"}},
+	}})
+	if err != nil {
+		t.Fatalf("invalid rules: %v", err)
+	}
+	admin := p.NewAdmin()
+	admin.CaptureOptions = CaptureOptions{MaxBodySize: 8, RedactHeaders: DefaultRedactHeaders}
+	admin.CaptureDir = t.TempDir()
+	adminSrv := httptest.NewServer(admin)
+	defer adminSrv.Close()
+	client := newTestClient(t, p)
+	file := filepath.Join(admin.CaptureDir, "capture.har")
+
+	post := func(path, body string) *http.Response {
+		resp, err := http.Post(adminSrv.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := post("/capture/stop", ""); resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected 409 when not capturing, got %d", resp.StatusCode)
+	}
+	for _, name := range []string{file, "../capture.har", ".."} {
+		if resp := post("/capture/start", `{"file": "`+name+`"}`); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected %s outside of the capture directory to be refused, got %d", name, resp.StatusCode)
+		}
+	}
+	if resp := post("/capture/start", `{"file": "capture.har"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("could not start capture: %d", resp.StatusCode)
+	}
+	if resp := post("/capture/start", `{"file": "capture.har"}`); resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected 409 when already capturing, got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://orders.shop.svc.cluster.local/orders?limit=10",
+		strings.NewReader("a long request body"))
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	got, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(got) != "pod:a long request body" {
+		t.Errorf("capture changed the response: %q", got)
+	}
+
+	stop, err := http.Post(adminSrv.URL+"/capture/stop", "application/json", nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	var stopped CaptureResponse
+	_ = json.NewDecoder(stop.Body).Decode(&stopped)
+	stop.Body.Close()
+	if stopped.File != file || stopped.Entries != 1 {
+		t.Errorf("unexpected response %+v", stopped)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("could not read capture: %v", err)
+	}
+	if strings.Contains(string(b), "injected-secret") {
+		t.Errorf("rewritten headers were captured: %s", b)
+	}
+	var har harFile
+	if err := json.Unmarshal(b, &har); err != nil {
+		t.Fatalf("invalid capture: %v", err)
+	}
+	if har.Log.Version != "1.2" || len(har.Log.Entries) != 1 {
+		t.Fatalf("unexpected capture %s", b)
+	}
+	e := har.Log.Entries[0]
+	if e.Namespace != "shop" || e.Pod != "orders-0" || e.Port != "80" {
+		t.Errorf("unexpected pod %s/%s:%s", e.Namespace, e.Pod, e.Port)
+	}
+	if e.Request.Method != http.MethodPost || e.Request.URL != "http://orders.shop.svc.cluster.local/orders?limit=10" {
+		t.Errorf("unexpected request %s %s", e.Request.Method, e.Request.URL)
+	}
+	if len(e.Request.QueryString) != 1 || e.Request.QueryString[0] != (harNameValue{Name: "limit", Value: "10"}) {
+		t.Errorf("unexpected query string %v", e.Request.QueryString)
+	}
+	if e.Request.PostData == nil || e.Request.PostData.Text != "a long r" || !e.Request.PostData.Truncated || e.Request.BodySize != 19 {
+		t.Errorf("unexpected request body %+v, size %d", e.Request.PostData, e.Request.BodySize)
+	}
+	if e.Response.Status != http.StatusOK || e.Response.Content.Text != "pod:a lo" || e.Response.Content.Size != 23 {
+		t.Errorf("unexpected response %+v", e.Response)
+	}
+	for _, h := range append(e.Request.Headers, e.Response.Headers...) {
+		if (h.Name == "Authorization" || h.Name == "Set-Cookie") && h.Value != harRedacted {
+			t.Errorf("%s was not redacted", h.Name)
+		}
+	}
+	if e.Time <= 0 || e.Time < e.Timings.Blocked+e.Timings.Wait {
+		t.Errorf("unexpected timings %v, total %v", e.Timings, e.Time)
+	}
+}
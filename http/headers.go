@@ -0,0 +1,306 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"github.com/tipok/kubeproxy/k8s"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Actions of header rewrites
+const (
+	HeaderAdd    = "add"
+	HeaderSet    = "set"
+	HeaderRemove = "remove"
+)
+
+// secretTTL is how long values of secrets are cached
+const secretTTL = time.Minute
+
+// SecretRef references a key of a secret
+type SecretRef struct {
+	// Namespace of the secret, the namespace of the requested host if empty
+	Namespace string `mapstructure:"namespace"`
+	Name      string `mapstructure:"name"`
+	Key       string `mapstructure:"key"`
+}
+
+// HeaderRewrite changes a header. The value of add and set is taken from exactly one of Value,
+// Env, Secret and Template.
+type HeaderRewrite struct {
+	Action string `mapstructure:"action"`
+	Name   string `mapstructure:"name"`
+	Value  string `mapstructure:"value"`
+	// Env is the name of an environment variable
+	Env    string     `mapstructure:"env"`
+	Secret *SecretRef `mapstructure:"secret"`
+	// Template is a text/template executed with the HeaderTarget of the request, e.g.
+	// Bearer {{ .Secret "api-token" "token" }}
+	Template string `mapstructure:"template"`
+
+	tmpl *template.Template
+}
+
+// HeaderRule rewrites the headers of requests matching all of its fields, empty fields match
+// everything. Host, Namespace and Service are glob patterns as understood by path.Match.
+type HeaderRule struct {
+	// Host is the requested host name without port
+	Host      string `mapstructure:"host"`
+	Namespace string `mapstructure:"namespace"`
+	Service   string `mapstructure:"service"`
+	// Path is a prefix of the request path matching whole segments, /api matches /api and
+	// /api/v1 but not /apis. A Path ending in / matches the paths below it only.
+	Path     string          `mapstructure:"path"`
+	Request  []HeaderRewrite `mapstructure:"request"`
+	Response []HeaderRewrite `mapstructure:"response"`
+}
+
+func (r *HeaderRule) matches(t *HeaderTarget) bool {
+	return match(r.Host, t.Host) && match(r.Namespace, t.Namespace) && match(r.Service, t.Service) &&
+		matchPath(r.Path, t.Path)
+}
+
+// matchPath reports whether the segments of prefix start p
+func matchPath(prefix, p string) bool {
+	if !strings.HasPrefix(p, prefix) {
+		return false
+	}
+	return prefix == "" || len(p) == len(prefix) || strings.HasSuffix(prefix, "/") || p[len(prefix)] == '/'
+}
+
+// HeaderRewriter applies header rules to requests to cluster hosts and their responses, all
+// matching rules are applied in order
+type HeaderRewriter struct {
+	rules []HeaderRule
+
+	lock    sync.Mutex
+	secrets map[SecretRef]cachedSecret
+}
+
+type cachedSecret struct {
+	value   string
+	expires time.Time
+}
+
+// NewHeaderRewriter validates the rules and parses their templates
+func NewHeaderRewriter(rules []HeaderRule) (*HeaderRewriter, error) {
+	for i := range rules {
+		r := &rules[i]
+		for _, pattern := range []string{r.Host, r.Namespace, r.Service} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid pattern %q: %w", i+1, pattern, err)
+			}
+		}
+		for _, rewrites := range [][]HeaderRewrite{r.Request, r.Response} {
+			for j := range rewrites {
+				if err := rewrites[j].init(); err != nil {
+					return nil, fmt.Errorf("rule %d: header %s: %w", i+1, rewrites[j].Name, err)
+				}
+			}
+		}
+	}
+	return &HeaderRewriter{rules: rules, secrets: map[SecretRef]cachedSecret{}}, nil
+}
+
+func (h *HeaderRewrite) init() error {
+	if h.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	sources := 0
+	for _, set := range []bool{h.Value != "", h.Env != "", h.Secret != nil, h.Template != ""} {
+		if set {
+			sources++
+		}
+	}
+	switch h.Action {
+	case HeaderRemove:
+		if sources != 0 {
+			return fmt.Errorf("remove takes no value")
+		}
+		return nil
+	case HeaderAdd, HeaderSet:
+	default:
+		return fmt.Errorf("unknown action %q, expected add, set or remove", h.Action)
+	}
+	if sources != 1 {
+		return fmt.Errorf("expected exactly one of value, env, secret and template")
+	}
+	if h.Secret != nil && (h.Secret.Name == "" || h.Secret.Key == "") {
+		return fmt.Errorf("secret requires name and key")
+	}
+	if h.Template != "" {
+		tmpl, err := template.New(h.Name).Option("missingkey=error").Parse(h.Template)
+		if err != nil {
+			return fmt.Errorf("invalid template: %w", err)
+		}
+		h.tmpl = tmpl
+	}
+	return nil
+}
+
+// HeaderTarget describes the request headers are rewritten for, templates are executed with it
+type HeaderTarget struct {
+	// Host is the requested host name without port
+	Host      string
+	Namespace string
+	// Service is the name of the requested service, empty for pods
+	Service string
+	Pod     string
+	Method  string
+	Path    string
+
+	ctx      context.Context
+	k8sc     resolver
+	rewriter *HeaderRewriter
+}
+
+// Env returns the value of the environment variable, it fails if the variable is not set
+func (t *HeaderTarget) Env(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// Secret returns the value of key in the secret, name is namespace/name for secrets in other
+// namespaces than the one of the requested host
+func (t *HeaderTarget) Secret(name, key string) (string, error) {
+	ref := SecretRef{Namespace: t.Namespace, Name: name, Key: key}
+	if ns, n, ok := strings.Cut(name, "/"); ok {
+		ref.Namespace, ref.Name = ns, n
+	}
+	return t.rewriter.secret(t.ctx, t.k8sc, ref)
+}
+
+func (w *HeaderRewriter) secret(ctx context.Context, k8sc resolver, ref SecretRef) (string, error) {
+	w.lock.Lock()
+	cached, ok := w.secrets[ref]
+	w.lock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.value, nil
+	}
+
+	value, err := k8sc.GetSecretValue(ctx, ref.Namespace, ref.Name, ref.Key)
+	if err != nil {
+		return "", err
+	}
+	w.lock.Lock()
+	w.secrets[ref] = cachedSecret{value: value, expires: time.Now().Add(secretTTL)}
+	w.lock.Unlock()
+	return value, nil
+}
+
+// flush drops the cached values of secrets, it returns how many there were
+func (w *HeaderRewriter) flush() int {
+	if w == nil {
+		return 0
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	n := len(w.secrets)
+	w.secrets = map[SecretRef]cachedSecret{}
+	return n
+}
+
+// newHeaderTarget describes the request r to the pod tp
+func (p *Proxy) newHeaderTarget(r *http.Request, tp *k8s.TargetPod) *HeaderTarget {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	t := &HeaderTarget{
+		Host:      strings.ToLower(host),
+		Namespace: tp.Namespace,
+		Pod:       tp.Name,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		ctx:       r.Context(),
+		k8sc:      p.k8sc,
+		rewriter:  p.Headers,
+	}
+	if h, err := p.parser.ParseHost(r.Host, r.URL.Scheme == "https"); err == nil && h.Type == "svc" {
+		t.Service = h.Name
+	}
+	return t
+}
+
+// rewrite applies the request or response rewrites of the rules matching t to header
+func (w *HeaderRewriter) rewrite(t *HeaderTarget, header http.Header, response bool) error {
+	if w == nil {
+		return nil
+	}
+	for _, r := range w.rules {
+		if !r.matches(t) {
+			continue
+		}
+		rewrites := r.Request
+		if response {
+			rewrites = r.Response
+		}
+		for _, h := range rewrites {
+			if h.Action == HeaderRemove {
+				header.Del(h.Name)
+				continue
+			}
+			value, err := h.value(t)
+			if err != nil {
+				return fmt.Errorf("could not get value of header %s: %w", h.Name, err)
+			}
+			if h.Action == HeaderAdd {
+				header.Add(h.Name, value)
+			} else {
+				header.Set(h.Name, value)
+			}
+		}
+	}
+	return nil
+}
+
+// rewritten returns the names of the headers rewritten for t
+func (w *HeaderRewriter) rewritten(t *HeaderTarget, response bool) []string {
+	if w == nil {
+		return nil
+	}
+	var names []string
+	for _, r := range w.rules {
+		if !r.matches(t) {
+			continue
+		}
+		rewrites := r.Request
+		if response {
+			rewrites = r.Response
+		}
+		for _, h := range rewrites {
+			names = append(names, h.Name)
+		}
+	}
+	return names
+}
+
+func (h *HeaderRewrite) value(t *HeaderTarget) (string, error) {
+	switch {
+	case h.Env != "":
+		return t.Env(h.Env)
+	case h.Secret != nil:
+		ref := *h.Secret
+		if ref.Namespace == "" {
+			ref.Namespace = t.Namespace
+		}
+		return t.rewriter.secret(t.ctx, t.k8sc, ref)
+	case h.tmpl != nil:
+		var b strings.Builder
+		if err := h.tmpl.Execute(&b, t); err != nil {
+			return "", err
+		}
+		return b.String(), nil
+	}
+	return h.Value, nil
+}
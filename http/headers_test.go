@@ -0,0 +1,133 @@
+package http
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNewHeaderRewriter(t *testing.T) {
+	tests := map[string]HeaderRewrite{
+		"unknown action":  {Action: "append", Name: "X-Tenant-ID", Value: "acme"},
+		"missing name":    {Action: HeaderSet, Value: "acme"},
+		"missing value":   {Action: HeaderSet, Name: "X-Tenant-ID"},
+		"two values":      {Action: HeaderSet, Name: "X-Tenant-ID", Value: "acme", Env: "TENANT"},
+		"remove value":    {Action: HeaderRemove, Name: "X-Tenant-ID", Value: "acme"},
+		"incomplete ref":  {Action: HeaderSet, Name: "Authorization", Secret: &SecretRef{Name: "api-token"}},
+		"broken template": {Action: HeaderSet, Name: "Authorization", Template: "Bearer {{ .Secret "},
+	}
+	for name, rewrite := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewHeaderRewriter([]HeaderRule{{Request: []HeaderRewrite{rewrite}}}); err == nil {
+				t.Errorf("expected rule to be refused")
+			}
+		})
+	}
+}
+
+func TestHeaderRulePath(t *testing.T) {
+	tests := []struct {
+		rule, path string
+		want       bool
+	}{
+		{"", "/api", true},
+		{"/api", "/api", true},
+		{"/api", "/api/v1", true},
+		{"/api", "/apis", false},
+		{"/api/", "/api/v1", true},
+		{"/api/", "/api", false},
+		{"/api/v1", "/api/v10", false},
+		{"/", "/orders", true},
+	}
+	for _, tt := range tests {
+		r := HeaderRule{Path: tt.rule}
+		if got := r.matches(&HeaderTarget{Path: tt.path}); got != tt.want {
+			t.Errorf("path %q matching %q = %v, want %v", tt.rule, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestProxyHeaderRewrite(t *testing.T) {
+	p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"X-Tenant-ID", "Authorization", "X-Debug", "X-Env", "X-Route"} {
+			w.Header()["Echo-"+name] = r.Header.Values(name)
+		}
+		w.Header().Set("Server", "orders")
+	}))
+	t.Setenv("KUBEPROXY_TEST_ENV", "dev")
+	var err error
+	p.Headers, err = NewHeaderRewriter([]HeaderRule{
+		{
+			Namespace: "shop",
+			Request: []HeaderRewrite{
+				{Action: HeaderSet, Name: "X-Tenant-ID", Value: "acme"},
+				{Action: HeaderRemove, Name: "X-Debug"},
+				{Action: HeaderSet, Name: "X-Env", Env: "KUBEPROXY_TEST_ENV"},
+			},
+			Response: []HeaderRewrite{{Action: HeaderRemove, Name: "Server"}},
+		},
+		{
+			Service: "orders",
+			Path:    "/api/",
+			Request: []HeaderRewrite{
+				{Action: HeaderSet, Name: "Authorization", Secret: &SecretRef{Name: "api-token", Key: "token"}},
+				{Action: HeaderAdd, Name: "X-Route", Template: "{{ .Method }} {{ .Service }}.{{ .Namespace }}{{ .Path }}"},
+				{Action: HeaderAdd, Name: "X-Route", Template: `{{ .Secret "auth/keys" "route" }}`},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("could not create header rewriter: %v", err)
+	}
+	client := newTestClient(t, p)
+
+	get := func(url string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("X-Debug", "1")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	t.Run("matching rules", func(t *testing.T) {
+		resp := get("http://orders.shop.svc.cluster.local/api/orders")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+		for name, want := range map[string]string{
+			"Echo-X-Tenant-Id":   "acme",
+			"Echo-X-Debug":       "",
+			"Echo-X-Env":         "dev",
+			"Echo-Authorization": "shop/api-token/token",
+			"Server":             "",
+		} {
+			if got := resp.Header.Get(name); got != want {
+				t.Errorf("%s: expected %q, got %q", name, want, got)
+			}
+		}
+		route := resp.Header["Echo-X-Route"]
+		if len(route) != 2 || route[0] != "GET orders.shop/api/orders" || route[1] != "auth/keys/route" {
+			t.Errorf("unexpected X-Route headers %q", route)
+		}
+	})
+
+	t.Run("other path and namespace", func(t *testing.T) {
+		resp := get("http://orders.staging.svc.cluster.local/health")
+		if resp.Header.Get("Echo-X-Debug") != "1" || resp.Header.Get("Echo-Authorization") != "" {
+			t.Errorf("expected headers to be unchanged, got %v", resp.Header)
+		}
+		if resp.Header.Get("Server") != "orders" {
+			t.Errorf("expected response headers to be unchanged, got %v", resp.Header)
+		}
+	})
+
+	t.Run("missing environment variable", func(t *testing.T) {
+		p.Headers.rules[0].Request[2].Env = "KUBEPROXY_TEST_MISSING"
+		defer func() { p.Headers.rules[0].Request[2].Env = "KUBEPROXY_TEST_ENV" }()
+		if resp := get("http://orders.shop.svc.cluster.local/"); resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("expected 502, got %d", resp.StatusCode)
+		}
+	})
+}
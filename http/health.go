@@ -0,0 +1,132 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readyTimeout limits the time the checks of a readiness probe may take
+const readyTimeout = 5 * time.Second
+
+// ErrShuttingDown is reported by the readiness probe once the proxy is shutting down
+var ErrShuttingDown = errors.New("shutting down")
+
+// ReadyResponse is the response of /readyz
+type ReadyResponse struct {
+	Ready bool `json:"ready"`
+	// Checks maps the names of the checks to ok or the reason they failed
+	Checks map[string]string `json:"checks"`
+}
+
+// Health answers the liveness probe on /healthz and the readiness probe on /readyz
+type Health struct {
+	mux      *http.ServeMux
+	lock     sync.Mutex
+	checks   []readyCheck
+	stopping bool
+}
+
+type readyCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// NewHealth returns a health without checks, it is ready until checks are added
+func NewHealth() *Health {
+	h := &Health{mux: http.NewServeMux()}
+	h.mux.HandleFunc("/healthz", h.healthz)
+	h.mux.HandleFunc("/readyz", h.readyz)
+	return h
+}
+
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// AddCheck adds a check which has to pass for the proxy to be ready
+func (h *Health) AddCheck(name string, check func(ctx context.Context) error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.checks = append(h.checks, readyCheck{name: name, check: check})
+}
+
+// Stop marks the proxy as shutting down, it is not ready anymore
+func (h *Health) Stop() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.stopping = true
+}
+
+func shuttingDown(context.Context) error {
+	return ErrShuttingDown
+}
+
+// check runs all checks in the order they were added, it returns their errors
+func (h *Health) check(ctx context.Context) ([]readyCheck, []error) {
+	h.lock.Lock()
+	checks := h.checks
+	if h.stopping {
+		checks = append([]readyCheck{{name: "shutdown", check: shuttingDown}}, checks...)
+	}
+	h.lock.Unlock()
+
+	errs := make([]error, len(checks))
+	for i, c := range checks {
+		errs[i] = c.check(ctx)
+	}
+	return checks, errs
+}
+
+// Ready returns the first failed check, nil if the proxy is ready
+func (h *Health) Ready(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	checks, errs := h.check(ctx)
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("%s: %w", checks[i].name, err)
+		}
+	}
+	return nil
+}
+
+// healthz answers as long as the process is alive
+func (h *Health) healthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (h *Health) readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	resp := &ReadyResponse{Ready: true, Checks: map[string]string{}}
+	checks, errs := h.check(ctx)
+	for i, err := range errs {
+		resp.Checks[checks[i].name] = "ok"
+		if err != nil {
+			resp.Ready = false
+			resp.Checks[checks[i].name] = err.Error()
+		}
+	}
+	if !resp.Ready {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, resp)
+}
+
+// CheckCluster checks that the API server of the cluster is reachable and accepts the
+// credentials, proxies replaying recordings without a cluster are always ready
+func (p *Proxy) CheckCluster(ctx context.Context) error {
+	if p.k8sc == nil {
+		if p.Replay != nil {
+			return nil
+		}
+		return ErrNoCluster
+	}
+	return p.k8sc.Ping(ctx)
+}
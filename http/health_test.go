@@ -0,0 +1,75 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	p, _ := newFakeProxy(t, http.NotFoundHandler())
+	resolver := fakeResolver{pingErr: errors.New("not authenticated")}
+	p.k8sc = resolver
+	p.Health = NewHealth()
+	p.Health.AddCheck("cluster", p.CheckCluster)
+	admin := httptest.NewServer(p.NewAdmin())
+	defer admin.Close()
+
+	resp, err := http.Get(admin.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(b) != "ok\n" {
+		t.Errorf("expected to be alive, got %d %q", resp.StatusCode, b)
+	}
+
+	readyz := func() (int, ReadyResponse) {
+		resp, err := http.Get(admin.URL + "/readyz")
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var ready ReadyResponse
+		if err := json.NewDecoder(resp.Body).Decode(&ready); err != nil {
+			t.Fatalf("invalid response: %v", err)
+		}
+		return resp.StatusCode, ready
+	}
+	if status, ready := readyz(); status != http.StatusServiceUnavailable || ready.Ready || ready.Checks["cluster"] != "not authenticated" {
+		t.Errorf("expected not to be ready, got %d %+v", status, ready)
+	}
+	if err := p.Health.Ready(context.Background()); err == nil || err.Error() != "cluster: not authenticated" {
+		t.Errorf("unexpected readiness %v", err)
+	}
+
+	resolver.pingErr = nil
+	p.k8sc = resolver
+	if status, ready := readyz(); status != http.StatusOK || !ready.Ready || ready.Checks["cluster"] != "ok" {
+		t.Errorf("expected to be ready, got %d %+v", status, ready)
+	}
+	if err := p.Health.Ready(context.Background()); err != nil {
+		t.Errorf("expected to be ready, got %v", err)
+	}
+
+	p.Health.Stop()
+	if status, ready := readyz(); status != http.StatusServiceUnavailable || ready.Checks["shutdown"] != ErrShuttingDown.Error() {
+		t.Errorf("expected not to be ready while shutting down, got %d %+v", status, ready)
+	}
+}
+
+func TestCheckClusterWithoutCluster(t *testing.T) {
+	p := NewProxy(nil, "cluster.local")
+	if err := p.CheckCluster(context.Background()); !errors.Is(err, ErrNoCluster) {
+		t.Errorf("expected %v, got %v", ErrNoCluster, err)
+	}
+	p.Replay = &Replayer{}
+	if err := p.CheckCluster(context.Background()); err != nil {
+		t.Errorf("expected replaying proxy to be ready, got %v", err)
+	}
+}
@@ -17,6 +17,11 @@ type Host struct {
 
 type Parser struct {
 	ClusterDomain string
+	// Aliases maps lower case host names to cluster hosts, e.g. orders.dev to
+	// orders.shop.svc.cluster.local
+	Aliases map[string]string
+	// CIDRs are the ClusterIP and pod networks, their addresses are resolved to pods
+	CIDRs []*net.IPNet
 }
 
 func (p *Parser) ParseHost(h string, https bool) (*Host, error) {
@@ -36,6 +41,17 @@ func (p *Parser) ParseHost(h string, https bool) (*Host, error) {
 	if port == "" {
 		port = "80"
 	}
+	if alias, ok := p.Aliases[strings.ToLower(host)]; ok {
+		host = alias
+	}
+	if ip := net.ParseIP(host); ip != nil && p.inCIDRs(ip) {
+		return &Host{
+			Name: ip.String(),
+			Type: "ip",
+			Port: port,
+			K8s:  true,
+		}, nil
+	}
 	if !strings.HasSuffix(host, p.ClusterDomain) {
 		return &Host{
 			Domain: host,
@@ -46,6 +62,10 @@ func (p *Parser) ParseHost(h string, https bool) (*Host, error) {
 
 	clusterDomain := p.ClusterDomain
 	host = strings.TrimSuffix(host, fmt.Sprintf(".%s", clusterDomain))
+	// name.namespace.type
+	if strings.Count(host, ".") < 2 {
+		return nil, fmt.Errorf("invalid cluster host %s", h)
+	}
 	i := strings.LastIndex(host, ".")
 	t := host[i+1:]
 	host = host[:i]
@@ -61,3 +81,22 @@ func (p *Parser) ParseHost(h string, https bool) (*Host, error) {
 		K8s:       true,
 	}, nil
 }
+
+// checkType refuses cluster hosts of unknown types, e.g. name.namespace.svcs, they must not be
+// resolved like services without matching the rules for services
+func (h *Host) checkType() error {
+	switch h.Type {
+	case "svc", "pod", "ip":
+		return nil
+	}
+	return fmt.Errorf("unknown type %q of cluster host %s.%s", h.Type, h.Name, h.Namespace)
+}
+
+func (p *Parser) inCIDRs(ip net.IP) bool {
+	for _, n := range p.CIDRs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
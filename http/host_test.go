@@ -1,6 +1,9 @@
 package http
 
-import "testing"
+import (
+	"net"
+	"testing"
+)
 
 func TestParseHost(t *testing.T) {
 	p := &Parser{ClusterDomain: "cluster.local"}
@@ -9,6 +12,49 @@ func TestParseHost(t *testing.T) {
 	t.Run("k8s without port https", testParseHostK8sWithWithoutPortHttps(p))
 	t.Run("k8s without port non https", testParseHostK8sWithWithoutPortNonHttps(p))
 	t.Run("non k8s without port https", testParseHostWithoutPortNonHttps(p))
+	t.Run("k8s without name", testParseHostK8sWithoutName(p))
+	t.Run("alias", testParseHostAlias)
+	t.Run("cluster network", testParseHostClusterNetwork)
+}
+
+func testParseHostAlias(t *testing.T) {
+	p := &Parser{ClusterDomain: "cluster.local", Aliases: map[string]string{"orders.dev": "orders.shop.svc.cluster.local"}}
+	host, err := p.ParseHost("Orders.dev:8080", false)
+	if err != nil {
+		t.Fatalf("failed to parse host: %v", err)
+	}
+	if !host.K8s || host.Name != "orders" || host.Namespace != "shop" || host.Type != "svc" || host.Port != "8080" {
+		t.Errorf("unexpected host: %+v", host)
+	}
+}
+
+func testParseHostClusterNetwork(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.96.0.0/12")
+	p := &Parser{ClusterDomain: "cluster.local", CIDRs: []*net.IPNet{network}}
+	host, err := p.ParseHost("10.96.0.10:53", false)
+	if err != nil {
+		t.Fatalf("failed to parse host: %v", err)
+	}
+	if !host.K8s || host.Type != "ip" || host.Name != "10.96.0.10" || host.Port != "53" {
+		t.Errorf("unexpected host: %+v", host)
+	}
+	host, err = p.ParseHost("192.168.0.1", false)
+	if err != nil {
+		t.Fatalf("failed to parse host: %v", err)
+	}
+	if host.K8s {
+		t.Errorf("unexpected k8s host: %+v", host)
+	}
+}
+
+func testParseHostK8sWithoutName(p *Parser) func(t *testing.T) {
+	return func(t *testing.T) {
+		for _, h := range []string{"home-notifier.svc.cluster.local", "svc.cluster.local:80"} {
+			if host, err := p.ParseHost(h, false); err == nil {
+				t.Errorf("expected error for %s, got %+v", h, host)
+			}
+		}
+	}
 }
 
 func testParseHostK8sWithIntPort(p *Parser) func(t *testing.T) {
@@ -0,0 +1,137 @@
+package http
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// loopbackAllocator hands out a distinct address of a loopback network per key
+type loopbackAllocator struct {
+	network *net.IPNet
+	lock    sync.Mutex
+	ips     map[string]net.IP
+	used    map[uint32]bool
+}
+
+func newLoopbackAllocator(network *net.IPNet) (*loopbackAllocator, error) {
+	if network.IP.To4() == nil || !network.IP.IsLoopback() {
+		return nil, fmt.Errorf("%s is not an IPv4 loopback network", network)
+	}
+	return &loopbackAllocator{network: network, ips: map[string]net.IP{}, used: map[uint32]bool{}}, nil
+}
+
+// allocate returns the address of key, the same address is returned until it is released
+func (a *loopbackAllocator) allocate(key string) (net.IP, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if ip, ok := a.ips[key]; ok {
+		return ip, nil
+	}
+
+	ones, bits := a.network.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	base := binary.BigEndian.Uint32(a.network.IP.To4())
+	// skip the network and broadcast addresses
+	for i := uint32(1); i+1 < size; i++ {
+		if a.used[i] {
+			continue
+		}
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, base+i)
+		a.used[i] = true
+		a.ips[key] = ip
+		return ip, nil
+	}
+	return nil, fmt.Errorf("no free address in %s", a.network)
+}
+
+func (a *loopbackAllocator) release(key string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	ip, ok := a.ips[key]
+	if !ok {
+		return
+	}
+	delete(a.ips, key)
+	delete(a.used, binary.BigEndian.Uint32(ip.To4())-binary.BigEndian.Uint32(a.network.IP.To4()))
+}
+
+const (
+	hostsBlockBegin = "# BEGIN kubeproxy"
+	hostsBlockEnd   = "# END kubeproxy"
+)
+
+// HostsFile maintains a marked block of entries in a /etc/hosts style file, lines outside of
+// the block are kept as they are
+type HostsFile struct {
+	Path string
+	lock sync.Mutex
+}
+
+// Write replaces the block with entries mapping addresses to host names
+func (h *HostsFile) Write(entries map[string][]string) error {
+	var block bytes.Buffer
+	if len(entries) > 0 {
+		ips := make([]string, 0, len(entries))
+		for ip := range entries {
+			ips = append(ips, ip)
+		}
+		sort.Slice(ips, func(i, j int) bool {
+			return bytes.Compare(net.ParseIP(ips[i]).To16(), net.ParseIP(ips[j]).To16()) < 0
+		})
+		block.WriteString(hostsBlockBegin + "\n")
+		for _, ip := range ips {
+			block.WriteString(fmt.Sprintf("%s %s\n", ip, strings.Join(entries[ip], " ")))
+		}
+		block.WriteString(hostsBlockEnd + "\n")
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	content, err := ioutil.ReadFile(h.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not read %s: %w", h.Path, err)
+	}
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(h.Path); err == nil {
+		mode = fi.Mode()
+	}
+
+	var out bytes.Buffer
+	inBlock := false
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		switch strings.TrimSpace(line) {
+		case hostsBlockBegin:
+			inBlock = true
+			continue
+		case hostsBlockEnd:
+			inBlock = false
+			continue
+		}
+		if !inBlock {
+			out.WriteString(line)
+		}
+	}
+	if out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+		out.WriteString("\n")
+	}
+	out.Write(block.Bytes())
+
+	// the file is rewritten in place, /etc/hosts is often a bind mount which can't be replaced
+	if err := ioutil.WriteFile(h.Path, out.Bytes(), mode); err != nil {
+		return fmt.Errorf("could not write %s: %w", h.Path, err)
+	}
+	return nil
+}
+
+// Clean removes the block
+func (h *HostsFile) Clean() error {
+	return h.Write(nil)
+}
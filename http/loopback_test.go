@@ -0,0 +1,173 @@
+package http
+
+import (
+	"context"
+	"github.com/tipok/kubeproxy/k8s"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoopbackAllocator(t *testing.T) {
+	_, network, _ := net.ParseCIDR("127.1.0.0/30")
+	a, err := newLoopbackAllocator(network)
+	if err != nil {
+		t.Fatalf("could not create allocator: %v", err)
+	}
+
+	orders, _ := a.allocate("orders.shop")
+	payments, _ := a.allocate("payments.shop")
+	if orders.String() != "127.1.0.1" || payments.String() != "127.1.0.2" {
+		t.Errorf("unexpected addresses %s and %s", orders, payments)
+	}
+	if again, _ := a.allocate("orders.shop"); !again.Equal(orders) {
+		t.Errorf("expected stable address %s, got %s", orders, again)
+	}
+	if _, err := a.allocate("billing.shop"); err == nil {
+		t.Errorf("expected network to be exhausted")
+	}
+	a.release("orders.shop")
+	if billing, _ := a.allocate("billing.shop"); !billing.Equal(orders) {
+		t.Errorf("expected released address %s, got %s", orders, billing)
+	}
+
+	_, public, _ := net.ParseCIDR("10.0.0.0/8")
+	if _, err := newLoopbackAllocator(public); err == nil {
+		t.Errorf("expected non loopback network to be refused")
+	}
+}
+
+func TestHostsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	original := "127.0.0.1 localhost\n::1 localhost"
+	if err := ioutil.WriteFile(path, []byte(original), 0644); err != nil {
+		t.Fatalf("could not write hosts file: %v", err)
+	}
+	h := &HostsFile{Path: path}
+
+	err := h.Write(map[string][]string{
+		"127.1.0.2": {"payments.shop.svc.cluster.local"},
+		"127.1.0.1": {"orders.shop.svc.cluster.local", "orders.shop"},
+	})
+	if err != nil {
+		t.Fatalf("could not write entries: %v", err)
+	}
+	// rewriting replaces the block
+	err = h.Write(map[string][]string{
+		"127.1.0.10": {"billing.shop.svc.cluster.local"},
+		"127.1.0.1":  {"orders.shop.svc.cluster.local", "orders.shop"},
+	})
+	if err != nil {
+		t.Fatalf("could not write entries: %v", err)
+	}
+	content, _ := ioutil.ReadFile(path)
+	expected := original + "\n" + hostsBlockBegin + "\n" +
+		"127.1.0.1 orders.shop.svc.cluster.local orders.shop\n" +
+		"127.1.0.10 billing.shop.svc.cluster.local\n" +
+		hostsBlockEnd + "\n"
+	if string(content) != expected {
+		t.Errorf("unexpected hosts file:\n%s", content)
+	}
+
+	if err := h.Clean(); err != nil {
+		t.Fatalf("could not clean hosts file: %v", err)
+	}
+	content, _ = ioutil.ReadFile(path)
+	if string(content) != original+"\n" {
+		t.Errorf("unexpected hosts file after clean:\n%s", content)
+	}
+}
+
+func TestForwarderWatchNamespaces(t *testing.T) {
+	p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("orders"))
+	}))
+	events := make(chan k8s.ServiceEvent)
+	p.k8sc = fakeResolver{events: events}
+	hosts := &HostsFile{Path: filepath.Join(t.TempDir(), "hosts")}
+	f := p.NewForwarder()
+	defer f.Close()
+
+	_, network, _ := net.ParseCIDR("127.77.0.0/16")
+	if err := f.UseLoopback(network, hosts); err != nil {
+		t.Fatalf("could not enable loopback addresses: %v", err)
+	}
+	if err := f.WatchNamespaces(context.Background(), []string{"shop"}); err != nil {
+		t.Fatalf("could not watch namespaces: %v", err)
+	}
+	// events are received one after the other, deleting an unknown service is a no-op which is
+	// only received after the previous event was handled
+	sync := func() {
+		events <- k8s.ServiceEvent{Deleted: true, Service: &k8s.Service{Name: "unknown", Namespace: "shop"}}
+	}
+	events <- k8s.ServiceEvent{Service: &k8s.Service{Name: "orders", Namespace: "shop", Ports: []string{"18080"}}}
+	events <- k8s.ServiceEvent{Service: &k8s.Service{Name: "payments", Namespace: "shop", Ports: []string{"18080"}}}
+	sync()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+	resp, err := client.Get("http://127.77.0.1:18080/")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "orders" {
+		t.Errorf("unexpected body %q", body)
+	}
+	content, _ := ioutil.ReadFile(hosts.Path)
+	if !strings.Contains(string(content), "127.77.0.1 orders.shop.svc.cluster.local") ||
+		!strings.Contains(string(content), "127.77.0.2 payments.shop.svc.cluster.local") {
+		t.Errorf("unexpected hosts file:\n%s", content)
+	}
+
+	events <- k8s.ServiceEvent{Deleted: true, Service: &k8s.Service{Name: "orders", Namespace: "shop"}}
+	sync()
+	if _, err := client.Get("http://127.77.0.1:18080/"); err == nil {
+		t.Errorf("expected listener of deleted service to be closed")
+	}
+	content, _ = ioutil.ReadFile(hosts.Path)
+	if strings.Contains(string(content), "orders") {
+		t.Errorf("expected entry of deleted service to be removed:\n%s", content)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("could not close forwarder: %v", err)
+	}
+	content, _ = ioutil.ReadFile(hosts.Path)
+	if len(content) != 0 {
+		t.Errorf("expected hosts file to be cleaned:\n%s", content)
+	}
+}
+
+func TestForwarderLookupPod(t *testing.T) {
+	p, _ := newFakeProxy(t, http.NotFoundHandler())
+	hosts := &HostsFile{Path: filepath.Join(t.TempDir(), "hosts")}
+	f := p.NewForwarder()
+	defer f.Close()
+	_, network, _ := net.ParseCIDR("127.78.0.0/16")
+	if err := f.UseLoopback(network, hosts); err != nil {
+		t.Fatalf("could not enable loopback addresses: %v", err)
+	}
+
+	// a pod and a service of the same name get their own address
+	pod, _, err := f.lookup(context.Background(), &Host{Type: "pod", Name: "orders", Namespace: "shop"})
+	if err != nil {
+		t.Fatalf("could not look up pod: %v", err)
+	}
+	svc, _, err := f.lookup(context.Background(), &Host{Type: "svc", Name: "orders", Namespace: "shop"})
+	if err != nil {
+		t.Fatalf("could not look up service: %v", err)
+	}
+	if pod.Equal(svc) {
+		t.Errorf("expected pod and service to have different addresses, got %s", pod)
+	}
+	content, _ := ioutil.ReadFile(hosts.Path)
+	if !strings.Contains(string(content), pod.String()+" orders.shop.pod.cluster.local orders.shop.pod\n") ||
+		!strings.Contains(string(content), svc.String()+" orders.shop.svc.cluster.local orders.shop.svc orders.shop\n") {
+		t.Errorf("unexpected hosts file:\n%s", content)
+	}
+}
@@ -0,0 +1,263 @@
+package http
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets are the upper bounds in seconds of the buckets of latency histograms
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics collects the metrics of a proxy and serves them in the Prometheus text format
+type Metrics struct {
+	requests          *metric
+	requestDuration   *metric
+	tunnels           *metric
+	tunnelsActive     *metric
+	bytes             *metric
+	lookupDuration    *metric
+	dialFailures      *metric
+	errorStreamErrors *metric
+}
+
+// NewMetrics returns empty metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: newMetric("counter", "kubeproxy_requests_total",
+			"Requests to cluster hosts", "namespace", "service", "status"),
+		requestDuration: newMetric("histogram", "kubeproxy_request_duration_seconds",
+			"Duration of requests to cluster hosts until the response body is closed", "namespace", "service", "status"),
+		tunnels: newMetric("counter", "kubeproxy_tunnels_total",
+			"Tunnels to cluster hosts by kind: connect, socks or forward", "kind", "namespace", "service"),
+		tunnelsActive: newMetric("gauge", "kubeproxy_tunnels_active",
+			"Open tunnels to cluster hosts", "kind"),
+		bytes: newMetric("counter", "kubeproxy_transferred_bytes_total",
+			"Bytes received from (in) and sent to (out) clients", "kind", "direction"),
+		lookupDuration: newMetric("histogram", "kubeproxy_lookup_duration_seconds",
+			"Duration of API server lookups of pods by resolver: pod, service or ip", "resolver", "result"),
+		dialFailures: newMetric("counter", "kubeproxy_dial_failures_total",
+			"Failed SPDY connections to the port-forward API of pods", "namespace"),
+		errorStreamErrors: newMetric("counter", "kubeproxy_error_stream_errors_total",
+			"Errors reported by the kubelet on port-forward error streams", "namespace"),
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, metric := range []*metric{
+		m.requests, m.requestDuration, m.tunnels, m.tunnelsActive, m.bytes,
+		m.lookupDuration, m.dialFailures, m.errorStreamErrors,
+	} {
+		metric.write(w)
+	}
+}
+
+// finish records a finished request or tunnel
+func (m *Metrics) finish(e *accessEntry, d time.Duration) {
+	if m == nil {
+		return
+	}
+	if e.Kind == kindHTTP {
+		status := strconv.Itoa(e.Status)
+		m.requests.add(1, e.Namespace, e.service, status)
+		m.requestDuration.observe(d.Seconds(), e.Namespace, e.service, status)
+	} else {
+		m.tunnels.add(1, e.Kind, e.Namespace, e.service)
+	}
+	m.bytes.add(float64(atomic.LoadInt64(&e.bytesIn)), e.Kind, "in")
+	m.bytes.add(float64(atomic.LoadInt64(&e.bytesOut)), e.Kind, "out")
+}
+
+// ServiceStats are the totals of requests to a service
+type ServiceStats struct {
+	Namespace string `json:"namespace"`
+	// Service is empty for requests to pods and cluster addresses
+	Service  string `json:"service"`
+	Requests int64  `json:"requests"`
+	// Errors are the requests answered with 5xx
+	Errors int64 `json:"errors"`
+}
+
+// ServiceStats returns the totals of requests per service since the start
+func (m *Metrics) ServiceStats() []ServiceStats {
+	stats := []ServiceStats{}
+	if m == nil {
+		return stats
+	}
+	m.requests.lock.Lock()
+	defer m.requests.lock.Unlock()
+	index := map[[2]string]int{}
+	for _, s := range m.requests.series {
+		key := [2]string{s.labels[0], s.labels[1]}
+		i, ok := index[key]
+		if !ok {
+			i = len(stats)
+			index[key] = i
+			stats = append(stats, ServiceStats{Namespace: key[0], Service: key[1]})
+		}
+		stats[i].Requests += int64(s.value)
+		if strings.HasPrefix(s.labels[2], "5") {
+			stats[i].Errors += int64(s.value)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Namespace != stats[j].Namespace {
+			return stats[i].Namespace < stats[j].Namespace
+		}
+		return stats[i].Service < stats[j].Service
+	})
+	return stats
+}
+
+// tunnelOpened counts an open tunnel until tunnelClosed is called
+func (m *Metrics) tunnelOpened(kind string) {
+	if m != nil {
+		m.tunnelsActive.add(1, kind)
+	}
+}
+
+func (m *Metrics) tunnelClosed(kind string) {
+	if m != nil {
+		m.tunnelsActive.add(-1, kind)
+	}
+}
+
+// ObserveLookup records an API server lookup of the resolver pod, service or ip, it is meant
+// to be set as k8s.Api.OnLookup
+func (m *Metrics) ObserveLookup(resolver string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	m.lookupDuration.observe(d.Seconds(), resolver, result)
+}
+
+func (m *Metrics) dialFailed(namespace string) {
+	if m != nil {
+		m.dialFailures.add(1, namespace)
+	}
+}
+
+func (m *Metrics) errorStreamError(namespace string) {
+	if m != nil {
+		m.errorStreamErrors.add(1, namespace)
+	}
+}
+
+// metric is a counter, gauge or histogram with labels
+type metric struct {
+	kind   string
+	name   string
+	help   string
+	labels []string
+
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+// series holds the values of one combination of label values
+type series struct {
+	labels []string
+	value  float64
+	// counts of observations per bucket of histograms, the last one is +Inf
+	counts []uint64
+	sum    float64
+}
+
+func newMetric(kind, name, help string, labels ...string) *metric {
+	return &metric{kind: kind, name: name, help: help, labels: labels, series: map[string]*series{}}
+}
+
+// get returns the series of the label values, m.lock has to be held
+func (m *metric) get(labels []string) *series {
+	key := strings.Join(labels, "\x00")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: labels}
+		if m.kind == "histogram" {
+			s.counts = make([]uint64, len(durationBuckets)+1)
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metric) add(v float64, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.get(labels).value += v
+}
+
+func (m *metric) observe(v float64, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s := m.get(labels)
+	s.counts[sort.SearchFloat64s(durationBuckets, v)]++
+	s.sum += v
+}
+
+func (m *metric) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	for _, key := range keys {
+		s := m.series[key]
+		labels := m.formatLabels(s.labels)
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labels, formatValue(s.value))
+			continue
+		}
+		var count uint64
+		for i, c := range s.counts {
+			count += c
+			le := "+Inf"
+			if i < len(durationBuckets) {
+				le = formatValue(durationBuckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.formatLabels(s.labels, "le", le), count)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, count)
+	}
+}
+
+// formatLabels returns the labels with the values, followed by extra name value pairs
+func (m *metric) formatLabels(values []string, extra ...string) string {
+	pairs := make([]string, 0, len(values)+len(extra)/2)
+	for i, name := range m.labels {
+		pairs = append(pairs, name+"="+quoteLabel(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+quoteLabel(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,88 @@
+package http
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("pod"))
+	}))
+	p.Metrics = NewMetrics()
+	admin := httptest.NewServer(p.NewAdmin())
+	defer admin.Close()
+	client := newTestClient(t, p)
+
+	for _, path := range []string{"/orders", "/orders", "/missing"} {
+		resp, err := client.Get("http://orders.shop.svc.cluster.local" + path)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		_, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	p.Metrics.ObserveLookup("service", 30*time.Millisecond, nil)
+	p.Metrics.ObserveLookup("pod", time.Second, errors.New("not found"))
+
+	var metrics string
+	// the entries of requests are finished after the response was sent
+	for i := 0; i < 50; i++ {
+		resp, err := http.Get(admin.URL + "/metrics")
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		metrics = string(b)
+		if strings.Contains(metrics, `kubeproxy_transferred_bytes_total{kind="http",direction="out"} 25`) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, line := range []string{
+		"# TYPE kubeproxy_requests_total counter",
+		`kubeproxy_requests_total{namespace="shop",service="orders",status="200"} 2`,
+		`kubeproxy_requests_total{namespace="shop",service="orders",status="404"} 1`,
+		"# TYPE kubeproxy_request_duration_seconds histogram",
+		`kubeproxy_request_duration_seconds_bucket{namespace="shop",service="orders",status="200",le="+Inf"} 2`,
+		`kubeproxy_request_duration_seconds_count{namespace="shop",service="orders",status="200"} 2`,
+		// "pod" twice and "404 page not found\n"
+		`kubeproxy_transferred_bytes_total{kind="http",direction="out"} 25`,
+		`kubeproxy_lookup_duration_seconds_bucket{resolver="service",result="ok",le="0.025"} 0`,
+		`kubeproxy_lookup_duration_seconds_bucket{resolver="service",result="ok",le="0.05"} 1`,
+		`kubeproxy_lookup_duration_seconds_sum{resolver="pod",result="error"} 1`,
+		"# TYPE kubeproxy_tunnels_active gauge",
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("expected %q in\n%s", line, metrics)
+		}
+	}
+
+	var stats []ServiceStats
+	adminGet(t, admin.URL+"/stats", &stats)
+	if len(stats) != 1 || stats[0] != (ServiceStats{Namespace: "shop", Service: "orders", Requests: 3}) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestMetricLabels(t *testing.T) {
+	m := newMetric("counter", "test_total", "Test", "name")
+	m.add(1, "a \"quoted\"\\name\n")
+	var b strings.Builder
+	m.write(&b)
+	want := "# HELP test_total Test\n# TYPE test_total counter\ntest_total{name=\"a \\\"quoted\\\"\\\\name\\n\"} 1\n"
+	if b.String() != want {
+		t.Errorf("expected %q, got %q", want, b.String())
+	}
+}
@@ -0,0 +1,196 @@
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	caValidity = 10 * 365 * 24 * time.Hour
+	// browsers refuse leaf certificates valid for more than 398 days
+	leafValidity = 365 * 24 * time.Hour
+)
+
+// LoadOrCreateCA loads the CA used to intercept TLS connections, a new CA is created and stored
+// if neither file exists yet
+func LoadOrCreateCA(certFile, keyFile string) (*tls.Certificate, error) {
+	ca, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil {
+		return &ca, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not load CA: %w", err)
+	}
+	// an existing certificate or key is never replaced
+	for _, f := range []string{certFile, keyFile} {
+		if _, err := os.Stat(f); !errors.Is(err, os.ErrNotExist) {
+			missing := certFile
+			if f == certFile {
+				missing = keyFile
+			}
+			return nil, fmt.Errorf("could not load CA: %s exists but %s is missing", f, missing)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate CA key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("could not generate serial number: %w", err)
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"kubeproxy"},
+			CommonName:   fmt.Sprintf("kubeproxy CA %s", hostname),
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create CA certificate: %w", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal CA key: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return nil, fmt.Errorf("could not write CA key: %w", err)
+	}
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return nil, fmt.Errorf("could not write CA certificate: %w", err)
+	}
+
+	ca, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("could not load CA: %w", err)
+	}
+	return &ca, nil
+}
+
+// certStore signs certificates for intercepted hosts with the CA, certificates are cached
+type certStore struct {
+	ca    *tls.Certificate
+	x509  *x509.Certificate
+	lock  sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+func newCertStore(ca *tls.Certificate) (*certStore, error) {
+	x509ca, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("could not parse CA certificate: %w", err)
+	}
+	return &certStore{ca: ca, x509: x509ca, certs: map[string]*tls.Certificate{}}, nil
+}
+
+func (cs *certStore) get(host string) (*tls.Certificate, error) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	if cert, ok := cs.certs[host]; ok && time.Now().Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("could not generate serial number: %w", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"kubeproxy"},
+			CommonName:   host,
+		},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(leafValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, cs.x509, &key.PublicKey, cs.ca.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not sign certificate for %s: %w", host, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse certificate for %s: %w", host, err)
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, cs.ca.Certificate[0]},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	cs.certs[host] = cert
+	return cert, nil
+}
+
+// MitmConnect returns a goproxy HttpsHandler intercepting CONNECT tunnels to the TLS ports of
+// cluster hosts with certificates signed by ca. Decrypted requests are passed to Do, tunnels
+// to other ports are passed to TunnelConnect.
+func (p *Proxy) MitmConnect(ca *tls.Certificate, tlsPorts []string) (goproxy.FuncHttpsHandler, error) {
+	certs, err := newCertStore(ca)
+	if err != nil {
+		return nil, err
+	}
+	ports := map[string]bool{}
+	for _, port := range tlsPorts {
+		ports[port] = true
+	}
+	p.mitmPorts = ports
+
+	mitm := &goproxy.ConnectAction{
+		Action: goproxy.ConnectMitm,
+		TLSConfig: func(host string, _ *goproxy.ProxyCtx) (*tls.Config, error) {
+			hostname, _, err := net.SplitHostPort(host)
+			if err != nil {
+				hostname = host
+			}
+			cert, err := certs.get(hostname)
+			if err != nil {
+				return nil, err
+			}
+			return &tls.Config{Certificates: []tls.Certificate{*cert}, MinVersion: tls.VersionTLS12}, nil
+		},
+	}
+
+	return func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		h, err := p.parser.ParseHost(host, true)
+		if err != nil || !h.K8s || !ports[h.Port] {
+			return p.TunnelConnect(host, ctx)
+		}
+		return mitm, host
+	}, nil
+}
@@ -0,0 +1,158 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/elazarl/goproxy"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestLoadOrCreateCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+
+	created, err := LoadOrCreateCA(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("could not create CA: %v", err)
+	}
+	loaded, err := LoadOrCreateCA(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("could not load CA: %v", err)
+	}
+	if string(created.Certificate[0]) != string(loaded.Certificate[0]) {
+		t.Errorf("CA was recreated")
+	}
+	cert, err := x509.ParseCertificate(loaded.Certificate[0])
+	if err != nil {
+		t.Fatalf("could not parse CA: %v", err)
+	}
+	if !cert.IsCA {
+		t.Errorf("certificate is not a CA")
+	}
+
+	t.Run("missing key", func(t *testing.T) {
+		if err := os.Remove(keyFile); err != nil {
+			t.Fatalf("could not remove key: %v", err)
+		}
+		if _, err := LoadOrCreateCA(certFile, keyFile); err == nil || !strings.Contains(err.Error(), keyFile) {
+			t.Errorf("expected error naming %s, got %v", keyFile, err)
+		}
+		if _, err := os.Stat(keyFile); err == nil {
+			t.Errorf("key was recreated")
+		}
+	})
+
+	t.Run("missing certificate", func(t *testing.T) {
+		certFile, keyFile := filepath.Join(dir, "other.pem"), filepath.Join(dir, "other-key.pem")
+		if err := ioutil.WriteFile(keyFile, []byte("key"), 0600); err != nil {
+			t.Fatalf("could not write key: %v", err)
+		}
+		if _, err := LoadOrCreateCA(certFile, keyFile); err == nil || !strings.Contains(err.Error(), certFile) {
+			t.Errorf("expected error naming %s, got %v", certFile, err)
+		}
+	})
+}
+
+func TestMitmConnect(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		t.Fatalf("could not create CA: %v", err)
+	}
+	roots := x509.NewCertPool()
+	x509ca, _ := x509.ParseCertificate(ca.Certificate[0])
+	roots.AddCert(x509ca)
+
+	// the pod serves a certificate for its service name signed by the same CA
+	certs, err := newCertStore(ca)
+	if err != nil {
+		t.Fatalf("could not create cert store: %v", err)
+	}
+	podCert, err := certs.get("secure.shop.svc.cluster.local")
+	if err != nil {
+		t.Fatalf("could not create pod certificate: %v", err)
+	}
+	con := newFakeTLSConnection(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || r.TLS.ServerName != "secure.shop.svc.cluster.local" {
+			t.Errorf("unexpected tls state: %+v", r.TLS)
+		}
+		w.Header().Set("X-Path", r.URL.Path)
+		_, _ = w.Write([]byte("intercepted"))
+	}), &tls.Config{Certificates: []tls.Certificate{*podCert}})
+	p := newFakeProxyFor(con)
+	p.UpstreamTLS = &tls.Config{RootCAs: roots}
+
+	proxy := goproxy.NewProxyHttpServer()
+	onReq := proxy.OnRequest(goproxy.ReqHostMatches(regexp.MustCompile(`^.*\.cluster\.local:?\d*`)))
+	handleConnect, err := p.MitmConnect(ca, []string{"443"})
+	if err != nil {
+		t.Fatalf("could not create connect handler: %v", err)
+	}
+	onReq.HandleConnect(handleConnect)
+	onReq.DoFunc(p.Do)
+	front := httptest.NewServer(p.Handler(proxy))
+	defer front.Close()
+
+	proxyURL, _ := url.Parse(front.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+	resp, err := client.Get("https://secure.shop.svc.cluster.local/orders")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "intercepted" {
+		t.Errorf("unexpected body: %q", body)
+	}
+	if resp.Header.Get("X-Path") != "/orders" {
+		t.Errorf("unexpected path: %s", resp.Header.Get("X-Path"))
+	}
+}
+
+func TestUpstreamServerNamePerHost(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		t.Fatalf("could not create CA: %v", err)
+	}
+	roots := x509.NewCertPool()
+	x509ca, _ := x509.ParseCertificate(ca.Certificate[0])
+	roots.AddCert(x509ca)
+	certs, err := newCertStore(ca)
+	if err != nil {
+		t.Fatalf("could not create cert store: %v", err)
+	}
+	// both hosts are served by the same pod
+	con := newFakeTLSConnection(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.ServerName))
+	}), &tls.Config{GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return certs.get(hello.ServerName)
+	}})
+	p := newFakeProxyFor(con)
+	p.UpstreamTLS = &tls.Config{RootCAs: roots}
+	p.parser.Aliases = map[string]string{"secure.dev": "secure.shop.svc.cluster.local"}
+
+	for _, host := range []string{"secure.shop.svc.cluster.local", "secure.dev", "secure.shop.svc.cluster.local"} {
+		req, _ := http.NewRequest(http.MethodGet, "https://"+host+"/", nil)
+		resp, err := p.transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("request to %s failed: %v", host, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != host {
+			t.Errorf("expected server name %s, got %s", host, body)
+		}
+	}
+}
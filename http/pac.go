@@ -0,0 +1,54 @@
+package http
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// pacPath is served by the proxy listener for browsers using proxy auto-config
+const pacPath = "/proxy.pac"
+
+// PAC returns a proxy auto-config script sending requests to cluster hosts, aliases and cluster
+// networks to the proxy at proxyAddr, all other requests are sent directly
+func (p *Proxy) PAC(proxyAddr string) string {
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString(fmt.Sprintf("  var proxy = %q;\n", "PROXY "+proxyAddr))
+	b.WriteString("  host = host.toLowerCase();\n")
+	b.WriteString(fmt.Sprintf("  if (dnsDomainIs(host, %q)) {\n    return proxy;\n  }\n", "."+p.parser.ClusterDomain))
+
+	aliases := make([]string, 0, len(p.parser.Aliases))
+	for alias := range p.parser.Aliases {
+		aliases = append(aliases, strings.ToLower(alias))
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		b.WriteString(fmt.Sprintf("  if (host == %q) {\n    return proxy;\n  }\n", alias))
+	}
+
+	var networks []string
+	for _, n := range p.parser.CIDRs {
+		// PAC files only support IPv4 networks
+		if ip := n.IP.To4(); ip != nil && len(n.Mask) == net.IPv4len {
+			networks = append(networks, fmt.Sprintf("isInNet(host, %q, %q)", ip, net.IP(n.Mask)))
+		}
+	}
+	if len(networks) > 0 {
+		// isInNet resolves host names, only match addresses
+		b.WriteString("  if (/^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host) &&\n")
+		b.WriteString("    (" + strings.Join(networks, " ||\n    ") + ")) {\n    return proxy;\n  }\n")
+	}
+	b.WriteString("  return \"DIRECT\";\n}\n")
+	return b.String()
+}
+
+// servePAC answers requests for the PAC file, the proxy address is the address the client
+// reached the listener with
+func (p *Proxy) servePAC(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write([]byte(p.PAC(r.Host)))
+}
@@ -0,0 +1,56 @@
+package http
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPAC(t *testing.T) {
+	p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("pod"))
+	}))
+	_, network, _ := net.ParseCIDR("10.96.0.0/12")
+	p.Parser().CIDRs = []*net.IPNet{network}
+	p.Parser().Aliases = map[string]string{"orders.dev": "orders.shop.svc.cluster.local"}
+
+	front := httptest.NewServer(p.Handler(http.NotFoundHandler()))
+	defer front.Close()
+
+	resp, err := http.Get(front.URL + "/proxy.pac")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ns-proxy-autoconfig" {
+		t.Errorf("unexpected content type %s", ct)
+	}
+	script := string(body)
+	for _, expected := range []string{
+		`var proxy = "PROXY ` + strings.TrimPrefix(front.URL, "http://") + `";`,
+		`dnsDomainIs(host, ".cluster.local")`,
+		`host == "orders.dev"`,
+		`isInNet(host, "10.96.0.0", "255.240.0.0")`,
+		`return "DIRECT";`,
+	} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("expected %s in PAC file:\n%s", expected, script)
+		}
+	}
+
+	// requests to the cluster network are sent to the pod
+	client := newTestClient(t, p)
+	resp, err = client.Get("http://10.96.0.10:8080/")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "pod" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
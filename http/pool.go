@@ -0,0 +1,183 @@
+package http
+
+import (
+	"fmt"
+	log "github.com/go-pkgz/lgr"
+	"github.com/tipok/kubeproxy/k8s"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/tools/portforward"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// connPool keeps one SPDY connection per pod, all port-forward streams to that pod are
+// multiplexed over it. Connections are dropped from the pool as soon as they are closed.
+type connPool struct {
+	dial  func(tp *k8s.TargetPod) (httpstream.Connection, error)
+	lock  sync.Mutex
+	conns map[string]httpstream.Connection
+	// streams counts the open streams per connection
+	streams map[httpstream.Connection]int
+	// flushed connections are closed with their last stream
+	flushed map[httpstream.Connection]bool
+}
+
+// PooledConnection is a pooled connection to the port-forward API of a pod
+type PooledConnection struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Streams   int    `json:"streams"`
+}
+
+func newConnPool(k8sc *k8s.Api) *connPool {
+	return &connPool{dial: func(tp *k8s.TargetPod) (httpstream.Connection, error) {
+		dialer, err := k8sc.Dialer(tp)
+		if err != nil {
+			return nil, fmt.Errorf("could not create dialer: %w", err)
+		}
+		con, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+		if err != nil {
+			return nil, fmt.Errorf("could not dial: %w", err)
+		}
+		return con, nil
+	}, conns: map[string]httpstream.Connection{}}
+}
+
+func poolKey(tp *k8s.TargetPod) string {
+	return fmt.Sprintf("%s/%s", tp.Namespace, tp.Name)
+}
+
+func (cp *connPool) get(tp *k8s.TargetPod) (httpstream.Connection, error) {
+	key := poolKey(tp)
+	cp.lock.Lock()
+	con, ok := cp.conns[key]
+	cp.lock.Unlock()
+	if ok {
+		return con, nil
+	}
+
+	con, err := cp.dial(tp)
+	if err != nil {
+		return nil, err
+	}
+
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	if existing, ok := cp.conns[key]; ok {
+		// someone else was faster
+		if err := con.Close(); err != nil {
+			log.Printf("[DEBUG] error closing stream connection: %v", err)
+		}
+		return existing, nil
+	}
+	cp.conns[key] = con
+	go func() {
+		<-con.CloseChan()
+		cp.remove(tp, con)
+	}()
+	return con, nil
+}
+
+// remove removes con from the pool
+func (cp *connPool) remove(tp *k8s.TargetPod, con httpstream.Connection) {
+	key := poolKey(tp)
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	if cp.conns[key] == con {
+		delete(cp.conns, key)
+	}
+}
+
+// evict removes con from the pool and closes it
+func (cp *connPool) evict(tp *k8s.TargetPod, con httpstream.Connection) {
+	cp.remove(tp, con)
+	if err := con.Close(); err != nil {
+		log.Printf("[DEBUG] error closing stream connection: %v", err)
+	}
+}
+
+// acquire counts a stream opened on con
+func (cp *connPool) acquire(con httpstream.Connection) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	if cp.streams == nil {
+		cp.streams = map[httpstream.Connection]int{}
+	}
+	cp.streams[con]++
+}
+
+// release counts a closed stream of con
+func (cp *connPool) release(con httpstream.Connection) {
+	cp.lock.Lock()
+	cp.streams[con]--
+	last := cp.streams[con] <= 0
+	flushed := last && cp.flushed[con]
+	if last {
+		delete(cp.streams, con)
+		delete(cp.flushed, con)
+	}
+	cp.lock.Unlock()
+	if flushed {
+		if err := con.Close(); err != nil {
+			log.Printf("[DEBUG] error closing stream connection: %v", err)
+		}
+	}
+}
+
+// list returns the pooled connections
+func (cp *connPool) list() []PooledConnection {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	list := make([]PooledConnection, 0, len(cp.conns))
+	for key, con := range cp.conns {
+		ns, pod := key, ""
+		if i := strings.Index(key, "/"); i >= 0 {
+			ns, pod = key[:i], key[i+1:]
+		}
+		list = append(list, PooledConnection{Namespace: ns, Pod: pod, Streams: cp.streams[con]})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Namespace+"/"+list[i].Pod < list[j].Namespace+"/"+list[j].Pod
+	})
+	return list
+}
+
+// flush removes all connections from the pool, new streams get new connections. Connections
+// without streams are closed, the others when their last stream is closed.
+func (cp *connPool) flush() int {
+	cp.lock.Lock()
+	conns := cp.conns
+	cp.conns = map[string]httpstream.Connection{}
+	var idle []httpstream.Connection
+	for _, con := range conns {
+		if cp.streams[con] > 0 {
+			if cp.flushed == nil {
+				cp.flushed = map[httpstream.Connection]bool{}
+			}
+			cp.flushed[con] = true
+			continue
+		}
+		idle = append(idle, con)
+	}
+	cp.lock.Unlock()
+	for _, con := range idle {
+		if err := con.Close(); err != nil {
+			log.Printf("[DEBUG] error closing stream connection: %v", err)
+		}
+	}
+	return len(conns)
+}
+
+// Close closes all pooled connections
+func (cp *connPool) Close() {
+	cp.lock.Lock()
+	conns := cp.conns
+	cp.conns = map[string]httpstream.Connection{}
+	cp.lock.Unlock()
+	for _, con := range conns {
+		if err := con.Close(); err != nil {
+			log.Printf("[DEBUG] error closing stream connection: %v", err)
+		}
+	}
+}
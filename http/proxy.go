@@ -1,30 +1,80 @@
 package http
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/elazarl/goproxy"
 	log "github.com/go-pkgz/lgr"
 	"github.com/tipok/kubeproxy/k8s"
 	"io"
-	"io/ioutil"
-	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/httpstream"
 	"k8s.io/apimachinery/pkg/util/runtime"
-	"k8s.io/client-go/tools/portforward"
 	"net"
 	"net/http"
-	"net/http/httputil"
-	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+// ErrNoCluster is returned for cluster hosts if the proxy has no connection to the cluster
+var ErrNoCluster = errors.New("not connected to a cluster")
+
+// resolver looks up the pods serving cluster hosts
+type resolver interface {
+	GetMatchingPod(ctx context.Context, namespace, podName, port string) (*k8s.TargetPod, error)
+	GetMatchingPodForService(ctx context.Context, namespace, serviceName, port string) (*k8s.TargetPod, error)
+	ListServices(ctx context.Context, namespace string) ([]*k8s.Service, error)
+	WatchServices(ctx context.Context, namespace string) (<-chan k8s.ServiceEvent, error)
+	GetService(ctx context.Context, namespace, serviceName string) (*k8s.Service, error)
+	GetPodPorts(ctx context.Context, namespace, podName string) (*k8s.Service, error)
+	GetMatchingPodForIP(ctx context.Context, ip, port string) (*k8s.TargetPod, error)
+	GetSecretValue(ctx context.Context, namespace, secretName, key string) (string, error)
+	Ping(ctx context.Context) error
+}
+
 type Proxy struct {
-	k8sc          *k8s.Api
+	k8sc          resolver
 	requestID     int
 	requestIDLock sync.Mutex
 	parser        *Parser
+	conns         *connPool
+	transport     *Transport
+
+	// GRPCWeb enables translating grpc-web requests of browsers to gRPC
+	GRPCWeb bool
+	// UpstreamTLS is used for TLS connections to pods of intercepted requests
+	UpstreamTLS *tls.Config
+	// Users are required to authenticate with Proxy-Authorization if set
+	Users *Htpasswd
+	// ACL restricts the cluster hosts which may be accessed if set
+	ACL *AccessList
+	// Safe restricts the requests to namespaces in safe mode if set
+	Safe *SafeMode
+	// Headers rewrites the headers of requests and responses if set
+	Headers *HeaderRewriter
+	// Recorder stores the requests to cluster hosts and their responses if set
+	Recorder *Recorder
+	// Replay answers requests to cluster hosts with recorded responses if set
+	Replay *Replayer
+	// AccessLog writes an entry per request and tunnel to cluster hosts if set
+	AccessLog *AccessLog
+	// Metrics collects the metrics of requests and tunnels to cluster hosts if set
+	Metrics *Metrics
+	// Tracer creates spans for requests to cluster hosts if set
+	Tracer *Tracer
+	// Health answers the liveness and readiness probes on the admin API if set
+	Health *Health
+	// Timeouts limit resolving, dialing, waiting for responses and tunnels if set
+	Timeouts *TimeoutPolicy
+	// capture records requests to cluster hosts while it is set
+	captureLock sync.Mutex
+	capture     *Capture
+	// mitmPorts are the ports of cluster hosts CONNECT tunnels are intercepted for
+	mitmPorts map[string]bool
+	// active are the requests and tunnels in flight
+	active registry
 }
 
 func (p *Proxy) nextRequestID() int {
@@ -35,86 +85,111 @@ func (p *Proxy) nextRequestID() int {
 	return id
 }
 
-func NewProxy(k8sc *k8s.Api) *Proxy {
-	return &Proxy{k8sc: k8sc, requestID: 0, parser: &Parser{
-		ClusterDomain: "cluster.local",
-	}}
+func NewProxy(k8sc *k8s.Api, clusterDomain string) *Proxy {
+	p := &Proxy{requestID: 0, parser: &Parser{
+		ClusterDomain: clusterDomain,
+	}, conns: newConnPool(k8sc)}
+	// without a cluster, e.g. when replaying recordings, cluster hosts can't be resolved
+	if k8sc != nil {
+		p.k8sc = k8sc
+	}
+	p.transport = newTransport(p)
+	return p
+}
+
+// Parser returns the parser recognizing cluster hosts, aliases and cluster networks can be
+// configured on it before the proxy is used
+func (p *Proxy) Parser() *Parser {
+	return p.parser
 }
 
-func (p *Proxy) handleRequest(req *http.Request, tp *k8s.TargetPod, streamConn httpstream.Connection) (*http.Request, *http.Response, error) {
+// ClusterRequest is a goproxy condition matching requests to cluster hosts
+func (p *Proxy) ClusterRequest() goproxy.ReqConditionFunc {
+	return func(r *http.Request, _ *goproxy.ProxyCtx) bool {
+		return p.isClusterHost(r.Host)
+	}
+}
 
-	requestID := p.nextRequestID()
+// Transport returns the http.RoundTripper used for requests to cluster hosts
+func (p *Proxy) Transport() http.RoundTripper {
+	return p.transport
+}
 
-	// create error stream
-	headers := http.Header{}
-	headers.Set(v1.StreamType, v1.StreamTypeError)
-	headers.Set(v1.PortHeader, tp.Port)
-	headers.Set(v1.PortForwardRequestIDHeader, strconv.Itoa(requestID))
-	errorStream, err := streamConn.CreateStream(headers)
+// dialPod opens a port-forward stream to tp, reusing the pooled connection to the pod
+func (p *Proxy) dialPod(tp *k8s.TargetPod) (net.Conn, error) {
+	con, err := p.conns.get(tp)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error creating error stream for pod %s -> %s: %v", tp.Name, tp.Port, err)
+		p.Metrics.dialFailed(tp.Namespace)
+		return nil, err
 	}
-	// we're not writing to this stream
-	err = errorStream.Close()
-	if err != nil {
-		log.Printf("[DEBUG] error closing error stream for pod %s -> %s: %v", tp.Name, tp.Port, err)
+	c, err := p.openStream(con, tp)
+	if err == nil {
+		return c, nil
 	}
 
-	errorChan := make(chan error)
-	go func() {
-		message, err := ioutil.ReadAll(errorStream)
-		switch {
-		case err != nil:
-			errorChan <- fmt.Errorf("error reading from error stream for pod %s -> %s: %v", tp.Name, tp.Port, err)
-		case len(message) > 0:
-			errorChan <- fmt.Errorf("an error occurred forwarding on pod %s -> %s: %v", tp.Name, tp.Port, string(message))
-		}
-		close(errorChan)
-	}()
+	// the pooled connection might be stale, retry once on a fresh one
+	log.Printf("[DEBUG] retrying with new connection: %v", err)
+	p.conns.evict(tp, con)
+	con, err = p.conns.get(tp)
+	if err != nil {
+		p.Metrics.dialFailed(tp.Namespace)
+		return nil, err
+	}
+	return p.openStream(con, tp)
+}
 
-	// create data stream
-	headers.Set(v1.StreamType, v1.StreamTypeData)
-	dataStream, err := streamConn.CreateStream(headers)
+// openStream opens a port-forward stream on the pooled connection con
+func (p *Proxy) openStream(con httpstream.Connection, tp *k8s.TargetPod) (net.Conn, error) {
+	// counted before, so the connection isn't closed by a flush meanwhile
+	p.conns.acquire(con)
+	c, err := newStreamConn(con, tp, p.nextRequestID(), func() { p.Metrics.errorStreamError(tp.Namespace) })
 	if err != nil {
-		return nil, nil, fmt.Errorf("error creating forwarding stream for pod %s -> %s: %v", tp.Name, tp.Port, err)
+		p.conns.release(con)
+		return nil, err
 	}
+	c.onClose = func() { p.conns.release(con) }
+	return c, nil
+}
+
+func (p *Proxy) handleConnection(conn net.Conn, upstream io.ReadWriteCloser) {
+	defer func() {
+		err := conn.Close()
+		if err != nil {
+			log.Printf("[DEBUG] could not close connection: %v", err)
+		}
+		err = upstream.Close()
+		if err != nil {
+			log.Printf("[DEBUG] could not close upstream connection: %v", err)
+		}
+	}()
 
 	localError := make(chan struct{})
 	remoteDone := make(chan struct{})
 
-	var resp *http.Response
 	go func() {
 		// Copy from the remote side to the local port.
-		reader := bufio.NewReader(dataStream)
-		resp, err = http.ReadResponse(reader, req)
-		if err != nil {
+		if _, err := io.Copy(conn, upstream); err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
 			runtime.HandleError(fmt.Errorf("error copying from remote stream to local connection: %v", err))
 		}
 
+		// inform the select below that the remote copy is done
 		close(remoteDone)
 	}()
 
 	go func() {
-		// inform server we're not sending any more data after copy unblocks
-		defer func() {
-			err := dataStream.Close()
-			if err != nil {
-				log.Printf("[DEBUG] error closing data stream: %v", err)
-			}
-		}()
-
 		// Copy from the local port to the remote side.
-		reqBytes, err := httputil.DumpRequestOut(req, false)
-		if err != nil {
-			runtime.HandleError(fmt.Errorf("error dumping request: %v", err))
-		}
-		if _, err := dataStream.Write(reqBytes); err != nil {
-			runtime.HandleError(fmt.Errorf("error copying request: %v", err))
-		}
-		if _, err := io.Copy(dataStream, req.Body); err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+		if _, err := io.Copy(upstream, conn); err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
 			runtime.HandleError(fmt.Errorf("error copying from local connection to remote stream: %v", err))
 			// break out of the select below without waiting for the other copy to finish
 			close(localError)
+			return
+		}
+
+		// inform server we're not sending any more data after copy unblocks
+		if cw, ok := upstream.(interface{ CloseWrite() error }); ok {
+			if err := cw.CloseWrite(); err != nil {
+				log.Printf("[DEBUG] error closing data stream: %v", err)
+			}
 		}
 	}()
 
@@ -123,181 +198,358 @@ func (p *Proxy) handleRequest(req *http.Request, tp *k8s.TargetPod, streamConn h
 	case <-remoteDone:
 	case <-localError:
 	}
-
-	// always expect something on errorChan (it may be nil)
-	err = <-errorChan
-	if err != nil {
-		runtime.HandleError(err)
-		err := streamConn.Close()
-		if err != nil {
-			log.Printf("[DEBUG] error closing stream connection: %v", err)
-		}
-		return nil, nil, err
-	}
-
-	return req, resp, nil
 }
 
-func (p *Proxy) handleConnection(conn net.Conn, tp *k8s.TargetPod, streamConn httpstream.Connection) {
-	defer func() {
-		err := conn.Close()
-		if err != nil {
-			log.Printf("[DEBUG] could not close connection: %v", err)
-		}
-	}()
-
-	requestID := p.nextRequestID()
+func (p *Proxy) getTargetPod(r *http.Request) (*k8s.TargetPod, error) {
+	return p.resolve(r.Context(), r.Host, r.URL.Scheme == "https")
+}
 
-	// create error stream
-	headers := http.Header{}
-	headers.Set(v1.StreamType, v1.StreamTypeError)
-	headers.Set(v1.PortHeader, tp.Port)
-	headers.Set(v1.PortForwardRequestIDHeader, strconv.Itoa(requestID))
-	errorStream, err := streamConn.CreateStream(headers)
+// resolveTunnel looks up the pod serving the cluster host of a tunnel, which is refused with a
+// SafeModeError if the namespace is in safe mode
+func (p *Proxy) resolveTunnel(ctx context.Context, host string) (*k8s.TargetPod, error) {
+	h, err := p.parser.ParseHost(host, false)
 	if err != nil {
-		runtime.HandleError(fmt.Errorf("error creating error stream for pod %s -> %s: %v", tp.Name, tp.Port, err))
-		return
+		return nil, fmt.Errorf("could not parse host %w", err)
 	}
-	// we're not writing to this stream
-	err = errorStream.Close()
+	tp, err := p.resolve(ctx, host, false)
 	if err != nil {
-		log.Printf("[DEBUG] error on closing error stream: %v", err)
+		return nil, err
+	}
+	if err := p.Safe.checkTunnel(tp.Namespace, h.Port); err != nil {
+		return nil, err
 	}
+	return tp, nil
+}
 
-	errorChan := make(chan error)
+// tunnel copies between the client and the pod until either side closes the connection
+func (p *Proxy) tunnel(kind string, client net.Conn, upstream io.ReadWriteCloser, e *accessEntry) {
+	p.Metrics.tunnelOpened(kind)
+	defer p.Metrics.tunnelClosed(kind)
+	e.setCloser(func() {
+		_ = client.Close()
+		_ = upstream.Close()
+	})
+	done, watched := make(chan struct{}), make(chan struct{})
 	go func() {
-		message, err := ioutil.ReadAll(errorStream)
-		switch {
-		case err != nil:
-			errorChan <- fmt.Errorf("error reading from error stream for pod %s -> %s: %v", tp.Name, tp.Port, err)
-		case len(message) > 0:
-			errorChan <- fmt.Errorf("an error occurred forwarding on pod %s -> %s: %v", tp.Name, tp.Port, string(message))
-		}
-		close(errorChan)
+		p.watchTunnel(e, e.timeouts, done)
+		close(watched)
 	}()
+	p.handleConnection(e.countConn(client), upstream)
+	close(done)
+	<-watched
+}
 
-	// create data stream
-	headers.Set(v1.StreamType, v1.StreamTypeData)
-	dataStream, err := streamConn.CreateStream(headers)
+// dialTunnel resolves the pod of host for a tunnel and connects to it
+func (p *Proxy) dialTunnel(ctx context.Context, host string, e *accessEntry) (net.Conn, error) {
+	start := time.Now()
+	tp, err := p.resolveTunnel(ctx, host)
 	if err != nil {
-		runtime.HandleError(fmt.Errorf("error creating forwarding stream for pod %s -> %s: %v", tp.Name, tp.Port, err))
-		return
+		e.fail(errorClass(err))
+		return nil, err
 	}
-
-	localError := make(chan struct{})
-	remoteDone := make(chan struct{})
-
-	go func() {
-		// Copy from the remote side to the local port.
-		if _, err := io.Copy(conn, dataStream); err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
-			runtime.HandleError(fmt.Errorf("error copying from remote stream to local connection: %v", err))
-		}
-
-		// inform the select below that the remote copy is done
-		close(remoteDone)
-	}()
-
-	go func() {
-		// inform server we're not sending any more data after copy unblocks
-		defer func() {
-			err := dataStream.Close()
-			if err != nil {
-				log.Printf("[DEBUG] error closing data stream: %v", err)
-			}
-		}()
-
-		// Copy from the local port to the remote side.
-		if _, err := io.Copy(dataStream, conn); err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
-			runtime.HandleError(fmt.Errorf("error copying from local connection to remote stream: %v", err))
-			// break out of the select below without waiting for the other copy to finish
-			close(localError)
+	e.resolved(tp, start)
+	start = time.Now()
+	e.timeouts = p.hostTimeouts(host, false)
+	upstream, err := p.dialPodWithin(tp, e.timeouts.Dial)
+	if err != nil {
+		var timeout *TimeoutError
+		if errors.As(err, &timeout) {
+			e.fail(timeout.class())
+		} else {
+			e.fail(errorDial)
 		}
-	}()
-
-	// wait for either a local->remote error or for copying from remote->local to finish
-	select {
-	case <-remoteDone:
-	case <-localError:
+		return nil, err
 	}
+	e.dialed(start)
+	return upstream, nil
+}
 
-	// always expect something on errorChan (it may be nil)
-	err = <-errorChan
+// checkSafe refuses unsafe requests to namespaces in safe mode, upgraded connections are
+// treated as tunnels
+func (p *Proxy) checkSafe(r *http.Request, tp *k8s.TargetPod) error {
+	if err := p.Safe.checkMethod(tp.Namespace, r.Method); err != nil {
+		return err
+	}
+	if r.Header.Get("Upgrade") == "" {
+		return nil
+	}
+	h, err := p.parser.ParseHost(r.Host, r.URL.Scheme == "https")
 	if err != nil {
-		runtime.HandleError(err)
-		err := streamConn.Close()
-		if err != nil {
-			log.Printf("[DEBUG] error closing stream connection: %v", err)
-		}
+		return err
 	}
+	return p.Safe.checkTunnel(tp.Namespace, h.Port)
 }
 
-func (p *Proxy) getTargetPod(r *http.Request) (*k8s.TargetPod, error) {
-	h, err := p.parser.ParseHost(r.Host, r.URL.Scheme == "https")
+// resolve looks up the pod serving the cluster host
+func (p *Proxy) resolve(ctx context.Context, host string, https bool) (*k8s.TargetPod, error) {
+	if p.k8sc == nil {
+		return nil, ErrNoCluster
+	}
+	h, err := p.parser.ParseHost(host, https)
 	if err != nil {
 		return nil, fmt.Errorf("could not parse host %w", err)
 	}
-	if h.Type == "pod" {
-		return p.k8sc.GetMatchingPod(r.Context(), h.Namespace, h.Name, h.Port)
+	if err := h.checkType(); err != nil {
+		return nil, err
 	}
-	return p.k8sc.GetMatchingPodForService(r.Context(), h.Namespace, h.Name, h.Port)
+	if err := p.ACL.check(h); err != nil {
+		return nil, err
+	}
+	var tp *k8s.TargetPod
+	err = withTimeout(ctx, phaseResolve, p.Timeouts.timeouts(h).Resolve, func(ctx context.Context) (err error) {
+		switch h.Type {
+		case "pod":
+			tp, err = p.k8sc.GetMatchingPod(ctx, h.Namespace, h.Name, h.Port)
+		case "ip":
+			tp, err = p.k8sc.GetMatchingPodForIP(ctx, h.Name, h.Port)
+		case "svc":
+			tp, err = p.k8sc.GetMatchingPodForService(ctx, h.Namespace, h.Name, h.Port)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if h.Type == "ip" {
+		// the namespace of addresses is only known after the lookup
+		if err := p.ACL.check(&Host{Name: tp.Name, Namespace: tp.Namespace, Type: "pod", Port: h.Port, K8s: true}); err != nil {
+			return nil, err
+		}
+	}
+	return tp, nil
 }
 
 func (p *Proxy) Do(r *http.Request, _ *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	r, resp, e := p.doRequest(r)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// goproxy doesn't hand over upgraded connections
+		e.finish()
+	}
+	return r, resp
+}
+
+// doRequest sends r to its cluster host, the entry of upgraded connections has to be finished
+// by the caller, e.g. with tunnel
+func (p *Proxy) doRequest(r *http.Request) (*http.Request, *http.Response, *accessEntry) {
+	e := p.begin(kindHTTP, r.RemoteAddr, r.Method, r.Host)
+	r, span := p.Tracer.startRequest(r)
+	r, resp := p.do(r, e)
+	e.finishResponse(resp)
+	span.finishResponse(resp)
+	return r, resp, e
+}
+
+func (p *Proxy) do(r *http.Request, e *accessEntry) (*http.Request, *http.Response) {
+	if p.GRPCWeb && isGRPCWebPreflight(r) {
+		return r, grpcWebPreflightResponse(r)
+	}
+
+	if p.Replay != nil {
+		if err := p.checkReplay(r); err != nil {
+			log.Printf("[INFO] %v", err)
+			e.fail(errorClass(err))
+			return r, refusal(r, err)
+		}
+		resp, err := p.Replay.replay(r)
+		if err != nil {
+			log.Printf("[ERROR] could not replay request to %s: %v", r.Host, err)
+			e.fail(errorReplay)
+			return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusBadGateway, "Cannot replay request")
+		}
+		if resp != nil {
+			return r, resp
+		}
+		if p.Replay.Strict {
+			log.Printf("[ERROR] no recording of %s %s%s", r.Method, r.Host, r.URL.RequestURI())
+			e.fail(errorReplay)
+			return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusBadGateway, "No recorded response")
+		}
+	}
+
+	start := time.Now()
+	resolve := startSpan(r.Context(), "resolve", spanInternal)
 	tp, err := p.getTargetPod(r)
+	resolved := time.Now()
+	if err == nil {
+		e.resolved(tp, start)
+		resolve.setPod(tp)
+		err = p.checkSafe(r, tp)
+	}
+	resolve.finish(err)
 	if err != nil {
 		log.Printf("[INFO] could not get pod %v", err)
-		return r, nil
+		e.fail(errorClass(err))
+		return r, refusal(r, err)
 	}
 
-	dialer, err := p.k8sc.Dialer(tp)
-	if err != nil {
-		log.Printf("[ERROR] could not create dialer: %v", err)
-		return r, nil
+	record := p.Recorder.record(r)
+	grpcWeb := p.GRPCWeb && isGRPCWebRequest(r)
+	out := r
+	if grpcWeb {
+		out = newGRPCWebRequest(r)
 	}
-
-	con, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
-	if err != nil {
-		log.Printf("[ERROR] could not dial: %v", err)
-		return r, nil
+	// captures get the headers as sent by the client, rewritten values might be credentials
+	capture := p.activeCapture()
+	var sent http.Header
+	if capture != nil {
+		sent = out.Header.Clone()
+	}
+	var target *HeaderTarget
+	if p.Headers != nil {
+		target = p.newHeaderTarget(r, tp)
+		if err := p.Headers.rewrite(target, out.Header, false); err != nil {
+			log.Printf("[ERROR] could not rewrite request headers for %s: %v", r.Host, err)
+			e.fail(errorHeaders)
+			return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusBadGateway, "Cannot rewrite headers")
+		}
 	}
-	r, resp, err := p.handleRequest(r, tp, con)
+
+	rec := capture.begin(out, sent, p.Headers.rewritten(target, false), tp, start, resolved)
+	rec.requestBody(out)
+	e.countRequest(out)
+	// upgraded connections are tunnels with the timeouts of the host
+	e.timeouts = p.hostTimeouts(r.Host, r.URL.Scheme == "https")
+	out = withTimeouts(out, e.timeouts)
+
+	upstream := startSpan(out.Context(), "upstream", spanClient)
+	upstream.inject(out.Header)
+	resp, err := p.transport.roundTrip(traceDial(e.trace(out)), tp)
 	if err != nil {
-		log.Printf("[ERROR] could not dial: %v", err)
-		return r, nil
+		upstream.finish(err)
+		rec.response(nil, err, nil)
+		e.failRoundTrip(err)
+		log.Printf("[ERROR] could not forward request to pod %s: %v", tp.Name, err)
+		return r, errorResponse(r, err)
 	}
 
+	upstream.finishResponse(resp)
+	if grpcWeb {
+		resp = newGRPCWebResponse(r, resp)
+	}
+	if err := p.Headers.rewrite(target, resp.Header, true); err != nil {
+		log.Printf("[ERROR] could not rewrite response headers for %s: %v", r.Host, err)
+		e.fail(errorHeaders)
+		_ = resp.Body.Close()
+		return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusBadGateway, "Cannot rewrite headers")
+	}
+	// values of rewritten headers might be credentials
+	rewritten := p.Headers.rewritten(target, true)
+	record(resp, rewritten)
+	rec.response(resp, nil, rewritten)
 	return r, resp
 }
 
-func (p *Proxy) HijackConnect(r *http.Request, client net.Conn, _ *goproxy.ProxyCtx) {
-	tp, err := p.getTargetPod(r)
+// checkReplay applies the access list and safe mode to requests before they are answered with
+// recordings, the pod is not looked up so addresses are only checked by the access list
+func (p *Proxy) checkReplay(r *http.Request) error {
+	h, err := p.parser.ParseHost(r.Host, r.URL.Scheme == "https")
 	if err != nil {
-		log.Printf("[INFO] could not get pod %v", err)
-		_, err := client.Write([]byte("HTTP/1.1 500 Cannot reach destination\r\n\r\n"))
-		if err != nil {
-			log.Printf("[ERROR] could not write to client: %v", err)
-		}
-		return
+		return fmt.Errorf("could not parse host %w", err)
+	}
+	if err := h.checkType(); err != nil {
+		return err
+	}
+	if err := p.ACL.check(h); err != nil {
+		return err
 	}
+	if h.Type == "ip" {
+		return nil
+	}
+	return p.checkSafe(r, &k8s.TargetPod{Name: h.Name, Namespace: h.Namespace, Port: h.Port})
+}
 
-	dialer, err := p.k8sc.Dialer(tp)
-	if err != nil {
-		log.Printf("[ERROR] could not create dialer: %v", err)
-		_, err := client.Write([]byte("HTTP/1.1 500 Cannot reach destination\r\n\r\n"))
-		if err != nil {
-			log.Printf("[ERROR] could not write to client: %v", err)
+// refusal answers requests denied by the access list or safe mode with 403 Forbidden or 405
+// Method Not Allowed, other requests which could not be sent to the pod like errorResponse
+func refusal(r *http.Request, err error) *http.Response {
+	var denied *AccessDeniedError
+	if errors.As(err, &denied) {
+		return goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusForbidden, "Access denied")
+	}
+	var unsafe *SafeModeError
+	if errors.As(err, &unsafe) {
+		if unsafe.Method == "" {
+			return goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusForbidden, "Not permitted in safe mode")
 		}
-		return
+		resp := goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusMethodNotAllowed, "Not permitted in safe mode")
+		resp.Header.Set("Allow", strings.Join(safeMethods, ", "))
+		return resp
 	}
+	return errorResponse(r, err)
+}
 
-	con, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+// errorResponse answers requests which could not be forwarded to the pod, 504 Gateway Timeout
+// tells which timeout was hit
+func errorResponse(r *http.Request, err error) *http.Response {
+	var timeout *TimeoutError
+	if errors.As(err, &timeout) {
+		return goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusGatewayTimeout, timeout.reason())
+	}
+	return goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusBadGateway, "Cannot reach destination")
+}
+
+// AccessConnect rejects CONNECT requests to cluster hosts of unknown types, hosts denied by the
+// access list and tunnels not permitted in safe mode with 403 Forbidden, it has to be registered
+// before the handler accepting the tunnels
+func (p *Proxy) AccessConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	h, err := p.parser.ParseHost(host, true)
+	if err != nil || !h.K8s {
+		return nil, host
+	}
+	reason := "Unknown cluster host type"
+	err = h.checkType()
+	if err == nil {
+		reason = "Access denied"
+		err = p.ACL.check(h)
+	}
+	// the namespace of addresses is only known after the lookup, intercepted requests are
+	// checked like plain HTTP requests
+	if err == nil && h.Type != "ip" && !p.mitmPorts[h.Port] {
+		reason = "Not permitted in safe mode"
+		err = p.Safe.checkTunnel(h.Namespace, h.Port)
+	}
+	if err == nil {
+		return nil, host
+	}
+	log.Printf("[INFO] %v", err)
+	e := p.begin(kindConnect, ctx.Req.RemoteAddr, ctx.Req.Method, host)
+	e.setStatus(http.StatusForbidden)
+	e.fail(errorClass(err))
+	e.finish()
+	resp := goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusForbidden, reason)
+	resp.ProtoMajor, resp.ProtoMinor = 1, 1
+	ctx.Resp = resp
+	return goproxy.RejectConnect, host
+}
+
+// TunnelConnect tunnels CONNECT requests to cluster hosts to their pods. The pod is connected
+// before the CONNECT is answered, failures are answered like plain HTTP requests instead of
+// with 200 OK.
+func (p *Proxy) TunnelConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	r := ctx.Req
+	e := p.begin(kindConnect, r.RemoteAddr, r.Method, host)
+	upstream, err := p.dialTunnel(r.Context(), host, e)
 	if err != nil {
-		log.Printf("[ERROR] could not dial: %v", err)
-		_, err := client.Write([]byte("HTTP/1.1 500 Cannot reach destination\r\n\r\n"))
-		if err != nil {
-			log.Printf("[ERROR] could not write to client: %v", err)
-		}
-		return
+		log.Printf("[INFO] could not connect to %s: %v", host, err)
+		resp := refusal(r, err)
+		resp.ProtoMajor, resp.ProtoMinor = 1, 1
+		e.setStatus(resp.StatusCode)
+		e.finish()
+		ctx.Resp = resp
+		return goproxy.RejectConnect, host
 	}
-	p.handleConnection(client, tp, con)
+	// goproxy answers with 200 OK before the connection is hijacked
+	e.setStatus(http.StatusOK)
+	return &goproxy.ConnectAction{
+		Action: goproxy.ConnectHijack,
+		Hijack: func(_ *http.Request, client net.Conn, _ *goproxy.ProxyCtx) {
+			defer e.finish()
+			p.tunnel(kindConnect, client, upstream, e)
+		},
+	}, host
+}
+
+// Close closes all idle upstream connections and pooled connections to pods
+func (p *Proxy) Close() {
+	p.transport.CloseIdleConnections()
+	p.conns.Close()
 }
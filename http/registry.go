@@ -0,0 +1,179 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrUnknownConnection is returned for connections which are not active
+var ErrUnknownConnection = errors.New("no such connection")
+
+// ErrNotTunnel is returned when closing a request, only tunnels can be closed
+var ErrNotTunnel = errors.New("not a tunnel")
+
+// ConnectionInfo describes a request or tunnel in flight
+type ConnectionInfo struct {
+	ID     uint64 `json:"id"`
+	Kind   string `json:"kind"`
+	Client string `json:"client"`
+	Method string `json:"method,omitempty"`
+	Host   string `json:"host"`
+	// Service is set for hosts of services
+	Service string `json:"service,omitempty"`
+	// Namespace, Pod and Port are set once the pod is resolved
+	Namespace string    `json:"namespace,omitempty"`
+	Pod       string    `json:"pod,omitempty"`
+	Port      string    `json:"port,omitempty"`
+	Started   time.Time `json:"started"`
+	Age       float64   `json:"ageSeconds"`
+	BytesIn   int64     `json:"bytesIn"`
+	BytesOut  int64     `json:"bytesOut"`
+}
+
+// registry keeps track of the requests and tunnels in flight, the zero value is ready to use
+type registry struct {
+	lock    sync.Mutex
+	next    uint64
+	entries map[uint64]*accessEntry
+	// idle are closed once there are no entries
+	idle []chan struct{}
+}
+
+func (r *registry) add(e *accessEntry) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.entries == nil {
+		r.entries = map[uint64]*accessEntry{}
+	}
+	r.next++
+	e.id = r.next
+	r.entries[e.id] = e
+}
+
+func (r *registry) remove(e *accessEntry) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.entries, e.id)
+	if len(r.entries) == 0 {
+		for _, idle := range r.idle {
+			close(idle)
+		}
+		r.idle = nil
+	}
+}
+
+// empty returns a channel which is closed once there are no entries
+func (r *registry) empty() <-chan struct{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	idle := make(chan struct{})
+	if len(r.entries) == 0 {
+		close(idle)
+		return idle
+	}
+	r.idle = append(r.idle, idle)
+	return idle
+}
+
+func (r *registry) get(id uint64) *accessEntry {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.entries[id]
+}
+
+func (r *registry) all() []*accessEntry {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entries := make([]*accessEntry, 0, len(r.entries))
+	for _, e := range r.entries {
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func (r *registry) list() []ConnectionInfo {
+	entries := r.all()
+	list := make([]ConnectionInfo, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e.info())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// info returns the current state of the entry
+func (e *accessEntry) info() ConnectionInfo {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return ConnectionInfo{
+		ID:        e.id,
+		Kind:      e.Kind,
+		Client:    e.Client,
+		Method:    e.Method,
+		Host:      e.Host,
+		Service:   e.service,
+		Namespace: e.Namespace,
+		Pod:       e.Pod,
+		Port:      e.Port,
+		Started:   e.start,
+		Age:       time.Since(e.start).Seconds(),
+		BytesIn:   atomic.LoadInt64(&e.bytesIn),
+		BytesOut:  atomic.LoadInt64(&e.bytesOut),
+	}
+}
+
+// setCloser sets the function closing the tunnel of the entry
+func (e *accessEntry) setCloser(closer func()) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.closer = closer
+}
+
+// Connections returns the requests and tunnels in flight
+func (p *Proxy) Connections() []ConnectionInfo {
+	return p.active.list()
+}
+
+// CloseConnection closes both sides of the tunnel with the id
+func (p *Proxy) CloseConnection(id uint64) (ConnectionInfo, error) {
+	e := p.active.get(id)
+	if e == nil {
+		return ConnectionInfo{}, ErrUnknownConnection
+	}
+	e.lock.Lock()
+	closer := e.closer
+	e.lock.Unlock()
+	if closer == nil {
+		return e.info(), ErrNotTunnel
+	}
+	closer()
+	return e.info(), nil
+}
+
+// Drain waits until the requests and tunnels in flight are finished or ctx is done, then it
+// closes the tunnels left. It returns how many requests and tunnels were left.
+func (p *Proxy) Drain(ctx context.Context) int {
+	select {
+	case <-p.active.empty():
+		return 0
+	case <-ctx.Done():
+	}
+	left := p.active.all()
+	for _, e := range left {
+		e.lock.Lock()
+		closer := e.closer
+		e.lock.Unlock()
+		// requests fail once the pooled connections are closed
+		if closer != nil {
+			closer()
+		}
+	}
+	return len(left)
+}
@@ -0,0 +1,50 @@
+package http
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("pod"))
+	}))
+	if n := p.Drain(context.Background()); n != 0 {
+		t.Fatalf("expected nothing to drain, got %d", n)
+	}
+
+	// tunnels closed by their clients are drained
+	conn, _ := openTunnel(t, p)
+	drained := make(chan int)
+	go func() { drained <- p.Drain(context.Background()) }()
+	select {
+	case n := <-drained:
+		t.Fatalf("drained %d connections with an open tunnel", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.Close()
+	select {
+	case n := <-drained:
+		if n != 0 {
+			t.Errorf("expected all tunnels to be finished, got %d", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel was not drained")
+	}
+
+	// tunnels still open after the timeout are closed
+	conn, r := openTunnel(t, p)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if n := p.Drain(ctx); n != 1 {
+		t.Errorf("expected 1 tunnel to be closed, got %d", n)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("expected tunnel to be closed, got %v", err)
+	}
+}
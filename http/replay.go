@@ -0,0 +1,352 @@
+package http
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/go-pkgz/lgr"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ReplayMatch selects the parts of requests which have to be equal to the recorded request,
+// the host always has to match
+type ReplayMatch struct {
+	Method bool
+	Path   bool
+	Query  bool
+	// Body compares the SHA-256 of the bodies
+	Body    bool
+	Headers []string
+}
+
+// ParseReplayMatch parses the fields method, path, query, body and header:<name>
+func ParseReplayMatch(fields []string) (ReplayMatch, error) {
+	var m ReplayMatch
+	for _, f := range fields {
+		switch f = strings.TrimSpace(f); {
+		case f == "method":
+			m.Method = true
+		case f == "path":
+			m.Path = true
+		case f == "query":
+			m.Query = true
+		case f == "body":
+			m.Body = true
+		case strings.HasPrefix(f, "header:") && len(f) > len("header:"):
+			m.Headers = append(m.Headers, http.CanonicalHeaderKey(strings.TrimPrefix(f, "header:")))
+		default:
+			return m, fmt.Errorf("unknown match field %q, expected method, path, query, body or header:<name>", f)
+		}
+	}
+	return m, nil
+}
+
+// key identifies the requests matching r
+func (m ReplayMatch) key(r *recordedRequest) string {
+	parts := []string{strings.ToLower(r.Host)}
+	if m.Method {
+		parts = append(parts, r.Method)
+	}
+	if m.Path {
+		parts = append(parts, r.Path)
+	}
+	if m.Query {
+		parts = append(parts, canonicalQuery(r.Query))
+	}
+	if m.Body {
+		parts = append(parts, r.BodySHA256)
+	}
+	for _, h := range m.Headers {
+		parts = append(parts, h+"="+strings.Join(r.Headers.Values(h), ","))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// canonicalQuery sorts the parameters, their order doesn't matter
+func canonicalQuery(query string) string {
+	params := strings.Split(query, "&")
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// recording is a request to a cluster host and its response as stored on disk
+type recording struct {
+	Request  recordedRequest  `json:"request"`
+	Response recordedResponse `json:"response"`
+}
+
+type recordedRequest struct {
+	Method     string      `json:"method"`
+	Host       string      `json:"host"`
+	Path       string      `json:"path"`
+	Query      string      `json:"query,omitempty"`
+	Headers    http.Header `json:"headers"`
+	BodySHA256 string      `json:"bodySha256"`
+}
+
+type recordedResponse struct {
+	Status  int         `json:"status"`
+	Headers http.Header `json:"headers"`
+	Body    []byte      `json:"body"`
+}
+
+// newRecordedRequest describes r with header and the SHA-256 of the body, credentials are
+// removed from header
+func newRecordedRequest(r *http.Request, header http.Header, bodySHA256 string) recordedRequest {
+	headers := header.Clone()
+	for _, h := range DefaultRedactHeaders {
+		headers.Del(h)
+	}
+	return recordedRequest{
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+		Query:      r.URL.RawQuery,
+		Headers:    headers,
+		BodySHA256: bodySHA256,
+	}
+}
+
+// DefaultRecordMaxBody is the size of the largest response body recorded by default
+const DefaultRecordMaxBody = 10 << 20
+
+// Recorder stores the requests to cluster hosts and their responses in a directory, one file
+// per request. Credentials in Authorization and Cookie headers are not stored.
+type Recorder struct {
+	dir string
+	// MaxBodySize is the size of the largest response body recorded, responses are kept in
+	// memory until they are complete. There is no limit if it is 0.
+	MaxBodySize int64
+
+	lock sync.Mutex
+	seq  int
+}
+
+// NewRecorder records to dir, it is created if missing. Recordings already in dir are kept, new
+// ones are numbered after them.
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create recording directory: %w", err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	rec := &Recorder{dir: dir, MaxBodySize: DefaultRecordMaxBody}
+	for _, file := range files {
+		// the names start with the sequence number
+		seq, err := strconv.Atoi(strings.SplitN(filepath.Base(file), "-", 2)[0])
+		if err == nil && seq > rec.seq {
+			rec.seq = seq
+		}
+	}
+	return rec, nil
+}
+
+// unsafeFileChars are replaced in file names of recordings
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9.-]+`)
+
+// record reads the body of r while it is sent, the returned function records the response
+// without the headers in redact. Both are recorded as exchanged with the client, r has to be
+// passed before its headers are rewritten so replayed requests match. The recording is written
+// when the response body is closed.
+func (rec *Recorder) record(r *http.Request) func(resp *http.Response, redact []string) {
+	if rec == nil {
+		return func(*http.Response, []string) {}
+	}
+	header := r.Header.Clone()
+	// the request body might still be read while the response is
+	var lock sync.Mutex
+	reqHash := sha256.New()
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &capturedBody{ReadCloser: r.Body, read: func(b []byte) {
+			lock.Lock()
+			defer lock.Unlock()
+			reqHash.Write(b)
+		}}
+	}
+	return func(resp *http.Response, redact []string) {
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			return
+		}
+		respHeader := resp.Header.Clone()
+		for _, h := range redact {
+			respHeader.Del(h)
+		}
+		var respBody []byte
+		complete, truncated := false, false
+		resp.Body = &capturedBody{
+			ReadCloser: resp.Body,
+			read: func(b []byte) {
+				if !truncated {
+					respBody, truncated = appendLimited(respBody, b, rec.MaxBodySize)
+				}
+			},
+			eof: func() { complete = true },
+			close: func() {
+				if truncated {
+					log.Printf("[INFO] not recording %s%s, the response is larger than %d bytes", r.Host, r.URL.Path, rec.MaxBodySize)
+					return
+				}
+				if !complete {
+					log.Printf("[INFO] not recording %s%s, the response was not read completely", r.Host, r.URL.Path)
+					return
+				}
+				lock.Lock()
+				req := newRecordedRequest(r, header, hex.EncodeToString(reqHash.Sum(nil)))
+				lock.Unlock()
+				rec.write(&recording{
+					Request:  req,
+					Response: recordedResponse{Status: resp.StatusCode, Headers: respHeader, Body: respBody},
+				})
+			},
+		}
+	}
+}
+
+func (rec *Recorder) write(recording *recording) {
+	b, err := json.MarshalIndent(recording, "", "  ")
+	if err != nil {
+		log.Printf("[ERROR] could not encode recording: %v", err)
+		return
+	}
+	suffix := fmt.Sprintf("-%s-%s.json", recording.Request.Method,
+		unsafeFileChars.ReplaceAllString(recording.Request.Host+recording.Request.Path, "_"))
+	for {
+		rec.lock.Lock()
+		rec.seq++
+		seq := rec.seq
+		rec.lock.Unlock()
+		// recordings written by others to the same directory are never replaced
+		f, err := os.OpenFile(filepath.Join(rec.dir, fmt.Sprintf("%06d", seq)+suffix), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			log.Printf("[ERROR] could not write recording: %v", err)
+			return
+		}
+		_, err = f.Write(b)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			log.Printf("[ERROR] could not write recording: %v", err)
+		}
+		return
+	}
+}
+
+// Replayer answers requests to cluster hosts with recorded responses. Requests matching several
+// recordings get them in the recorded order, the last one is repeated.
+type Replayer struct {
+	match ReplayMatch
+	// Strict answers requests without recording with 502 Bad Gateway instead of sending them to
+	// the cluster
+	Strict bool
+
+	lock       sync.Mutex
+	recordings map[string][]*recording
+	next       map[string]int
+}
+
+// LoadReplayer loads the recordings in dir
+func LoadReplayer(dir string, match ReplayMatch) (*Replayer, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	// the names start with the sequence number
+	sort.Strings(files)
+	rp := &Replayer{match: match, recordings: map[string][]*recording{}, next: map[string]int{}}
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read recording: %w", err)
+		}
+		var r recording
+		if err := json.Unmarshal(b, &r); err != nil {
+			return nil, fmt.Errorf("invalid recording %s: %w", file, err)
+		}
+		key := match.key(&r.Request)
+		rp.recordings[key] = append(rp.recordings[key], &r)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recordings found in %s", dir)
+	}
+	log.Printf("[INFO] loaded %d recordings from %s", len(files), dir)
+	return rp, nil
+}
+
+// replay returns the recorded response for r, nil if there is none. Bodies larger than
+// DefaultRecordMaxBody don't match any recording if bodies are matched.
+func (rp *Replayer) replay(r *http.Request) (*http.Response, error) {
+	var body []byte
+	if rp.match.Body && r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, DefaultRecordMaxBody+1))
+		if err != nil {
+			return nil, fmt.Errorf("could not read request body: %w", err)
+		}
+		// the body is sent to the cluster if there is no recording, the rest is streamed
+		r.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+		if len(body) > DefaultRecordMaxBody {
+			return nil, nil
+		}
+	}
+	sum := sha256.Sum256(body)
+	req := newRecordedRequest(r, r.Header, hex.EncodeToString(sum[:]))
+	key := rp.match.key(&req)
+
+	rp.lock.Lock()
+	recordings := rp.recordings[key]
+	if len(recordings) == 0 {
+		rp.lock.Unlock()
+		return nil, nil
+	}
+	i := rp.next[key]
+	if i < len(recordings)-1 {
+		rp.next[key] = i + 1
+	}
+	rp.lock.Unlock()
+
+	recorded := recordings[i].Response
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded.Status, http.StatusText(recorded.Status)),
+		StatusCode:    recorded.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        recorded.Headers.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(recorded.Body)),
+		ContentLength: int64(len(recorded.Body)),
+		Request:       r,
+	}
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	// the recorded body is not chunked anymore
+	resp.Header.Del("Transfer-Encoding")
+	if r.Method != http.MethodHead {
+		resp.Header.Set("Content-Length", fmt.Sprint(len(recorded.Body)))
+	}
+	return resp, nil
+}
+
+// readCloser reads from Reader and closes Closer
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,185 @@
+package http
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseReplayMatch(t *testing.T) {
+	m, err := ParseReplayMatch([]string{"method", "body", "header:x-tenant-id"})
+	if err != nil {
+		t.Fatalf("could not parse match: %v", err)
+	}
+	if !m.Method || m.Path || !m.Body || len(m.Headers) != 1 || m.Headers[0] != "X-Tenant-Id" {
+		t.Errorf("unexpected match %+v", m)
+	}
+	for _, fields := range [][]string{{"cookie"}, {"header:"}} {
+		if _, err := ParseReplayMatch(fields); err == nil {
+			t.Errorf("expected %v to be refused", fields)
+		}
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	var calls int32
+	p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Call", string(rune('0'+n)))
+		_, _ = w.Write([]byte(r.Method + " " + r.URL.RequestURI() + " " + string(body)))
+	}))
+	dir := t.TempDir()
+	var err error
+	p.Recorder, err = NewRecorder(dir)
+	if err != nil {
+		t.Fatalf("could not create recorder: %v", err)
+	}
+
+	do := func(client *http.Client, method, url, body string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(b)
+	}
+
+	client := newTestClient(t, p)
+	do(client, http.MethodGet, "http://orders.shop.svc.cluster.local/orders?b=2&a=1", "")
+	do(client, http.MethodGet, "http://orders.shop.svc.cluster.local/orders?b=2&a=1", "")
+	do(client, http.MethodPost, "http://orders.shop.svc.cluster.local/orders", "first")
+	do(client, http.MethodPost, "http://orders.shop.svc.cluster.local/orders", "second")
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 4 {
+		t.Fatalf("expected 4 recordings, got %d", len(files))
+	}
+	b, _ := ioutil.ReadFile(files[0])
+	if strings.Contains(string(b), "Bearer token") {
+		t.Errorf("credentials were recorded")
+	}
+
+	match, _ := ParseReplayMatch([]string{"method", "path", "query", "body"})
+	replay, err := LoadReplayer(dir, match)
+	if err != nil {
+		t.Fatalf("could not load recordings: %v", err)
+	}
+	replay.Strict = true
+	p.Recorder = nil
+	p.Replay = replay
+	p.k8sc = nil
+	atomic.StoreInt32(&calls, 0)
+
+	t.Run("matching requests", func(t *testing.T) {
+		for _, tt := range []struct {
+			method, url, body, want, call string
+		}{
+			{http.MethodGet, "http://orders.shop.svc.cluster.local/orders?a=1&b=2", "", "GET /orders?b=2&a=1 ", "1"},
+			{http.MethodGet, "http://orders.shop.svc.cluster.local/orders?a=1&b=2", "", "GET /orders?b=2&a=1 ", "2"},
+			// the last recording is repeated
+			{http.MethodGet, "http://orders.shop.svc.cluster.local/orders?a=1&b=2", "", "GET /orders?b=2&a=1 ", "2"},
+			{http.MethodPost, "http://orders.shop.svc.cluster.local/orders", "second", "POST /orders second", "4"},
+		} {
+			resp, body := do(client, tt.method, tt.url, tt.body)
+			if resp.StatusCode != http.StatusOK || body != tt.want || resp.Header.Get("X-Call") != tt.call {
+				t.Errorf("%s %s: unexpected response %d %q, call %s", tt.method, tt.url, resp.StatusCode, body, resp.Header.Get("X-Call"))
+			}
+		}
+		if atomic.LoadInt32(&calls) != 0 {
+			t.Errorf("the pod was called while replaying")
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		resp, _ := do(client, http.MethodPost, "http://orders.shop.svc.cluster.local/orders", "third")
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("expected 502, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("access denied", func(t *testing.T) {
+		p.ACL, _ = NewAccessList("", []AccessRule{{Action: AccessDeny, Namespace: "shop"}})
+		defer func() { p.ACL = nil }()
+		resp, _ := do(client, http.MethodGet, "http://orders.shop.svc.cluster.local/orders?a=1&b=2", "")
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("safe mode", func(t *testing.T) {
+		p.Safe, _ = NewSafeMode("", []SafeRule{{Namespace: "shop"}})
+		defer func() { p.Safe = nil }()
+		resp, _ := do(client, http.MethodPost, "http://orders.shop.svc.cluster.local/orders", "second")
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("expected 405, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("not strict", func(t *testing.T) {
+		replay.Strict = false
+		p.k8sc = fakeResolver{}
+		resp, body := do(client, http.MethodPost, "http://orders.shop.svc.cluster.local/orders", "third")
+		if resp.StatusCode != http.StatusOK || body != "POST /orders third" || atomic.LoadInt32(&calls) != 1 {
+			t.Errorf("expected request to be sent to the pod, got %d %q", resp.StatusCode, body)
+		}
+	})
+
+	t.Run("large body", func(t *testing.T) {
+		large := strings.Repeat("x", DefaultRecordMaxBody+10)
+		resp, body := do(client, http.MethodPost, "http://orders.shop.svc.cluster.local/orders", large)
+		if resp.StatusCode != http.StatusOK || body != "POST /orders "+large {
+			t.Errorf("expected large body to be sent to the pod intact, got %d with %d bytes", resp.StatusCode, len(body))
+		}
+	})
+}
+
+func TestRecorder(t *testing.T) {
+	p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Internal-Token", "secret")
+		_, _ = w.Write([]byte(strings.Repeat("x", len(r.URL.Path))))
+	}))
+	var err error
+	p.Headers, err = NewHeaderRewriter([]HeaderRule{{
+		Request:  []HeaderRewrite{{Action: HeaderSet, Name: "X-Api-Key", Value: "secret"}},
+		Response: []HeaderRewrite{{Action: HeaderRemove, Name: "X-Internal-Token"}, {Action: HeaderSet, Name: "X-Session", Value: "secret"}},
+	}})
+	if err != nil {
+		t.Fatalf("invalid rules: %v", err)
+	}
+	dir := t.TempDir()
+	// recordings of an earlier run with a gap in the numbers
+	for _, name := range []string{"000001-GET-old.json", "000007-GET-old.json"} {
+		_ = ioutil.WriteFile(filepath.Join(dir, name), []byte("{}"), 0600)
+	}
+	p.Recorder, err = NewRecorder(dir)
+	if err != nil {
+		t.Fatalf("could not create recorder: %v", err)
+	}
+	p.Recorder.MaxBodySize = 16
+
+	client := newTestClient(t, p)
+	for _, url := range []string{"http://orders.shop.svc.cluster.local/small", "http://orders.shop.svc.cluster.local/larger-than-the-limit"} {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		_, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 3 || filepath.Base(files[2]) != "000008-GET-orders.shop.svc.cluster.local_small.json" {
+		t.Fatalf("expected only the small response to be recorded after the earlier recordings, got %v", files)
+	}
+	b, _ := ioutil.ReadFile(files[2])
+	if strings.Contains(string(b), "secret") {
+		t.Errorf("values of header rewrites were recorded:\n%s", b)
+	}
+}
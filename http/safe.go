@@ -0,0 +1,109 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// safeMethods are the methods permitted in safe mode
+var safeMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+
+// SafeRule puts the namespaces matching the glob patterns in safe mode, empty fields match
+// everything
+type SafeRule struct {
+	// Cluster is the name of the kubeconfig context
+	Cluster   string `mapstructure:"cluster"`
+	Namespace string `mapstructure:"namespace"`
+	// TunnelPorts are the ports tunnels may be opened to, e.g. of a database which is only
+	// queried
+	TunnelPorts []string `mapstructure:"tunnel-ports"`
+}
+
+// SafeMode guards production clusters against changes. Only GET, HEAD and OPTIONS requests
+// are sent to hosts in safe mode, CONNECT tunnels, upgraded connections, SOCKS5 and port
+// forwarding can't be inspected and are only permitted to the tunnel ports of the first
+// matching rule. Intercepted TLS requests are checked like plain HTTP requests.
+type SafeMode struct {
+	// Cluster is the name of the kubeconfig context the proxy uses
+	Cluster string
+	Rules   []SafeRule
+}
+
+// NewSafeMode validates the rules
+func NewSafeMode(cluster string, rules []SafeRule) (*SafeMode, error) {
+	for i, r := range rules {
+		for _, pattern := range append([]string{r.Cluster, r.Namespace}, r.TunnelPorts...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid pattern %q: %w", i+1, pattern, err)
+			}
+		}
+	}
+	return &SafeMode{Cluster: cluster, Rules: rules}, nil
+}
+
+// SafeModeError is returned for unsafe requests to namespaces in safe mode
+type SafeModeError struct {
+	Namespace string
+	// Method of the refused request, empty for tunnels
+	Method string
+	Port   string
+}
+
+func (e *SafeModeError) Error() string {
+	if e.Method != "" {
+		return fmt.Sprintf("%s requests to namespace %s are not permitted in safe mode, only %s",
+			e.Method, e.Namespace, strings.Join(safeMethods, ", "))
+	}
+	return fmt.Sprintf("tunnels to port %s in namespace %s are not permitted in safe mode", e.Port, e.Namespace)
+}
+
+// rule returns the first rule matching namespace, nil if it is not in safe mode
+func (s *SafeMode) rule(namespace string) *SafeRule {
+	if s == nil {
+		return nil
+	}
+	for i, r := range s.Rules {
+		if match(r.Cluster, s.Cluster) && match(r.Namespace, namespace) {
+			return &s.Rules[i]
+		}
+	}
+	return nil
+}
+
+// checkMethod returns a SafeModeError if requests with method are not permitted in namespace
+func (s *SafeMode) checkMethod(namespace, method string) error {
+	if s.rule(namespace) == nil {
+		return nil
+	}
+	for _, m := range safeMethods {
+		if m == method {
+			return nil
+		}
+	}
+	return &SafeModeError{Namespace: namespace, Method: method}
+}
+
+// checkTunnel returns a SafeModeError if tunnels to port are not permitted in namespace
+func (s *SafeMode) checkTunnel(namespace, port string) error {
+	r := s.rule(namespace)
+	if r == nil {
+		return nil
+	}
+	for _, pattern := range r.TunnelPorts {
+		if match(pattern, port) {
+			return nil
+		}
+	}
+	return &SafeModeError{Namespace: namespace, Port: port}
+}
+
+// match reports whether value matches the glob pattern, empty patterns match everything
+func match(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, value)
+	return ok
+}
@@ -0,0 +1,140 @@
+package http
+
+import (
+	"bufio"
+	"errors"
+	"github.com/elazarl/goproxy"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSafeMode(t *testing.T) {
+	safe, err := NewSafeMode("prod-eu", []SafeRule{
+		{Cluster: "prod-*", Namespace: "shop", TunnelPorts: []string{"5432"}},
+		{Cluster: "prod-*", Namespace: "kube-*"},
+	})
+	if err != nil {
+		t.Fatalf("could not create safe mode: %v", err)
+	}
+
+	t.Run("methods", func(t *testing.T) {
+		for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodOptions} {
+			if err := safe.checkMethod("shop", method); err != nil {
+				t.Errorf("expected %s to be permitted, got %v", method, err)
+			}
+		}
+		err := safe.checkMethod("shop", http.MethodDelete)
+		var unsafe *SafeModeError
+		if !errors.As(err, &unsafe) || unsafe.Method != http.MethodDelete {
+			t.Errorf("expected DELETE to be refused, got %v", err)
+		}
+		if err := safe.checkMethod("staging", http.MethodDelete); err != nil {
+			t.Errorf("expected namespace without rule to be unrestricted, got %v", err)
+		}
+	})
+
+	t.Run("tunnels", func(t *testing.T) {
+		if err := safe.checkTunnel("shop", "5432"); err != nil {
+			t.Errorf("expected tunnel port to be permitted, got %v", err)
+		}
+		if err := safe.checkTunnel("shop", "6379"); err == nil {
+			t.Errorf("expected tunnel to be refused")
+		}
+		if err := safe.checkTunnel("kube-system", "5432"); err == nil {
+			t.Errorf("expected tunnel port of other rule to be refused")
+		}
+	})
+
+	t.Run("other cluster", func(t *testing.T) {
+		staging := *safe
+		staging.Cluster = "staging"
+		if err := staging.checkMethod("shop", http.MethodPost); err != nil {
+			t.Errorf("expected other cluster to be unrestricted, got %v", err)
+		}
+	})
+
+	t.Run("invalid pattern", func(t *testing.T) {
+		if _, err := NewSafeMode("prod", []SafeRule{{TunnelPorts: []string{"[54"}}}); err == nil {
+			t.Errorf("expected invalid pattern to be refused")
+		}
+	})
+}
+
+func TestProxySafeMode(t *testing.T) {
+	p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("pod"))
+	}))
+	p.Safe, _ = NewSafeMode("prod", []SafeRule{{Namespace: "shop", TunnelPorts: []string{"5432"}}})
+
+	t.Run("http", func(t *testing.T) {
+		client := newTestClient(t, p)
+		for _, tt := range []struct {
+			method, host string
+			status       int
+		}{
+			{http.MethodGet, "orders.shop.svc.cluster.local", http.StatusOK},
+			{http.MethodPost, "orders.shop.svc.cluster.local", http.StatusMethodNotAllowed},
+			{http.MethodPost, "orders.staging.svc.cluster.local", http.StatusOK},
+		} {
+			req, _ := http.NewRequest(tt.method, "http://"+tt.host+"/", strings.NewReader(""))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("%s %s: expected %d, got %d", tt.method, tt.host, tt.status, resp.StatusCode)
+			}
+			if tt.status == http.StatusMethodNotAllowed && resp.Header.Get("Allow") != "GET, HEAD, OPTIONS" {
+				t.Errorf("unexpected Allow header %q", resp.Header.Get("Allow"))
+			}
+		}
+	})
+
+	t.Run("upgrade", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, "http://orders.shop.svc.cluster.local/ws", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		resp, err := newTestClient(t, p).Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("connect", func(t *testing.T) {
+		proxy := goproxy.NewProxyHttpServer()
+		onReq := proxy.OnRequest(p.ClusterRequest())
+		onReq.HandleConnectFunc(p.AccessConnect)
+		onReq.HandleConnectFunc(p.TunnelConnect)
+		srv := httptest.NewServer(proxy)
+		defer srv.Close()
+		proxyURL, _ := url.Parse(srv.URL)
+
+		for host, status := range map[string]int{
+			"orders.shop.svc.cluster.local:443":  http.StatusForbidden,
+			"orders.shop.svc.cluster.local:5432": http.StatusOK,
+		} {
+			conn, err := net.Dial("tcp", proxyURL.Host)
+			if err != nil {
+				t.Fatalf("could not dial proxy: %v", err)
+			}
+			_, _ = conn.Write([]byte("CONNECT " + host + " HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("could not read response: %v", err)
+			}
+			if resp.StatusCode != status {
+				t.Errorf("%s: expected %d, got %d", host, status, resp.StatusCode)
+			}
+			conn.Close()
+		}
+	})
+}
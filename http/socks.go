@@ -0,0 +1,260 @@
+package http
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/go-pkgz/lgr"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5, see RFC 1928 and RFC 1929 for username/password authentication
+const (
+	socksVersion         = 0x05
+	socksAuthVersion     = 0x01
+	socksNoAuth          = 0x00
+	socksUserPassAuth    = 0x02
+	socksNoAcceptable    = 0xff
+	socksConnect         = 0x01
+	socksIPv4            = 0x01
+	socksDomainName      = 0x03
+	socksIPv6            = 0x04
+	socksSucceeded       = 0x00
+	socksGeneralFailure  = 0x01
+	socksNotAllowed      = 0x02
+	socksHostUnreachable = 0x04
+	// socksTTLExpired is sent when resolving or dialing the pod timed out
+	socksTTLExpired      = 0x06
+	socksCmdUnsupported  = 0x07
+	socksAddrUnsupported = 0x08
+	// socksHandshakeTimeout limits the time clients get to send the greeting and the request
+	socksHandshakeTimeout = 30 * time.Second
+)
+
+// SOCKSServer accepts SOCKS5 CONNECT requests, cluster hosts are connected to their pods like
+// CONNECT tunnels of the HTTP proxy
+type SOCKSServer struct {
+	proxy *Proxy
+	// Egress dials hosts outside of the cluster, they are refused if nil
+	Egress *Egress
+	// Username and Password are required from clients if Username is set
+	Username string
+	Password string
+	// Users are accepted as well if set, clients have to authenticate if Username or Users is set
+	Users *Htpasswd
+}
+
+// NewSOCKSServer creates a SOCKS5 server resolving cluster hosts with p, clients authenticate
+// as the Users of p
+func (p *Proxy) NewSOCKSServer() *SOCKSServer {
+	return &SOCKSServer{proxy: p, Users: p.Users}
+}
+
+// Serve accepts connections on l until it is closed
+func (s *SOCKSServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *SOCKSServer) handle(conn net.Conn) {
+	if err := conn.SetDeadline(time.Now().Add(socksHandshakeTimeout)); err != nil {
+		log.Printf("[DEBUG] could not set deadline: %v", err)
+	}
+	addr, err := s.handshake(conn)
+	if err != nil {
+		log.Printf("[INFO] socks handshake with %s failed: %v", conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+
+	e := s.proxy.begin(kindSOCKS, conn.RemoteAddr().String(), "CONNECT", addr)
+	defer e.finish()
+	upstream, err := s.dial(addr, e)
+	if err != nil {
+		log.Printf("[INFO] could not connect to %s: %v", addr, err)
+		rep := byte(socksHostUnreachable)
+		var denied *AccessDeniedError
+		var unsafe *SafeModeError
+		var timeout *TimeoutError
+		switch {
+		case errors.Is(err, ErrEgressRejected) || errors.As(err, &denied) || errors.As(err, &unsafe):
+			rep = socksNotAllowed
+		case errors.As(err, &timeout):
+			rep = socksTTLExpired
+		}
+		_ = writeSOCKSReply(conn, rep)
+		_ = conn.Close()
+		return
+	}
+	if err := writeSOCKSReply(conn, socksSucceeded); err != nil {
+		log.Printf("[ERROR] could not write to client: %v", err)
+		_ = conn.Close()
+		_ = upstream.Close()
+		return
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		log.Printf("[DEBUG] could not clear deadline: %v", err)
+	}
+	s.proxy.tunnel(kindSOCKS, conn, upstream, e)
+}
+
+// handshake negotiates the authentication and reads the CONNECT request, it returns the
+// requested address
+func (s *SOCKSServer) handshake(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socksNoAuth)
+	if s.Username != "" || s.Users != nil {
+		method = socksUserPassAuth
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+	if !offered {
+		_, _ = conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return "", fmt.Errorf("no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksUserPassAuth {
+		if err := s.authenticate(conn); err != nil {
+			return "", err
+		}
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[0] != socksVersion {
+		return "", fmt.Errorf("unsupported socks version %d", request[0])
+	}
+	if request[1] != socksConnect {
+		_ = writeSOCKSReply(conn, socksCmdUnsupported)
+		return "", fmt.Errorf("unsupported command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socksIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksDomainName:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return "", err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		_ = writeSOCKSReply(conn, socksAddrUnsupported)
+		return "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func (s *SOCKSServer) authenticate(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != socksAuthVersion {
+		return fmt.Errorf("unsupported authentication version %d", header[0])
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return err
+	}
+	l := make([]byte, 1)
+	if _, err := io.ReadFull(conn, l); err != nil {
+		return err
+	}
+	password := make([]byte, l[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+
+	if !s.verify(string(username), string(password)) {
+		_, _ = conn.Write([]byte{socksAuthVersion, socksGeneralFailure})
+		return fmt.Errorf("invalid credentials for user %q", username)
+	}
+	_, err := conn.Write([]byte{socksAuthVersion, socksSucceeded})
+	return err
+}
+
+// verify reports whether the credentials match Username and Password or one of the Users
+func (s *SOCKSServer) verify(username, password string) bool {
+	if s.Username != "" {
+		userOK := subtle.ConstantTimeCompare([]byte(username), []byte(s.Username)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(s.Password)) == 1
+		if userOK && passwordOK {
+			return true
+		}
+	}
+	return s.Users != nil && s.Users.Verify(username, password)
+}
+
+// dial connects to the pod of cluster hosts, other hosts are dialed with the egress policy
+func (s *SOCKSServer) dial(addr string, e *accessEntry) (net.Conn, error) {
+	h, err := s.proxy.parser.ParseHost(addr, false)
+	if err != nil {
+		return nil, err
+	}
+	if !h.K8s {
+		if s.Egress == nil {
+			e.fail(errorAccessDenied)
+			return nil, ErrEgressRejected
+		}
+		start := time.Now()
+		upstream, err := s.Egress.Dial("tcp", addr)
+		if err != nil {
+			e.fail(errorDial)
+			return nil, err
+		}
+		e.dialed(start)
+		return upstream, nil
+	}
+	return s.proxy.dialTunnel(context.Background(), addr, e)
+}
+
+// writeSOCKSReply answers the CONNECT request, the bound address is not meaningful for
+// connections to pods and always reported as 0.0.0.0:0
+func writeSOCKSReply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{socksVersion, rep, 0x00, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
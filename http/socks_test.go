@@ -0,0 +1,118 @@
+package http
+
+import (
+	"context"
+	"golang.org/x/net/proxy"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestSOCKSServer(t *testing.T, s *SOCKSServer) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() { _ = s.Serve(l) }()
+	return l.Addr().String()
+}
+
+func socksClient(t *testing.T, addr string, auth *proxy.Auth) *http.Client {
+	dialer, err := proxy.SOCKS5("tcp", addr, auth, proxy.Direct)
+	if err != nil {
+		t.Fatalf("could not create socks dialer: %v", err)
+	}
+	tr := &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialer.Dial(network, addr)
+	}}
+	t.Cleanup(tr.CloseIdleConnections)
+	return &http.Client{Transport: tr}
+}
+
+func TestSOCKSServer(t *testing.T) {
+	p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("pod " + r.Host))
+	}))
+	s := p.NewSOCKSServer()
+	s.Username, s.Password = "dev", "secret"
+	addr := newTestSOCKSServer(t, s)
+
+	t.Run("cluster host", func(t *testing.T) {
+		client := socksClient(t, addr, &proxy.Auth{User: "dev", Password: "secret"})
+		resp, err := client.Get("http://db.shop.svc.cluster.local:8080/")
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != "pod db.shop.svc.cluster.local:8080" {
+			t.Errorf("unexpected body %q", body)
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		client := socksClient(t, addr, &proxy.Auth{User: "dev", Password: "guess"})
+		if _, err := client.Get("http://db.shop.svc.cluster.local:8080/"); err == nil {
+			t.Errorf("expected authentication to fail")
+		}
+	})
+
+	t.Run("missing credentials", func(t *testing.T) {
+		client := socksClient(t, addr, nil)
+		if _, err := client.Get("http://db.shop.svc.cluster.local:8080/"); err == nil {
+			t.Errorf("expected authentication to fail")
+		}
+	})
+
+	t.Run("outside of the cluster without egress", func(t *testing.T) {
+		client := socksClient(t, addr, &proxy.Auth{User: "dev", Password: "secret"})
+		if _, err := client.Get("http://example.com/"); err == nil {
+			t.Errorf("expected request to be refused")
+		}
+	})
+}
+
+func TestSOCKSServerUsers(t *testing.T) {
+	p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("pod"))
+	}))
+	p.Users = newTestHtpasswd(t)
+	addr := newTestSOCKSServer(t, p.NewSOCKSServer())
+
+	client := socksClient(t, addr, &proxy.Auth{User: "dev", Password: "secret"})
+	resp, err := client.Get("http://db.shop.svc.cluster.local:8080/")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	for _, auth := range []*proxy.Auth{nil, {User: "dev", Password: "guess"}} {
+		if _, err := socksClient(t, addr, auth).Get("http://db.shop.svc.cluster.local:8080/"); err == nil {
+			t.Errorf("expected authentication with %v to fail", auth)
+		}
+	}
+}
+
+func TestSOCKSServerEgress(t *testing.T) {
+	direct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("direct"))
+	}))
+	defer direct.Close()
+
+	p, _ := newFakeProxy(t, http.NotFoundHandler())
+	s := p.NewSOCKSServer()
+	s.Egress, _ = NewEgress(EgressDirect, "", "")
+	client := socksClient(t, newTestSOCKSServer(t, s), nil)
+
+	resp, err := client.Get(direct.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "direct" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
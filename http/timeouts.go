@@ -0,0 +1,264 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	log "github.com/go-pkgz/lgr"
+	"github.com/tipok/kubeproxy/k8s"
+	"net"
+	"net/http"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+// Phases of requests and tunnels limited by timeouts
+const (
+	phaseResolve        = "resolve"
+	phaseDial           = "dial"
+	phaseResponseHeader = "response_header"
+	phaseIdle           = "idle"
+	phaseLifetime       = "lifetime"
+)
+
+// TimeoutError is returned when a phase of a request or tunnel took longer than its timeout
+type TimeoutError struct {
+	Phase   string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", e.Phase, e.Timeout)
+}
+
+// class returns the error class of access log entries
+func (e *TimeoutError) class() string {
+	return e.Phase + "_timeout"
+}
+
+// reason returns the status text sent to clients
+func (e *TimeoutError) reason() string {
+	switch e.Phase {
+	case phaseResolve:
+		return "Resolving destination timed out"
+	case phaseDial:
+		return "Connecting to destination timed out"
+	}
+	return "Destination did not respond in time"
+}
+
+// Timeouts limit the phases of requests and tunnels to cluster hosts, zero disables a timeout
+type Timeouts struct {
+	// Resolve limits the API server lookup of the pod serving a host
+	Resolve time.Duration `mapstructure:"resolve"`
+	// Dial limits connecting to the port-forward API of the pod and opening the stream
+	Dial time.Duration `mapstructure:"dial"`
+	// ResponseHeader limits waiting for the response headers of the pod once the request is sent
+	ResponseHeader time.Duration `mapstructure:"response-header"`
+	// Idle closes tunnels without traffic in either direction for that long
+	Idle time.Duration `mapstructure:"idle"`
+	// MaxLifetime closes tunnels open for longer
+	MaxLifetime time.Duration `mapstructure:"max-lifetime"`
+}
+
+// merge returns t with the timeouts set in o replaced
+func (t Timeouts) merge(o Timeouts) Timeouts {
+	for _, f := range []struct{ dst, src *time.Duration }{
+		{&t.Resolve, &o.Resolve},
+		{&t.Dial, &o.Dial},
+		{&t.ResponseHeader, &o.ResponseHeader},
+		{&t.Idle, &o.Idle},
+		{&t.MaxLifetime, &o.MaxLifetime},
+	} {
+		if *f.src != 0 {
+			*f.dst = *f.src
+		}
+	}
+	return t
+}
+
+// TimeoutRule overrides the timeouts set in it for cluster hosts matching all of its fields.
+// The fields are glob patterns as understood by path.Match, empty fields match everything.
+type TimeoutRule struct {
+	Namespace string `mapstructure:"namespace"`
+	// Type is svc, pod or ip, the namespace of addresses is unknown when they are matched
+	Type     string `mapstructure:"type"`
+	Name     string `mapstructure:"name"`
+	Port     string `mapstructure:"port"`
+	Timeouts `mapstructure:",squash"`
+}
+
+func (r *TimeoutRule) matches(h *Host) bool {
+	return match(r.Namespace, h.Namespace) && match(r.Type, h.Type) && match(r.Name, h.Name) && match(r.Port, h.Port)
+}
+
+// TimeoutPolicy decides the timeouts of cluster hosts, the first matching rule overrides the
+// defaults
+type TimeoutPolicy struct {
+	Defaults Timeouts
+	Rules    []TimeoutRule
+}
+
+// NewTimeoutPolicy validates the timeouts and rules
+func NewTimeoutPolicy(defaults Timeouts, rules []TimeoutRule) (*TimeoutPolicy, error) {
+	if err := defaults.validate(); err != nil {
+		return nil, err
+	}
+	for i, r := range rules {
+		if err := r.Timeouts.validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		for _, pattern := range []string{r.Namespace, r.Type, r.Name, r.Port} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid pattern %q: %w", i+1, pattern, err)
+			}
+		}
+	}
+	return &TimeoutPolicy{Defaults: defaults, Rules: rules}, nil
+}
+
+func (t Timeouts) validate() error {
+	for _, d := range []time.Duration{t.Resolve, t.Dial, t.ResponseHeader, t.Idle, t.MaxLifetime} {
+		if d < 0 {
+			return fmt.Errorf("invalid timeout %s", d)
+		}
+	}
+	return nil
+}
+
+// timeouts returns the timeouts of h, none without a policy
+func (p *TimeoutPolicy) timeouts(h *Host) Timeouts {
+	if p == nil {
+		return Timeouts{}
+	}
+	for _, r := range p.Rules {
+		if r.matches(h) {
+			return p.Defaults.merge(r.Timeouts)
+		}
+	}
+	return p.Defaults
+}
+
+// hostTimeouts returns the timeouts of the cluster host
+func (p *Proxy) hostTimeouts(host string, https bool) Timeouts {
+	h, err := p.parser.ParseHost(host, https)
+	if err != nil {
+		return p.Timeouts.timeouts(&Host{})
+	}
+	return p.Timeouts.timeouts(h)
+}
+
+// timeoutsKey is the context key of the timeouts of requests to pods
+type timeoutsKey struct{}
+
+func withTimeouts(r *http.Request, t Timeouts) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), timeoutsKey{}, t))
+}
+
+// dialTimeout returns the dial timeout of the request with ctx to tp, connections dialed
+// without a request get the timeout of the pod
+func (p *Proxy) dialTimeout(ctx context.Context, tp *k8s.TargetPod) time.Duration {
+	if t, ok := ctx.Value(timeoutsKey{}).(Timeouts); ok {
+		return t.Dial
+	}
+	return p.Timeouts.timeouts(&Host{Type: "pod", Name: tp.Name, Namespace: tp.Namespace, Port: tp.Port, K8s: true}).Dial
+}
+
+func responseHeaderTimeout(ctx context.Context) time.Duration {
+	t, _ := ctx.Value(timeoutsKey{}).(Timeouts)
+	return t.ResponseHeader
+}
+
+// withTimeout runs f with a context limited to timeout, it returns a TimeoutError if f failed
+// because the timeout was hit
+func withTimeout(ctx context.Context, phase string, timeout time.Duration, f func(ctx context.Context) error) error {
+	if timeout <= 0 {
+		return f(ctx)
+	}
+	limited, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := f(limited)
+	if err != nil && limited.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return &TimeoutError{Phase: phase, Timeout: timeout}
+	}
+	return err
+}
+
+// dialPodWithin is dialPod giving up after timeout, dialing the port-forward API doesn't take a
+// context so a late stream is closed once it is opened
+func (p *Proxy) dialPodWithin(tp *k8s.TargetPod, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		return p.dialPod(tp)
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := p.dialPod(tp)
+		done <- result{conn, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-timer.C:
+		go func() {
+			if r := <-done; r.conn != nil {
+				_ = r.conn.Close()
+			}
+		}()
+		return nil, &TimeoutError{Phase: phaseDial, Timeout: timeout}
+	}
+}
+
+// watchTunnel closes the tunnel of e once it was idle or open for longer than allowed by t, it
+// returns when done is closed
+func (p *Proxy) watchTunnel(e *accessEntry, t Timeouts, done <-chan struct{}) {
+	if t.Idle <= 0 && t.MaxLifetime <= 0 {
+		return
+	}
+	var lifetime <-chan time.Time
+	if t.MaxLifetime > 0 {
+		timer := time.NewTimer(t.MaxLifetime)
+		defer timer.Stop()
+		lifetime = timer.C
+	}
+	// the tunnel is closed after being idle for at least Idle and at most 1.25 * Idle
+	var check <-chan time.Time
+	if t.Idle > 0 {
+		ticker := time.NewTicker(t.Idle / 4)
+		defer ticker.Stop()
+		check = ticker.C
+	}
+	transferred := func() int64 {
+		return atomic.LoadInt64(&e.bytesIn) + atomic.LoadInt64(&e.bytesOut)
+	}
+	last, active := transferred(), time.Now()
+
+	var timeout *TimeoutError
+	for timeout == nil {
+		select {
+		case <-done:
+			return
+		case <-lifetime:
+			timeout = &TimeoutError{Phase: phaseLifetime, Timeout: t.MaxLifetime}
+		case now := <-check:
+			if n := transferred(); n != last {
+				last, active = n, now
+			} else if now.Sub(active) >= t.Idle {
+				timeout = &TimeoutError{Phase: phaseIdle, Timeout: t.Idle}
+			}
+		}
+	}
+	log.Printf("[INFO] closing tunnel to %s: %v", e.Host, timeout)
+	e.lock.Lock()
+	e.Error = timeout.class()
+	closer := e.closer
+	e.lock.Unlock()
+	if closer != nil {
+		closer()
+	}
+}
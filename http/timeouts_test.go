@@ -0,0 +1,249 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"github.com/elazarl/goproxy"
+	"github.com/tipok/kubeproxy/k8s"
+	"io"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowResolver resolves services only once ctx is done
+type slowResolver struct {
+	fakeResolver
+}
+
+func (slowResolver) GetMatchingPodForService(ctx context.Context, _, _, _ string) (*k8s.TargetPod, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestTimeoutPolicy(t *testing.T) {
+	policy, err := NewTimeoutPolicy(Timeouts{Resolve: time.Second, Dial: 2 * time.Second}, []TimeoutRule{
+		{Namespace: "shop", Name: "orders", Timeouts: Timeouts{Dial: time.Minute, Idle: time.Hour}},
+		{Namespace: "shop", Timeouts: Timeouts{Resolve: time.Minute}},
+	})
+	if err != nil {
+		t.Fatalf("invalid policy: %v", err)
+	}
+	for _, tt := range []struct {
+		host *Host
+		want Timeouts
+	}{
+		{&Host{Namespace: "shop", Name: "orders", Type: "svc"}, Timeouts{Resolve: time.Second, Dial: time.Minute, Idle: time.Hour}},
+		{&Host{Namespace: "shop", Name: "payments", Type: "svc"}, Timeouts{Resolve: time.Minute, Dial: 2 * time.Second}},
+		{&Host{Namespace: "default", Name: "orders", Type: "svc"}, Timeouts{Resolve: time.Second, Dial: 2 * time.Second}},
+	} {
+		if got := policy.timeouts(tt.host); got != tt.want {
+			t.Errorf("%+v: expected %+v, got %+v", tt.host, tt.want, got)
+		}
+	}
+
+	if _, err := NewTimeoutPolicy(Timeouts{}, []TimeoutRule{{Timeouts: Timeouts{Idle: -time.Second}}}); err == nil {
+		t.Error("expected negative timeout to be rejected")
+	}
+	if _, err := NewTimeoutPolicy(Timeouts{}, []TimeoutRule{{Name: "["}}); err == nil {
+		t.Error("expected invalid pattern to be rejected")
+	}
+}
+
+func TestRequestTimeouts(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		timeouts Timeouts
+		setup    func(p *Proxy)
+		reason   string
+		class    string
+	}{
+		{
+			name:     "resolve",
+			timeouts: Timeouts{Resolve: 50 * time.Millisecond},
+			setup:    func(p *Proxy) { p.k8sc = slowResolver{} },
+			reason:   "Resolving destination timed out",
+			class:    "resolve_timeout",
+		},
+		{
+			name:     "dial",
+			timeouts: Timeouts{Dial: 50 * time.Millisecond},
+			setup: func(p *Proxy) {
+				p.conns.dial = func(_ *k8s.TargetPod) (httpstream.Connection, error) {
+					time.Sleep(time.Second)
+					return nil, io.EOF
+				}
+			},
+			reason: "Connecting to destination timed out",
+			class:  "dial_timeout",
+		},
+		{
+			name:     "response header",
+			timeouts: Timeouts{ResponseHeader: 50 * time.Millisecond},
+			reason:   "Destination did not respond in time",
+			class:    "response_header_timeout",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(time.Second)
+				_, _ = w.Write([]byte("pod"))
+			}))
+			p.Timeouts, _ = NewTimeoutPolicy(Timeouts{}, []TimeoutRule{{Namespace: "shop", Timeouts: tt.timeouts}})
+			lines := make(lineWriter, 1)
+			p.AccessLog, _ = NewAccessLog(lines, AccessLogJSON)
+			if tt.setup != nil {
+				tt.setup(p)
+			}
+			client := newTestClient(t, p)
+
+			start := time.Now()
+			resp, err := client.Get("http://orders.shop.svc.cluster.local/")
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusGatewayTimeout || string(body) != tt.reason {
+				t.Errorf("expected 504 %q, got %d %q", tt.reason, resp.StatusCode, body)
+			}
+			if d := time.Since(start); d > 500*time.Millisecond {
+				t.Errorf("expected request to time out, took %s", d)
+			}
+			if line := lines.next(t); !strings.Contains(line, `"error":"`+tt.class+`"`) {
+				t.Errorf("expected error %s in %s", tt.class, line)
+			}
+		})
+	}
+
+	// other routes are not limited
+	p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write([]byte("pod"))
+	}))
+	p.Timeouts, _ = NewTimeoutPolicy(Timeouts{}, []TimeoutRule{{Namespace: "shop", Timeouts: Timeouts{ResponseHeader: 50 * time.Millisecond}}})
+	resp, err := newTestClient(t, p).Get("http://orders.default.svc.cluster.local/")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+
+	// uploads taking longer than the response header timeout are not cut off
+	p, _ = newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	p.Timeouts, _ = NewTimeoutPolicy(Timeouts{ResponseHeader: 50 * time.Millisecond}, nil)
+	body, w := io.Pipe()
+	go func() {
+		for i := 0; i < 4; i++ {
+			time.Sleep(40 * time.Millisecond)
+			_, _ = w.Write([]byte("chunk"))
+		}
+		_ = w.Close()
+	}()
+	resp, err = newTestClient(t, p).Post("http://orders.shop.svc.cluster.local/", "text/plain", body)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	echo, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(echo) != strings.Repeat("chunk", 4) {
+		t.Errorf("expected upload to succeed, got %d %q", resp.StatusCode, echo)
+	}
+}
+
+func TestGRPCDialTimeout(t *testing.T) {
+	p, _ := newFakeProxy(t, newGRPCPod(t))
+	// only the rule of the service limits dialing, not the one of its pod
+	p.Timeouts, _ = NewTimeoutPolicy(Timeouts{}, []TimeoutRule{{Type: "svc", Name: "greeter", Timeouts: Timeouts{Dial: 50 * time.Millisecond}}})
+	p.conns.dial = func(_ *k8s.TargetPod) (httpstream.Connection, error) {
+		time.Sleep(time.Second)
+		return nil, io.EOF
+	}
+	req, _ := http.NewRequest(http.MethodPost, "http://greeter.shop.svc.cluster.local:50051/shop.Greeter/Hello", strings.NewReader("msg"))
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	start := time.Now()
+	resp, err := newTestClient(t, p).Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("expected 504, got %d", resp.StatusCode)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("expected dialing to time out, took %s", d)
+	}
+}
+
+func TestTunnelTimeouts(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		timeouts Timeouts
+		class    string
+	}{
+		{"idle", Timeouts{Idle: 100 * time.Millisecond}, "idle_timeout"},
+		{"lifetime", Timeouts{MaxLifetime: 200 * time.Millisecond}, "lifetime_timeout"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("pod"))
+			}))
+			p.Timeouts, _ = NewTimeoutPolicy(tt.timeouts, nil)
+			lines := make(lineWriter, 1)
+			p.AccessLog, _ = NewAccessLog(lines, AccessLogJSON)
+
+			conn, r := openTunnel(t, p)
+			defer conn.Close()
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := r.ReadByte(); err != io.EOF {
+				t.Errorf("expected tunnel to be closed, got %v", err)
+			}
+			if line := lines.next(t); !strings.Contains(line, `"error":"`+tt.class+`"`) {
+				t.Errorf("expected error %s in %s", tt.class, line)
+			}
+		})
+	}
+
+	t.Run("dial", func(t *testing.T) {
+		p, _ := newFakeProxy(t, http.NotFoundHandler())
+		p.Timeouts, _ = NewTimeoutPolicy(Timeouts{Dial: 50 * time.Millisecond}, nil)
+		p.conns.dial = func(_ *k8s.TargetPod) (httpstream.Connection, error) {
+			time.Sleep(time.Second)
+			return nil, io.EOF
+		}
+		lines := make(lineWriter, 1)
+		p.AccessLog, _ = NewAccessLog(lines, AccessLogJSON)
+		proxy := goproxy.NewProxyHttpServer()
+		proxy.OnRequest(p.ClusterRequest()).HandleConnectFunc(p.TunnelConnect)
+		srv := httptest.NewServer(proxy)
+		defer srv.Close()
+
+		conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+		if err != nil {
+			t.Fatalf("could not dial proxy: %v", err)
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("CONNECT orders.shop.svc.cluster.local:80 HTTP/1.1\r\nHost: orders.shop.svc.cluster.local:80\r\n\r\n"))
+		// the CONNECT is only answered once the pod is connected
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("could not read response: %v", err)
+		}
+		if resp.StatusCode != http.StatusGatewayTimeout {
+			t.Errorf("expected 504, got %s", resp.Status)
+		}
+		if line := lines.next(t); !strings.Contains(line, `"status":504`) || !strings.Contains(line, `"error":"dial_timeout"`) {
+			t.Errorf("unexpected entry %s", line)
+		}
+	})
+}
@@ -0,0 +1,454 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/go-pkgz/lgr"
+	"github.com/tipok/kubeproxy/k8s"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of spans as defined by OTLP
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+const (
+	traceBatchSize     = 256
+	traceFlushInterval = 5 * time.Second
+)
+
+// SpanExporter sends batches of finished spans encoded as OTLP/JSON ExportTraceServiceRequest
+type SpanExporter interface {
+	Export(ctx context.Context, payload []byte) error
+	Close() error
+}
+
+// Tracer creates a span per request to a cluster host, with child spans for the resolution of
+// the pod, the dial and the exchange with the pod. The trace is continued from the traceparent
+// header of the request and in the pod, the header is replaced for the request sent to it.
+type Tracer struct {
+	service   string
+	exporters []SpanExporter
+	spans     chan *span
+	done      chan struct{}
+	// lock guards closing spans
+	lock   sync.Mutex
+	closed bool
+}
+
+// NewTracer exports the spans of service to exporters in batches
+func NewTracer(service string, exporters ...SpanExporter) *Tracer {
+	t := &Tracer{service: service, exporters: exporters, spans: make(chan *span, 4*traceBatchSize), done: make(chan struct{})}
+	go t.run()
+	return t
+}
+
+// Close exports the remaining spans and closes the exporters
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.spans)
+	t.lock.Unlock()
+
+	<-t.done
+	var err error
+	for _, e := range t.exporters {
+		if cerr := e.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// add queues s for the export, spans finished after Close are dropped
+func (t *Tracer) add(s *span) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.spans <- s:
+	default:
+		log.Printf("[DEBUG] dropping span %s, the export is too slow", s.name)
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*span, 0, traceBatchSize)
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				t.export(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		t.export(batch)
+		batch = batch[:0]
+	}
+}
+
+func (t *Tracer) export(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+	payload, err := json.Marshal(t.encode(batch))
+	if err != nil {
+		log.Printf("[ERROR] could not encode spans: %v", err)
+		return
+	}
+	for _, e := range t.exporters {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := e.Export(ctx, payload); err != nil {
+			log.Printf("[ERROR] could not export %d spans: %v", len(batch), err)
+		}
+		cancel()
+	}
+}
+
+// span is a span of a trace, all methods may be called on nil spans
+type span struct {
+	tracer  *Tracer
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte
+	// sampled spans are exported, the flag is passed on to the pod
+	sampled    bool
+	traceState string
+
+	name       string
+	kind       int
+	start      time.Time
+	attributes []spanAttribute
+	once       sync.Once
+	end        time.Time
+	err        error
+}
+
+type spanAttribute struct {
+	key   string
+	value interface{}
+}
+
+type spanKey struct{}
+
+// startRequest starts the span of r, continuing the trace of its traceparent header
+func (t *Tracer) startRequest(r *http.Request) (*http.Request, *span) {
+	if t == nil {
+		return r, nil
+	}
+	s := &span{tracer: t, name: r.Method, kind: spanServer, start: time.Now(), sampled: true}
+	if traceID, parent, sampled, ok := parseTraceparent(r.Header.Get("Traceparent")); ok {
+		s.traceID, s.parent, s.sampled = traceID, parent, sampled
+		s.traceState = r.Header.Get("Tracestate")
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	_, _ = rand.Read(s.id[:])
+	s.setAttribute("http.method", r.Method)
+	s.setAttribute("http.host", r.Host)
+	s.setAttribute("http.target", r.URL.RequestURI())
+	s.setAttribute("net.peer.addr", r.RemoteAddr)
+	return r.WithContext(context.WithValue(r.Context(), spanKey{}, s)), s
+}
+
+// startSpan starts a child of the span of ctx, it is nil if ctx has none
+func startSpan(ctx context.Context, name string, kind int) *span {
+	parent, _ := ctx.Value(spanKey{}).(*span)
+	if parent == nil {
+		return nil
+	}
+	s := &span{
+		tracer:     parent.tracer,
+		traceID:    parent.traceID,
+		parent:     parent.id,
+		sampled:    parent.sampled,
+		traceState: parent.traceState,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+	}
+	_, _ = rand.Read(s.id[:])
+	return s
+}
+
+func (s *span) setAttribute(key string, value interface{}) {
+	if s != nil {
+		s.attributes = append(s.attributes, spanAttribute{key, value})
+	}
+}
+
+// setPod records the pod a request is sent to
+func (s *span) setPod(tp *k8s.TargetPod) {
+	s.setAttribute("k8s.namespace.name", tp.Namespace)
+	s.setAttribute("k8s.pod.name", tp.Name)
+	s.setAttribute("net.peer.port", tp.Port)
+}
+
+// finish ends the span, failed with err if not nil
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		s.end, s.err = time.Now(), err
+		if s.sampled {
+			s.tracer.add(s)
+		}
+	})
+}
+
+// finishResponse ends the span when the body of resp is closed
+func (s *span) finishResponse(resp *http.Response) {
+	if s == nil {
+		return
+	}
+	s.setAttribute("http.status_code", resp.StatusCode)
+	var err error
+	if resp.StatusCode >= http.StatusInternalServerError {
+		err = fmt.Errorf("%s", resp.Status)
+	}
+	if resp.Body == nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		s.finish(err)
+		return
+	}
+	resp.Body = &capturedBody{ReadCloser: resp.Body, close: func() { s.finish(err) }}
+}
+
+// inject sets the traceparent header continuing the trace with s
+func (s *span) inject(h http.Header) {
+	if s == nil {
+		return
+	}
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	h.Set("Traceparent", "00-"+hex.EncodeToString(s.traceID[:])+"-"+hex.EncodeToString(s.id[:])+"-"+flags)
+	if s.traceState != "" {
+		h.Set("Tracestate", s.traceState)
+	}
+}
+
+// traceDial records the time waiting for a connection to the pod as child span dial of the
+// span of r
+func traceDial(r *http.Request) *http.Request {
+	if r.Context().Value(spanKey{}) == nil {
+		return r
+	}
+	var dial *span
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), &httptrace.ClientTrace{
+		GetConn: func(string) { dial = startSpan(r.Context(), "dial", spanInternal) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			dial.setAttribute("reused", info.Reused)
+			dial.finish(nil)
+		},
+	}))
+}
+
+// parseTraceparent parses a W3C traceparent header
+func parseTraceparent(h string) (traceID [16]byte, parent [8]byte, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return
+	}
+	if _, err := hex.Decode(parent[:], []byte(parts[2])); err != nil || parent == [8]byte{} {
+		return
+	}
+	return traceID, parent, flags[0]&1 == 1, true
+}
+
+// OTLP/JSON encoding of spans, see opentelemetry-proto
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	TraceState        string         `json:"traceState,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+func otlpAttribute(key string, value interface{}) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	switch v := value.(type) {
+	case int:
+		i := strconv.Itoa(v)
+		kv.Value.IntValue = &i
+	case bool:
+		kv.Value.BoolValue = &v
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
+
+func (t *Tracer) encode(batch []*span) *otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.id[:]),
+			TraceState:        s.traceState,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: 1},
+		}
+		if s.parent != [8]byte{} {
+			out.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for _, a := range s.attributes {
+			out.Attributes = append(out.Attributes, otlpAttribute(a.key, a.value))
+		}
+		if s.err != nil {
+			out.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+		spans = append(spans, out)
+	}
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpKeyValue{otlpAttribute("service.name", t.service)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "kubeproxy"}, Spans: spans}},
+	}}}
+}
+
+// OTLPExporter posts spans to the OTLP/HTTP traces endpoint of a collector, e.g.
+// http://localhost:4318/v1/traces
+type OTLPExporter struct {
+	Endpoint string
+	Client   *http.Client
+}
+
+func (e *OTLPExporter) Export(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.Endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (e *OTLPExporter) Close() error {
+	return nil
+}
+
+// FileExporter appends every batch of spans as one line to a file
+type FileExporter struct {
+	f *os.File
+}
+
+// NewFileExporter appends to the file at path, it is created if missing
+func NewFileExporter(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{f: f}, nil
+}
+
+func (e *FileExporter) Export(_ context.Context, payload []byte) error {
+	_, err := e.f.Write(append(payload, '\n'))
+	return err
+}
+
+func (e *FileExporter) Close() error {
+	return e.f.Close()
+}
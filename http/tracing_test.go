@@ -0,0 +1,134 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeExporter keeps the exported payloads
+type fakeExporter struct {
+	lock     sync.Mutex
+	payloads [][]byte
+}
+
+func (e *fakeExporter) Export(_ context.Context, payload []byte) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.payloads = append(e.payloads, payload)
+	return nil
+}
+
+func (e *fakeExporter) Close() error {
+	return nil
+}
+
+func TestParseTraceparent(t *testing.T) {
+	for _, tt := range []struct {
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	} {
+		_, _, sampled, ok := parseTraceparent(tt.header)
+		if ok != tt.ok || sampled != tt.sampled {
+			t.Errorf("%q: expected ok %v sampled %v, got %v %v", tt.header, tt.ok, tt.sampled, ok, sampled)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	traceparent := make(chan string, 1)
+	p, _ := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("Traceparent")
+		_, _ = w.Write([]byte("pod"))
+	}))
+	exporter := &fakeExporter{}
+	p.Tracer = NewTracer("kubeproxy", exporter)
+	// the access log entry is written after the request span is finished
+	lines := make(lineWriter, 1)
+	p.AccessLog, _ = NewAccessLog(lines, AccessLogJSON)
+	client := newTestClient(t, p)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://orders.shop.svc.cluster.local/orders", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	_, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	sent := <-traceparent
+	lines.next(t)
+	if err := p.Tracer.Close(); err != nil {
+		t.Fatalf("could not close tracer: %v", err)
+	}
+
+	var spans []otlpSpan
+	for _, payload := range exporter.payloads {
+		var r otlpRequest
+		if err := json.Unmarshal(payload, &r); err != nil {
+			t.Fatalf("invalid payload: %v", err)
+		}
+		if name := *r.ResourceSpans[0].Resource.Attributes[0].Value.StringValue; name != "kubeproxy" {
+			t.Errorf("unexpected service name %s", name)
+		}
+		spans = append(spans, r.ResourceSpans[0].ScopeSpans[0].Spans...)
+	}
+	byName := map[string]otlpSpan{}
+	for _, s := range spans {
+		byName[s.Name] = s
+		if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("span %s is not part of the trace of the client: %s", s.Name, s.TraceID)
+		}
+	}
+	root, ok := byName[http.MethodGet]
+	if !ok || len(spans) != 4 {
+		t.Fatalf("expected request, resolve, dial and upstream spans, got %+v", spans)
+	}
+	if root.ParentSpanID != "00f067aa0ba902b7" || root.Kind != spanServer {
+		t.Errorf("unexpected request span %+v", root)
+	}
+	for _, name := range []string{"resolve", "dial", "upstream"} {
+		if byName[name].ParentSpanID != root.SpanID {
+			t.Errorf("expected %s to be a child of the request span", name)
+		}
+	}
+	if want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + byName["upstream"].SpanID + "-01"; sent != want {
+		t.Errorf("expected traceparent %s sent to the pod, got %s", want, sent)
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	e, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatalf("could not create exporter: %v", err)
+	}
+	tracer := NewTracer("kubeproxy", e)
+	r, s := tracer.startRequest(httptest.NewRequest(http.MethodGet, "http://orders.shop.svc.cluster.local/", nil))
+	startSpan(r.Context(), "resolve", spanInternal).finish(nil)
+	s.finish(nil)
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("could not close tracer: %v", err)
+	}
+	b, _ := ioutil.ReadFile(path)
+	if lines := strings.Split(strings.TrimSpace(string(b)), "\n"); len(lines) != 1 || !strings.Contains(lines[0], `"name":"resolve"`) {
+		t.Errorf("unexpected file %s", b)
+	}
+}
@@ -0,0 +1,425 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/tipok/kubeproxy/k8s"
+	"golang.org/x/net/http2"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hopHeaders are removed when forwarding requests and responses, see RFC 7230 section 6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// upgradeType returns the protocol requested by an Upgrade request or confirmed by a
+// 101 Switching Protocols response
+func upgradeType(h http.Header) string {
+	for _, f := range h.Values("Connection") {
+		for _, sf := range strings.Split(f, ",") {
+			if strings.EqualFold(strings.TrimSpace(sf), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, f := range h.Values("Connection") {
+		for _, sf := range strings.Split(f, ",") {
+			if sf = strings.TrimSpace(sf); sf != "" {
+				h.Del(sf)
+			}
+		}
+	}
+	for _, hh := range hopHeaders {
+		h.Del(hh)
+	}
+}
+
+// Transport is a http.RoundTripper sending requests to cluster hosts through port-forward
+// streams. Upstream connections are kept alive per pod and are reused by later requests.
+type Transport struct {
+	proxy *Proxy
+	tr    *http.Transport
+	// h2c sends gRPC requests to plain text pods with HTTP/2 prior knowledge
+	h2c     *http2.Transport
+	h2cPool *h2cPool
+	lock    sync.Mutex
+	// tls holds the transports of intercepted requests re-originating TLS to pods
+	tls map[tlsKey]*http.Transport
+}
+
+// tlsKey identifies the transport of TLS connections to pods
+type tlsKey struct {
+	serverName string
+	// h2 negotiates HTTP/2 with ALPN
+	h2 bool
+}
+
+func newTransport(p *Proxy) *Transport {
+	t := &Transport{proxy: p, tls: map[tlsKey]*http.Transport{}}
+	t.tr = &http.Transport{
+		DialContext:           t.dial,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		DisableCompression:    true,
+	}
+	t.h2cPool = &h2cPool{t: t, conns: map[string][]*http2.ClientConn{}}
+	t.h2c = &http2.Transport{
+		AllowHTTP:          true,
+		DisableCompression: true,
+		ConnPool:           t.h2cPool,
+	}
+	return t
+}
+
+// h2cPool keeps the HTTP/2 connections to plain text pods. Unlike the default pool of
+// http2.Transport it dials with the context of the request, so the dial timeout of its route
+// applies.
+type h2cPool struct {
+	t     *Transport
+	lock  sync.Mutex
+	conns map[string][]*http2.ClientConn
+}
+
+func (p *h2cPool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	p.lock.Lock()
+	for _, cc := range p.conns[addr] {
+		if cc.CanTakeNewRequest() {
+			p.lock.Unlock()
+			return cc, nil
+		}
+	}
+	p.lock.Unlock()
+
+	conn, err := p.t.dial(req.Context(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := p.t.h2c.NewClientConn(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.conns[addr] = append(p.conns[addr], cc)
+	return cc, nil
+}
+
+func (p *h2cPool) MarkDead(dead *http2.ClientConn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for addr, conns := range p.conns {
+		for i, cc := range conns {
+			if cc == dead {
+				p.conns[addr] = append(conns[:i:i], conns[i+1:]...)
+				if len(p.conns[addr]) == 0 {
+					delete(p.conns, addr)
+				}
+				return
+			}
+		}
+	}
+}
+
+// closeIdle closes the connections without active streams
+func (p *h2cPool) closeIdle() {
+	p.lock.Lock()
+	var idle []*http2.ClientConn
+	for _, conns := range p.conns {
+		for _, cc := range conns {
+			if cc.State().StreamsActive == 0 {
+				idle = append(idle, cc)
+			}
+		}
+	}
+	p.lock.Unlock()
+	for _, cc := range idle {
+		// closed connections are marked dead by the transport
+		_ = cc.Close()
+	}
+}
+
+// tlsTransport returns the transport of TLS connections with serverName, connections are pooled
+// per pod so every server name needs its own pool to not reuse the handshake of another one
+func (t *Transport) tlsTransport(serverName string, h2 bool) *http.Transport {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := tlsKey{serverName: serverName, h2: h2}
+	if tr, ok := t.tls[key]; ok {
+		return tr
+	}
+	var nextProtos []string
+	if h2 {
+		nextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
+	tr := &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return t.dialTLS(ctx, network, addr, serverName, nextProtos)
+		},
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		DisableCompression:    true,
+	}
+	if h2 {
+		// only fails for transports already configured for HTTP/2
+		_, _ = http2.ConfigureTransports(tr)
+	}
+	t.tls[key] = tr
+	return tr
+}
+
+// isGRPC reports whether h belongs to a gRPC request or response
+func isGRPC(h http.Header) bool {
+	ct := h.Get("Content-Type")
+	return ct == "application/grpc" || strings.HasPrefix(ct, "application/grpc+") || strings.HasPrefix(ct, "application/grpc;")
+}
+
+// roundTripper returns the transport for req, gRPC requires HTTP/2 so gRPC requests are sent
+// with prior knowledge to plain text pods and with ALPN to pods serving TLS. Other requests
+// use HTTP/1.1 as the pod might not speak HTTP/2, even if the client did.
+func (t *Transport) roundTripper(req *http.Request) func(*http.Request) (*http.Response, error) {
+	grpc := isGRPC(req.Header)
+	if req.URL.Scheme == "https" {
+		serverName, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			serverName = req.Host
+		}
+		return t.tlsTransport(serverName, grpc).RoundTrip
+	}
+	if grpc {
+		return t.h2c.RoundTrip
+	}
+	return t.tr.RoundTrip
+}
+
+// podHost is the host the inner transport uses for connections to tp, connections are
+// pooled by it
+func podHost(tp *k8s.TargetPod) string {
+	return net.JoinHostPort(fmt.Sprintf("%s.%s", tp.Name, tp.Namespace), tp.Port)
+}
+
+// parsePodHost is the reverse of podHost
+func parsePodHost(addr string) (*k8s.TargetPod, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	// pod names may contain dots, namespaces don't
+	i := strings.LastIndex(host, ".")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid pod address %s", addr)
+	}
+	return &k8s.TargetPod{Name: host[:i], Namespace: host[i+1:], Port: port}, nil
+}
+
+func (t *Transport) dial(ctx context.Context, _, addr string) (net.Conn, error) {
+	tp, err := parsePodHost(addr)
+	if err != nil {
+		return nil, err
+	}
+	return t.proxy.dialPodWithin(tp, t.proxy.dialTimeout(ctx, tp))
+}
+
+// dialTLS re-originates TLS with serverName to the pod for intercepted requests, offering the
+// application protocols in nextProtos
+func (t *Transport) dialTLS(ctx context.Context, network, addr, serverName string, nextProtos []string) (net.Conn, error) {
+	conn, err := t.dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{}
+	if t.proxy.UpstreamTLS != nil {
+		cfg = t.proxy.UpstreamTLS.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = serverName
+	}
+	if nextProtos != nil {
+		cfg.NextProtos = nextProtos
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("tls handshake with pod failed: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// RoundTrip resolves the pod for req and sends the request to it
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tp, err := t.proxy.getTargetPod(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not get pod: %w", err)
+	}
+	return t.roundTrip(withTimeouts(req, t.proxy.hostTimeouts(req.Host, req.URL.Scheme == "https")), tp)
+}
+
+func (t *Transport) roundTrip(req *http.Request, tp *k8s.TargetPod) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	if out.Host == "" {
+		out.Host = req.URL.Host
+	}
+	out.URL.Scheme = "http"
+	if req.URL.Scheme == "https" {
+		out.URL.Scheme = "https"
+	}
+	out.URL.Host = podHost(tp)
+	removeHopHeaders(out.Header)
+	// the inner transport hands out the upgraded connection as body of the 101 response
+	if upType := upgradeType(req.Header); upType != "" {
+		out.Header.Set("Connection", "Upgrade")
+		out.Header.Set("Upgrade", upType)
+	}
+	// gRPC servers require the client to accept trailers
+	if strings.Contains(strings.ToLower(req.Header.Get("Te")), "trailers") {
+		out.Header.Set("Te", "trailers")
+	}
+
+	resp, err := t.waitResponse(out, responseHeaderTimeout(req.Context()))
+	if err != nil {
+		return nil, err
+	}
+	upType := upgradeType(resp.Header)
+	removeHopHeaders(resp.Header)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Header.Set("Connection", "Upgrade")
+		resp.Header.Set("Upgrade", upType)
+	}
+	resp.Request = req
+	return resp, nil
+}
+
+// waitResponse sends out to the pod, it gives up if the response headers take longer than
+// timeout once the request was written
+func (t *Transport) waitResponse(out *http.Request, timeout time.Duration) (*http.Response, error) {
+	roundTrip := t.roundTripper(out)
+	if timeout <= 0 {
+		return roundTrip(out)
+	}
+	ctx, cancel := context.WithCancel(out.Context())
+	timer := &responseTimer{timeout: timeout, cancel: cancel}
+	// slow uploads don't count, like http.Transport.ResponseHeaderTimeout
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) { timer.start() },
+	})
+	resp, err := roundTrip(out.WithContext(ctx))
+	expired := timer.stop()
+	if err != nil {
+		cancel()
+		if expired && ctx.Err() != nil {
+			return nil, &TimeoutError{Phase: phaseResponseHeader, Timeout: timeout}
+		}
+		return nil, err
+	}
+	// the context has to outlive the body
+	if conn, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &cancelConn{ReadWriteCloser: conn, cancel: cancel}
+		return resp, nil
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// responseTimer cancels a request if the response headers take longer than timeout after it
+// was written
+type responseTimer struct {
+	timeout time.Duration
+	cancel  context.CancelFunc
+
+	lock    sync.Mutex
+	timer   *time.Timer
+	stopped bool
+	expired bool
+}
+
+// start starts the timer, again if the request is retried
+func (t *responseTimer) start() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.stopped {
+		return
+	}
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.timer = time.AfterFunc(t.timeout, t.expire)
+}
+
+func (t *responseTimer) expire() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.stopped {
+		t.expired = true
+		t.cancel()
+	}
+}
+
+// stop stops the timer once the round trip returned, it reports whether the request was
+// cancelled by the timer
+func (t *responseTimer) stop() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.stopped = true
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	return t.expired
+}
+
+// cancelConn is the cancelBody of upgraded connections, which are written to as well
+type cancelConn struct {
+	io.ReadWriteCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelConn) Close() error {
+	err := c.ReadWriteCloser.Close()
+	c.cancel()
+	return err
+}
+
+// cancelBody cancels the context of the request once the body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// CloseIdleConnections closes all upstream connections not in use
+func (t *Transport) CloseIdleConnections() {
+	t.tr.CloseIdleConnections()
+	t.h2cPool.closeIdle()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, tr := range t.tls {
+		tr.CloseIdleConnections()
+	}
+}
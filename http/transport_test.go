@@ -0,0 +1,86 @@
+package http
+
+import (
+	"github.com/tipok/kubeproxy/k8s"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPodHost(t *testing.T) {
+	tp := &k8s.TargetPod{Name: "redis.master-0", Namespace: "home-notifier", Port: "6379"}
+	h := podHost(tp)
+	if h != "redis.master-0.home-notifier:6379" {
+		t.Errorf("unexpected pod host: %s", h)
+	}
+	parsed, err := parsePodHost(h)
+	if err != nil {
+		t.Fatalf("failed to parse pod host: %v", err)
+	}
+	if *parsed != *tp {
+		t.Errorf("unexpected target pod: %+v", parsed)
+	}
+	if _, err := parsePodHost("redis:6379"); err == nil {
+		t.Errorf("expected error for address without namespace")
+	}
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Connection", "keep-alive, X-Internal")
+	h.Set("X-Internal", "1")
+	h.Set("Proxy-Connection", "keep-alive")
+	h.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("Content-Type", "text/plain")
+
+	removeHopHeaders(h)
+
+	for _, k := range []string{"Connection", "X-Internal", "Proxy-Connection", "Proxy-Authorization", "Keep-Alive"} {
+		if h.Get(k) != "" {
+			t.Errorf("header %s not removed", k)
+		}
+	}
+	if h.Get("Content-Type") != "text/plain" {
+		t.Errorf("unexpected content type: %s", h.Get("Content-Type"))
+	}
+}
+
+func TestTransportKeepAlive(t *testing.T) {
+	p, con := newFakeProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		_, _ = w.Write([]byte(r.Host))
+	}))
+	tp := &k8s.TargetPod{Name: "web-0", Namespace: "shop", Port: "8080"}
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodPost, "http://web.shop.svc.cluster.local/", strings.NewReader("hello"))
+		resp, err := p.transport.roundTrip(req, tp)
+		if err != nil {
+			t.Fatalf("round trip failed: %v", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("could not read body: %v", err)
+		}
+		if err := resp.Body.Close(); err != nil {
+			t.Fatalf("could not close body: %v", err)
+		}
+		if string(body) != "web.shop.svc.cluster.local" {
+			t.Errorf("unexpected body: %s", body)
+		}
+	}
+
+	if n := atomic.LoadInt32(&con.dataStreams); n != 1 {
+		t.Errorf("expected one data stream, got %d", n)
+	}
+
+	p.Close()
+	if n := atomic.LoadInt32(&con.open); n != 0 {
+		t.Errorf("expected all streams to be closed, %d still open", n)
+	}
+}
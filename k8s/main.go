@@ -3,8 +3,12 @@ package k8s
 import (
 	"context"
 	"fmt"
+	log "github.com/go-pkgz/lgr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
@@ -14,17 +18,50 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// clusterIPTTL is how long the cluster IPs of services are cached, services created in the
+// meantime are found once it expired
+const clusterIPTTL = time.Minute
+
 type TargetPod struct {
 	Name      string
 	Port      string
 	Namespace string
 }
 
+type Service struct {
+	Name      string
+	Namespace string
+	Ports     []string
+	// NamedPorts maps port names to Ports
+	NamedPorts map[string]string
+}
+
+// ServiceEvent is sent by WatchServices
+type ServiceEvent struct {
+	Deleted bool
+	Service *Service
+}
+
 type Api struct {
 	api  v1.CoreV1Interface
 	conf *rest.Config
+	// context is the name of the kubeconfig context in use
+	context string
+	// OnLookup is called after every lookup of a pod by the resolver pod, service or ip if set
+	OnLookup func(resolver string, d time.Duration, err error)
+
+	lock sync.Mutex
+	// clusterIPs maps the cluster IPs of all services to their namespace and name
+	clusterIPs        map[string]serviceRef
+	clusterIPsExpires time.Time
+}
+
+type serviceRef struct {
+	namespace, name string
 }
 
 func New(kubeconfig string) (*Api, error) {
@@ -44,11 +81,44 @@ func New(kubeconfig string) (*Api, error) {
 		api:  apiInstance,
 		conf: kconf,
 	}
+	if kubeconfig != "" {
+		raw, err := clientcmd.LoadFromFile(kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("could not load k8s config: %w", err)
+		}
+		api.context = raw.CurrentContext
+	}
 
 	return api, nil
 }
 
-func (api *Api) GetMatchingPod(ctx context.Context, namespace, podName, port string) (*TargetPod, error) {
+// Context returns the name of the kubeconfig context, empty when running in a cluster
+func (api *Api) Context() string {
+	return api.context
+}
+
+// Ping checks that the API server is reachable and accepts the credentials of the kubeconfig
+func (api *Api) Ping(ctx context.Context) error {
+	_, err := api.api.Namespaces().List(ctx, metav1.ListOptions{Limit: 1})
+	// users restricted to some namespaces are authenticated nevertheless
+	if err == nil || apierrors.IsForbidden(err) {
+		return nil
+	}
+	if apierrors.IsUnauthorized(err) {
+		return fmt.Errorf("not authenticated: %w", err)
+	}
+	return fmt.Errorf("API server unreachable: %w", err)
+}
+
+// observe passes a lookup started at start to OnLookup
+func (api *Api) observe(resolver string, start time.Time, err error) {
+	if api.OnLookup != nil {
+		api.OnLookup(resolver, time.Since(start), err)
+	}
+}
+
+func (api *Api) GetMatchingPod(ctx context.Context, namespace, podName, port string) (_ *TargetPod, err error) {
+	defer func(start time.Time) { api.observe("pod", start, err) }(time.Now())
 	pod, err := api.api.Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("could not find pods: %w", err)
@@ -74,10 +144,11 @@ func (api *Api) GetMatchingPod(ctx context.Context, namespace, podName, port str
 	}, nil
 }
 
-func (api *Api) GetMatchingPodForService(ctx context.Context, namespace, serviceName, port string) (*TargetPod, error) {
+func (api *Api) GetMatchingPodForService(ctx context.Context, namespace, serviceName, port string) (_ *TargetPod, err error) {
+	defer func(start time.Time) { api.observe("service", start, err) }(time.Now())
 	svc, err := api.api.Services(namespace).Get(ctx, serviceName, metav1.GetOptions{})
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("could not find service: %w", err)
 	}
 
 	var podPort string
@@ -111,6 +182,260 @@ func (api *Api) GetMatchingPodForService(ctx context.Context, namespace, service
 	}, nil
 }
 
+// GetMatchingPodForIP returns the pod with the IP address or a pod of the service with the
+// cluster IP address
+func (api *Api) GetMatchingPodForIP(ctx context.Context, ip, port string) (_ *TargetPod, err error) {
+	defer func(start time.Time) { api.observe("ip", start, err) }(time.Now())
+	pods, err := api.api.Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{FieldSelector: "status.podIP=" + ip})
+	if err != nil {
+		return nil, fmt.Errorf("could not find pods: %w", err)
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodRunning {
+			return &TargetPod{Namespace: pod.Namespace, Name: pod.Name, Port: port}, nil
+		}
+	}
+
+	svc, ok, err := api.serviceForClusterIP(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("no pod or service found for %s", ip)
+	}
+	return api.GetMatchingPodForService(ctx, svc.namespace, svc.name, port)
+}
+
+// serviceForClusterIP returns the service with the cluster IP, the services of all namespaces
+// are listed at most once per clusterIPTTL
+func (api *Api) serviceForClusterIP(ctx context.Context, ip string) (serviceRef, bool, error) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	if api.clusterIPs == nil || time.Now().After(api.clusterIPsExpires) {
+		svcs, err := api.api.Services(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return serviceRef{}, false, fmt.Errorf("could not find services: %w", err)
+		}
+		api.clusterIPs = map[string]serviceRef{}
+		for _, svc := range svcs.Items {
+			for _, clusterIP := range append([]string{svc.Spec.ClusterIP}, svc.Spec.ClusterIPs...) {
+				if clusterIP != "" && clusterIP != corev1.ClusterIPNone {
+					api.clusterIPs[clusterIP] = serviceRef{namespace: svc.Namespace, name: svc.Name}
+				}
+			}
+		}
+		api.clusterIPsExpires = time.Now().Add(clusterIPTTL)
+	}
+	svc, ok := api.clusterIPs[ip]
+	return svc, ok, nil
+}
+
+// ListServices returns the services of namespace selecting pods, services without selector
+// can't be resolved to a pod
+func (api *Api) ListServices(ctx context.Context, namespace string) ([]*Service, error) {
+	svcs, err := api.api.Services(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list services: %w", err)
+	}
+	var services []*Service
+	for _, svc := range svcs.Items {
+		if s := newService(&svc); s != nil {
+			services = append(services, s)
+		}
+	}
+	return services, nil
+}
+
+// newService returns nil for services without selector
+func newService(svc *corev1.Service) *Service {
+	if len(svc.Spec.Selector) == 0 {
+		return nil
+	}
+	s := &Service{Name: svc.Name, Namespace: svc.Namespace, NamedPorts: map[string]string{}}
+	for _, p := range svc.Spec.Ports {
+		if p.Protocol == corev1.ProtocolTCP || p.Protocol == "" {
+			s.Ports = append(s.Ports, strconv.Itoa(int(p.Port)))
+			if p.Name != "" {
+				s.NamedPorts[p.Name] = strconv.Itoa(int(p.Port))
+			}
+		}
+	}
+	return s
+}
+
+// GetService returns the service if it selects pods
+func (api *Api) GetService(ctx context.Context, namespace, serviceName string) (*Service, error) {
+	svc, err := api.api.Services(namespace).Get(ctx, serviceName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not find service: %w", err)
+	}
+	s := newService(svc)
+	if s == nil {
+		return nil, fmt.Errorf("service %s.%s has no selector", serviceName, namespace)
+	}
+	return s, nil
+}
+
+// GetSecretValue returns the value of key in the secret
+func (api *Api) GetSecretValue(ctx context.Context, namespace, secretName, key string) (string, error) {
+	secret, err := api.api.Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not find secret: %w", err)
+	}
+	value, ok := secret.Data[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s.%s has no key %s", secretName, namespace, key)
+	}
+	return string(value), nil
+}
+
+// GetPodPorts returns the container ports of the pod like the ports of a service
+func (api *Api) GetPodPorts(ctx context.Context, namespace, podName string) (*Service, error) {
+	pod, err := api.api.Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not find pod: %w", err)
+	}
+	s := &Service{Name: pod.Name, Namespace: pod.Namespace, NamedPorts: map[string]string{}}
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			if p.Protocol == corev1.ProtocolTCP || p.Protocol == "" {
+				s.Ports = append(s.Ports, strconv.Itoa(int(p.ContainerPort)))
+				if p.Name != "" {
+					s.NamedPorts[p.Name] = strconv.Itoa(int(p.ContainerPort))
+				}
+			}
+		}
+	}
+	return s, nil
+}
+
+// WatchServices sends the services of namespace selecting pods as they appear, change and
+// disappear until ctx is done. Existing services are sent first. When the watch expired the
+// services are listed again, services deleted in the meantime are sent as deleted.
+func (api *Api) WatchServices(ctx context.Context, namespace string) (<-chan ServiceEvent, error) {
+	list, err := api.api.Services(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list services: %w", err)
+	}
+
+	events := make(chan ServiceEvent)
+	go func() {
+		defer close(events)
+		w := &serviceWatch{events: events, known: map[string]*Service{}}
+		for {
+			if list != nil {
+				if !w.sync(ctx, list) {
+					return
+				}
+				w.resourceVersion = list.ResourceVersion
+			}
+			expired, err := w.follow(ctx, api.api.Services(namespace))
+			if ctx.Err() != nil {
+				return
+			}
+			if expired {
+				log.Printf("[INFO] watch of services of %s expired, listing them again", namespace)
+			} else if err != nil {
+				log.Printf("[ERROR] could not watch services of %s: %v", namespace, err)
+			}
+
+			// the api server closes watches after a while, they are continued unless the
+			// resource version expired
+			list = nil
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Second):
+				}
+				if !expired {
+					break
+				}
+				if list, err = api.api.Services(namespace).List(ctx, metav1.ListOptions{}); err == nil {
+					break
+				}
+				log.Printf("[ERROR] could not list services of %s: %v", namespace, err)
+			}
+		}
+	}()
+	return events, nil
+}
+
+// serviceWatch keeps the services sent by WatchServices
+type serviceWatch struct {
+	events          chan<- ServiceEvent
+	resourceVersion string
+	// known are the services sent and not deleted by their namespace and name
+	known map[string]*Service
+}
+
+// send sends the event of svc, it returns false once ctx is done
+func (w *serviceWatch) send(ctx context.Context, svc *corev1.Service, deleted bool) bool {
+	key := svc.Namespace + "/" + svc.Name
+	event := ServiceEvent{Service: newService(svc)}
+	if deleted || event.Service == nil {
+		event.Deleted = true
+		event.Service = &Service{Name: svc.Name, Namespace: svc.Namespace}
+		delete(w.known, key)
+	} else {
+		w.known[key] = event.Service
+	}
+	select {
+	case w.events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// sync sends the listed services and the known services missing in list as deleted
+func (w *serviceWatch) sync(ctx context.Context, list *corev1.ServiceList) bool {
+	listed := map[string]bool{}
+	for i := range list.Items {
+		svc := &list.Items[i]
+		listed[svc.Namespace+"/"+svc.Name] = true
+		if !w.send(ctx, svc, false) {
+			return false
+		}
+	}
+	for key, known := range w.known {
+		if listed[key] {
+			continue
+		}
+		gone := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: known.Name, Namespace: known.Namespace}}
+		if !w.send(ctx, gone, true) {
+			return false
+		}
+	}
+	return true
+}
+
+// follow sends the changes after resourceVersion until the watch is closed, it reports whether
+// the resource version expired
+func (w *serviceWatch) follow(ctx context.Context, services v1.ServiceInterface) (bool, error) {
+	watcher, err := services.Watch(ctx, metav1.ListOptions{ResourceVersion: w.resourceVersion})
+	if err != nil {
+		return apierrors.IsResourceExpired(err) || apierrors.IsGone(err), err
+	}
+	defer watcher.Stop()
+	for ev := range watcher.ResultChan() {
+		svc, ok := ev.Object.(*corev1.Service)
+		if !ok {
+			// watch.Error events carry a status, usually 410 Gone as the resource version expired
+			if status, ok := ev.Object.(*metav1.Status); ok {
+				err := &apierrors.StatusError{ErrStatus: *status}
+				return apierrors.IsResourceExpired(err) || apierrors.IsGone(err), err
+			}
+			continue
+		}
+		w.resourceVersion = svc.ResourceVersion
+		if !w.send(ctx, svc, ev.Type == watch.Deleted) {
+			return false, nil
+		}
+	}
+	return false, nil
+}
+
 func (api *Api) Dialer(p *TargetPod) (httpstream.Dialer, error) {
 	transport, upgrader, err := spdy.RoundTripperFor(api.conf)
 	if err != nil {
@@ -0,0 +1,111 @@
+package k8s
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTestService(name string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "shop"},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{"app": name},
+			Ports:    []corev1.ServicePort{{Name: "http", Port: 80}},
+		},
+	}
+}
+
+func TestWatchServicesExpired(t *testing.T) {
+	clientset := fake.NewSimpleClientset(newTestService("orders"), newTestService("payments"))
+	watchers := make(chan *watch.FakeWatcher, 2)
+	clientset.PrependWatchReactor("services", func(k8stesting.Action) (bool, watch.Interface, error) {
+		w := watch.NewFake()
+		watchers <- w
+		return true, w, nil
+	})
+	api := &Api{api: clientset.CoreV1()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := api.WatchServices(ctx, "shop")
+	if err != nil {
+		t.Fatalf("could not watch services: %v", err)
+	}
+	next := func() ServiceEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event sent")
+			return ServiceEvent{}
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if ev := next(); ev.Deleted {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	}
+
+	// payments is deleted while the watch is expired
+	if err := clientset.Tracker().Delete(corev1.SchemeGroupVersion.WithResource("services"), "shop", "payments"); err != nil {
+		t.Fatalf("could not delete service: %v", err)
+	}
+	w := <-watchers
+	w.Error(&metav1.Status{Status: metav1.StatusFailure, Code: http.StatusGone, Reason: metav1.StatusReasonExpired})
+	w.Stop()
+
+	deleted := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		ev := next()
+		deleted[ev.Service.Name] = ev.Deleted
+	}
+	if len(deleted) != 2 || deleted["orders"] || !deleted["payments"] {
+		t.Errorf("expected payments to be deleted after listing again, got %v", deleted)
+	}
+	// the changes after the new list are followed
+	w = <-watchers
+	w.Add(newTestService("stock"))
+	if ev := next(); ev.Deleted || ev.Service.Name != "stock" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+}
+
+func TestGetMatchingPodForIPCached(t *testing.T) {
+	svc := newTestService("orders")
+	svc.Spec.ClusterIP = "10.96.0.10"
+	// not running, so it is only found through the service
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "orders-0", Namespace: "shop", Labels: map[string]string{"app": "orders"}},
+		Status:     corev1.PodStatus{Phase: corev1.PodPending},
+	}
+	clientset := fake.NewSimpleClientset(svc, pod)
+	api := &Api{api: clientset.CoreV1()}
+
+	for i := 0; i < 3; i++ {
+		tp, err := api.GetMatchingPodForIP(context.Background(), "10.96.0.10", "80")
+		if err != nil {
+			t.Fatalf("could not find pod: %v", err)
+		}
+		if tp.Name != "orders-0" || tp.Namespace != "shop" {
+			t.Errorf("unexpected pod %+v", tp)
+		}
+	}
+	if _, err := api.GetMatchingPodForIP(context.Background(), "10.96.0.11", "80"); err == nil {
+		t.Errorf("expected unknown address to fail")
+	}
+	lists := 0
+	for _, action := range clientset.Actions() {
+		if action.Matches("list", "services") {
+			lists++
+		}
+	}
+	if lists != 1 {
+		t.Errorf("expected services to be listed once, listed %d times", lists)
+	}
+}